@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Registry of the known mining software. The user agent of a miner, sent in the Xatum handshake
+// or in the User-Agent header of Getwork, is parsed into the name and version of its software.
+// Known miners have quirks, which the proxy works around, and versions with known bugs, which get
+// a warning. Unknown miners get the default behavior, and a warning.
+
+// Quirks are the behaviors of a miner which the proxy works around
+type Quirks struct {
+	NoPrint       bool // mishandles print packets, so they aren't sent to it
+	NoXnPrefix    bool // ignores xn_prefix, and only keeps the first DEFAULT_XN_PREFIX bytes of the extra nonce
+	BlockTemplate bool // submits its Getwork work with the block_template key instead of miner_work
+}
+
+func (q Quirks) or(o Quirks) Quirks {
+	return Quirks{
+		NoPrint:       q.NoPrint || o.NoPrint,
+		NoXnPrefix:    q.NoXnPrefix || o.NoXnPrefix,
+		BlockTemplate: q.BlockTemplate || o.BlockTemplate,
+	}
+}
+
+// String returns the names of the quirks, separated by commas
+func (q Quirks) String() string {
+	res := make([]string, 0, 3)
+	if q.NoPrint {
+		res = append(res, "no_print")
+	}
+	if q.NoXnPrefix {
+		res = append(res, "no_xn_prefix")
+	}
+	if q.BlockTemplate {
+		res = append(res, "block_template")
+	}
+	return strings.Join(res, ",")
+}
+
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// the first version number of a user agent, like 1.2.3, v1.2 or 2, which isn't part of a word
+var versionRegexp = regexp.MustCompile(`(?:^|[^0-9a-z_])v?(\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
+// ParseVersion returns the first version number of s, and false if there isn't one
+func ParseVersion(s string) (Version, bool) {
+	m := versionRegexp.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return Version{}, false
+	}
+
+	n := [3]int{}
+	for i, v := range m[1:] {
+		if v == "" {
+			continue
+		}
+		x, err := strconv.Atoi(v)
+		if err != nil {
+			return Version{}, false
+		}
+		n[i] = x
+	}
+	return Version{n[0], n[1], n[2]}, true
+}
+
+func (v Version) Compare(o Version) int {
+	return cmp.Or(cmp.Compare(v.Major, o.Major), cmp.Compare(v.Minor, o.Minor), cmp.Compare(v.Patch, o.Patch))
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Bug is a known bug of the versions from Since (included) to Before (excluded). A zero Since
+// matches all the versions before Before, and a zero Before all the versions since Since.
+type Bug struct {
+	Since, Before Version
+
+	Quirks  Quirks // quirks of the buggy versions, added to the quirks of the miner
+	Warning string // sent to the miners with a buggy version, if not empty
+}
+
+func (b Bug) match(v Version) bool {
+	return v.Compare(b.Since) >= 0 && (b.Before == Version{} || v.Compare(b.Before) < 0)
+}
+
+// Miner is a known mining software
+type Miner struct {
+	Name     string
+	Prefixes []string // lowercase prefixes of its user agents
+	Quirks   Quirks
+	Bugs     []Bug // only checked if the user agent has a version
+}
+
+// Agent is a parsed user agent
+type Agent struct {
+	Name       string // name of the known miner, or the first word of an unknown user agent
+	Version    Version
+	HasVersion bool
+	Known      bool
+
+	Quirks  Quirks
+	Warning string // the reason the miner gets a warning, empty if it doesn't
+}
+
+// String returns the name and version of the miner, like "xelis-miner 1.2.0"
+func (a Agent) String() string {
+	if a.HasVersion {
+		return a.Name + " " + a.Version.String()
+	}
+	return a.Name
+}
+
+type Registry []Miner
+
+// Parse returns the miner of the user agent. Unknown miners get a warning.
+func (r Registry) Parse(userAgent string) Agent {
+	lower := strings.ToLower(strings.TrimSpace(userAgent))
+
+	for _, m := range r {
+		for _, prefix := range m.Prefixes {
+			rest, ok := strings.CutPrefix(lower, prefix)
+			if !ok {
+				continue
+			}
+
+			a := Agent{
+				Name:   m.Name,
+				Known:  true,
+				Quirks: m.Quirks,
+			}
+			a.Version, a.HasVersion = ParseVersion(rest)
+			if !a.HasVersion {
+				return a
+			}
+
+			for _, b := range m.Bugs {
+				if !b.match(a.Version) {
+					continue
+				}
+				a.Quirks = a.Quirks.or(b.Quirks)
+				if b.Warning != "" {
+					a.Warning = b.Warning
+				}
+			}
+			return a
+		}
+	}
+
+	// the name is the first word, like "foo-miner" in "foo-miner/1.0 (linux)"
+	words := strings.FieldsFunc(strings.TrimSpace(userAgent), func(r rune) bool {
+		return r == ' ' || r == '/'
+	})
+	if len(words) == 0 {
+		return Agent{
+			Name:    "unknown",
+			Warning: "your miner did not send its name, the proxy may not work around its quirks",
+		}
+	}
+	name := words[0]
+
+	a := Agent{
+		Name:    name,
+		Warning: "your miner " + name + " is unknown to the proxy, please report any issue",
+	}
+	a.Version, a.HasVersion = ParseVersion(strings.TrimPrefix(lower, strings.ToLower(name)))
+	return a
+}
+
+// Known are the mining software known to the proxy. Agents which start with the name of another
+// one must be before it.
+var Known = Registry{
+	{
+		// the official XELIS miner, which mines with Getwork
+		Name:     "xelis-miner",
+		Prefixes: []string{"xelis-miner", "xelis_miner"},
+		Quirks: Quirks{
+			BlockTemplate: true,
+		},
+	},
+	{
+		// the reference Xatum miner, which predates xn_prefix. Proxies connected to this one use
+		// its user agent too, but they request an extra nonce slice, so they know xn_prefix.
+		Name:     "XelMiner",
+		Prefixes: []string{"xelminer"},
+		Quirks: Quirks{
+			NoXnPrefix: true,
+		},
+	},
+	{
+		Name:     "SRBMiner-MULTI",
+		Prefixes: []string{"srbminer"},
+	},
+	{
+		Name:     "lolMiner",
+		Prefixes: []string{"lolminer"},
+	},
+	{
+		Name:     "Rigel",
+		Prefixes: []string{"rigel"},
+	},
+	{
+		Name:     "OneZeroMiner",
+		Prefixes: []string{"onezerominer"},
+	},
+	{
+		Name:     "BzMiner",
+		Prefixes: []string{"bzminer"},
+	},
+	{
+		Name:     "TNN-Miner",
+		Prefixes: []string{"tnn-miner"},
+	},
+}
+
+// Parse returns the miner of the user agent, from the Known registry
+func Parse(userAgent string) Agent {
+	return Known.Parse(userAgent)
+}
@@ -0,0 +1,131 @@
+package agent
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s   string
+		v   Version
+		has bool
+	}{
+		{"1.2.3", Version{1, 2, 3}, true},
+		{"/1.2.3", Version{1, 2, 3}, true},
+		{" v0.3", Version{0, 3, 0}, true},
+		{" 1.82a", Version{1, 82, 0}, true},
+		{"-MULTI/2.4.5 (linux)", Version{2, 4, 5}, true},
+		{" build 7", Version{7, 0, 0}, true},
+		{" ALPHA", Version{}, false},
+		{"x86_64", Version{}, false},
+		{"", Version{}, false},
+	}
+
+	for _, v := range tests {
+		res, has := ParseVersion(v.s)
+		if res != v.v || has != v.has {
+			t.Fatalf("%q: expected %v %v, got %v %v", v.s, v.v, v.has, res, has)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	if (Version{1, 2, 3}).Compare(Version{1, 10, 0}) != -1 {
+		t.Fatal("expected 1.2.3 < 1.10.0")
+	}
+	if (Version{2, 0, 0}).Compare(Version{1, 99, 99}) != 1 {
+		t.Fatal("expected 2.0.0 > 1.99.99")
+	}
+	if (Version{1, 2, 3}).Compare(Version{1, 2, 3}) != 0 {
+		t.Fatal("expected 1.2.3 == 1.2.3")
+	}
+}
+
+func TestParse(t *testing.T) {
+	reg := Registry{
+		{
+			Name:     "foo-miner-ng",
+			Prefixes: []string{"foo-miner-ng"},
+		},
+		{
+			Name:     "FooMiner",
+			Prefixes: []string{"foo-miner", "foominer"},
+			Quirks:   Quirks{BlockTemplate: true},
+			Bugs: []Bug{
+				{Before: Version{1, 0, 0}, Quirks: Quirks{NoPrint: true}},
+				{Since: Version{1, 2, 0}, Before: Version{1, 3, 0}, Warning: "1.2 loses shares"},
+				{Since: Version{2, 0, 0}, Warning: "2.x is a beta"},
+			},
+		},
+	}
+
+	tests := []struct {
+		ua  string
+		exp Agent
+	}{
+		{"foo-miner/1.1.0", Agent{Name: "FooMiner", Version: Version{1, 1, 0}, HasVersion: true, Known: true,
+			Quirks: Quirks{BlockTemplate: true}}},
+		{"FOOMINER 0.9", Agent{Name: "FooMiner", Version: Version{0, 9, 0}, HasVersion: true, Known: true,
+			Quirks: Quirks{BlockTemplate: true, NoPrint: true}}},
+		{"foo-miner/1.2.9", Agent{Name: "FooMiner", Version: Version{1, 2, 9}, HasVersion: true, Known: true,
+			Quirks: Quirks{BlockTemplate: true}, Warning: "1.2 loses shares"}},
+		{"foo-miner v1.3", Agent{Name: "FooMiner", Version: Version{1, 3, 0}, HasVersion: true, Known: true,
+			Quirks: Quirks{BlockTemplate: true}}},
+		{"foo-miner/3.0.0", Agent{Name: "FooMiner", Version: Version{3, 0, 0}, HasVersion: true, Known: true,
+			Quirks: Quirks{BlockTemplate: true}, Warning: "2.x is a beta"}},
+		// the bugs are only checked with a version
+		{"foo-miner", Agent{Name: "FooMiner", Known: true, Quirks: Quirks{BlockTemplate: true}}},
+		{"foo-miner-ng/0.1", Agent{Name: "foo-miner-ng", Version: Version{0, 1, 0}, HasVersion: true, Known: true}},
+		{"bar-miner/2.1 (linux)", Agent{Name: "bar-miner", Version: Version{2, 1, 0}, HasVersion: true,
+			Warning: "your miner bar-miner is unknown to the proxy, please report any issue"}},
+		{"", Agent{Name: "unknown", Warning: "your miner did not send its name, the proxy may not work around its quirks"}},
+		{"/", Agent{Name: "unknown", Warning: "your miner did not send its name, the proxy may not work around its quirks"}},
+		{"\t", Agent{Name: "unknown", Warning: "your miner did not send its name, the proxy may not work around its quirks"}},
+		{"   /  ", Agent{Name: "unknown", Warning: "your miner did not send its name, the proxy may not work around its quirks"}},
+	}
+
+	for _, v := range tests {
+		if a := reg.Parse(v.ua); a != v.exp {
+			t.Fatalf("%q: expected %+v, got %+v", v.ua, v.exp, a)
+		}
+	}
+}
+
+func TestKnown(t *testing.T) {
+	for ua, name := range map[string]string{
+		"xelis-miner/1.2.0":    "xelis-miner",
+		"XelMiner ALPHA":       "XelMiner",
+		"SRBMiner-MULTI/2.4.5": "SRBMiner-MULTI",
+		"lolMiner 1.82":        "lolMiner",
+		"TNN-Miner v0.3.2":     "TNN-Miner",
+	} {
+		a := Parse(ua)
+		if !a.Known || a.Name != name || a.Warning != "" {
+			t.Fatalf("%q: expected the known miner %s, got %+v", ua, name, a)
+		}
+	}
+
+	// the names are unique, and each prefix only matches its miner
+	for i, m := range Known {
+		for _, prefix := range m.Prefixes {
+			if a := Known.Parse(prefix); a.Name != m.Name {
+				t.Fatalf("prefix %q of %s matches %s", prefix, m.Name, a.Name)
+			}
+		}
+		for _, o := range Known[i+1:] {
+			if o.Name == m.Name {
+				t.Fatalf("duplicate miner %s", m.Name)
+			}
+		}
+	}
+}
+
+func TestAgentString(t *testing.T) {
+	if s := Parse("xelis-miner/1.2").String(); s != "xelis-miner 1.2.0" {
+		t.Fatalf("unexpected %q", s)
+	}
+	if s := Parse("XelMiner ALPHA").String(); s != "XelMiner" {
+		t.Fatalf("unexpected %q", s)
+	}
+	if s := (Quirks{NoPrint: true, BlockTemplate: true}).String(); s != "no_print,block_template" {
+		t.Fatalf("unexpected %q", s)
+	}
+}
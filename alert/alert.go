@@ -0,0 +1,245 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+	"xatum-proxy/log"
+)
+
+// Alerting via webhooks and local commands.
+// An alert is identified by its key. It is notified once when it starts firing, and once when it
+// is resolved. Alerts that fire again within the debounce period of the last notification are
+// not notified, so flapping conditions don't flood the receivers, unless they still fire after it.
+// Events, like a found block, are notified once, without debounce.
+
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+	StatusEvent    = "event"
+)
+
+const DELIVERY_TIMEOUT = 10 * time.Second
+
+type Alert struct {
+	Kind   string         `json:"kind"`
+	Key    string         `json:"key"`
+	Status string         `json:"status"`
+	Msg    string         `json:"msg"`
+	Time   int64          `json:"time"` // unix milliseconds
+	Data   map[string]any `json:"data,omitempty"`
+}
+
+type Config struct {
+	Webhooks []string // URLs which receive the alerts as a JSON POST request
+	Command  string   // command which receives the alerts as JSON on stdin
+	Debounce time.Duration
+}
+
+type state struct {
+	active     bool
+	notified   bool
+	lastNotify time.Time
+}
+
+type Alerter struct {
+	cfg    Config
+	client *http.Client
+
+	// Now returns the current time. It can be replaced in tests.
+	Now func() time.Time
+
+	states map[string]*state
+	wg     sync.WaitGroup
+
+	sync.Mutex
+}
+
+func New(cfg Config) *Alerter {
+	return &Alerter{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: DELIVERY_TIMEOUT,
+		},
+		Now:    time.Now,
+		states: make(map[string]*state),
+	}
+}
+
+// Enabled returns true if there is at least one receiver
+func (a *Alerter) Enabled() bool {
+	return len(a.cfg.Webhooks) > 0 || a.cfg.Command != ""
+}
+
+// Fire starts an alert. Nothing happens if the alert is already firing, unless it was debounced:
+// then it's notified once the debounce period is over.
+func (a *Alerter) Fire(kind, key, msg string, data map[string]any) {
+	a.Lock()
+	defer a.Unlock()
+
+	st, ok := a.states[key]
+	if !ok {
+		st = &state{}
+		a.states[key] = st
+	}
+	if st.active && st.notified {
+		return
+	}
+
+	now := a.Now()
+
+	if !st.lastNotify.IsZero() && now.Sub(st.lastNotify) < a.cfg.Debounce {
+		if !st.active {
+			log.Debugf("alert %s is debounced", key)
+		}
+		st.active = true
+		st.notified = false
+		return
+	}
+	st.active = true
+	st.notified = true
+	st.lastNotify = now
+
+	log.Warnf("ALERT %s: %s", kind, msg)
+
+	a.send(Alert{
+		Kind:   kind,
+		Key:    key,
+		Status: StatusFiring,
+		Msg:    msg,
+		Time:   now.UnixMilli(),
+		Data:   data,
+	})
+}
+
+// Resolve ends an alert, and sends a recovery notification if the alert was notified
+func (a *Alerter) Resolve(kind, key, msg string) {
+	a.Lock()
+	defer a.Unlock()
+
+	st, ok := a.states[key]
+	if !ok || !st.active {
+		return
+	}
+
+	st.active = false
+	if !st.notified {
+		return
+	}
+
+	now := a.Now()
+	st.lastNotify = now
+
+	log.Infof("RESOLVED %s: %s", kind, msg)
+
+	a.send(Alert{
+		Kind:   kind,
+		Key:    key,
+		Status: StatusResolved,
+		Msg:    msg,
+		Time:   now.UnixMilli(),
+	})
+}
+
+// Notify sends an event, which isn't firing or resolved: it is always notified
+func (a *Alerter) Notify(kind, key, msg string, data map[string]any) {
+	a.Lock()
+	defer a.Unlock()
+
+	log.Infof("EVENT %s: %s", kind, msg)
+
+	a.send(Alert{
+		Kind:   kind,
+		Key:    key,
+		Status: StatusEvent,
+		Msg:    msg,
+		Time:   a.Now().UnixMilli(),
+		Data:   data,
+	})
+}
+
+// Active returns true if the alert with the given key is firing
+func (a *Alerter) Active(key string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	st, ok := a.states[key]
+	return ok && st.active
+}
+
+// Wait waits for the pending deliveries
+func (a *Alerter) Wait() {
+	a.wg.Wait()
+}
+
+// delivers the alert to all the receivers without blocking
+func (a *Alerter) send(al Alert) {
+	data, err := json.Marshal(al)
+	if err != nil {
+		log.Err(err)
+		return
+	}
+
+	for _, url := range a.cfg.Webhooks {
+		a.wg.Add(1)
+		go func(url string) {
+			defer a.wg.Done()
+
+			err := a.postWebhook(url, data)
+			if err != nil {
+				log.Warnf("failed to send alert to webhook %s: %s", url, err)
+			}
+		}(url)
+	}
+
+	if a.cfg.Command != "" {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+
+			err := a.runCommand(al, data)
+			if err != nil {
+				log.Warnf("alert command failed: %s", err)
+			}
+		}()
+	}
+}
+
+func (a *Alerter) postWebhook(url string, data []byte) error {
+	res, err := a.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+func (a *Alerter) runCommand(al Alert, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DELIVERY_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, a.cfg.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"XATUM_ALERT_KIND="+al.Kind,
+		"XATUM_ALERT_KEY="+al.Key,
+		"XATUM_ALERT_STATUS="+al.Status,
+		"XATUM_ALERT_MSG="+al.Msg,
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
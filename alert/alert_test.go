@@ -0,0 +1,162 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receiver struct {
+	alerts []Alert
+	sync.Mutex
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	al := Alert{}
+	err := json.NewDecoder(req.Body).Decode(&al)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.Lock()
+	r.alerts = append(r.alerts, al)
+	r.Unlock()
+}
+
+func (r *receiver) get() []Alert {
+	r.Lock()
+	defer r.Unlock()
+	return append([]Alert{}, r.alerts...)
+}
+
+func TestAlerter(t *testing.T) {
+	rcv := &receiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	now := time.Unix(1700000000, 0)
+
+	a := New(Config{
+		Webhooks: []string{srv.URL},
+		Debounce: 5 * time.Minute,
+	})
+	a.Now = func() time.Time {
+		return now
+	}
+
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", map[string]any{"worker": "rig1"})
+	// firing again does nothing
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", nil)
+	a.Wait()
+
+	alerts := rcv.get()
+	if len(alerts) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(alerts))
+	}
+	if alerts[0].Status != StatusFiring || alerts[0].Key != "worker:rig1" || alerts[0].Data["worker"] != "rig1" {
+		t.Fatalf("unexpected alert %+v", alerts[0])
+	}
+
+	now = now.Add(time.Minute)
+	a.Resolve("worker_dead", "worker:rig1", "rig1 is back")
+	a.Wait()
+
+	alerts = rcv.get()
+	if len(alerts) != 2 || alerts[1].Status != StatusResolved {
+		t.Fatalf("expected a recovery notification, got %+v", alerts)
+	}
+
+	// flapping within the debounce period is not notified, and neither is its recovery
+	now = now.Add(time.Minute)
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", nil)
+	if !a.Active("worker:rig1") {
+		t.Fatal("debounced alert should be active")
+	}
+	a.Resolve("worker_dead", "worker:rig1", "rig1 is back")
+	a.Wait()
+
+	if len(rcv.get()) != 2 {
+		t.Fatalf("debounced alert was notified: %+v", rcv.get())
+	}
+
+	// after the debounce period, alerts are notified again
+	now = now.Add(10 * time.Minute)
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", nil)
+	a.Wait()
+
+	if len(rcv.get()) != 3 {
+		t.Fatalf("expected 3 alerts, got %+v", rcv.get())
+	}
+
+	// a debounced alert which keeps firing is notified after the debounce period
+	now = now.Add(time.Minute)
+	a.Resolve("worker_dead", "worker:rig1", "rig1 is back")
+	now = now.Add(time.Minute)
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", nil)
+	now = now.Add(time.Minute)
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", nil)
+	a.Wait()
+
+	if len(rcv.get()) != 4 {
+		t.Fatalf("expected 4 alerts, got %+v", rcv.get())
+	}
+
+	now = now.Add(5 * time.Minute)
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", nil)
+	a.Fire("worker_dead", "worker:rig1", "rig1 is dead", nil)
+	a.Wait()
+
+	alerts = rcv.get()
+	if len(alerts) != 5 || alerts[4].Status != StatusFiring {
+		t.Fatalf("expected the debounced alert, got %+v", alerts)
+	}
+}
+
+func TestAlerterNotify(t *testing.T) {
+	rcv := &receiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	a := New(Config{
+		Webhooks: []string{srv.URL},
+		Debounce: 5 * time.Minute,
+	})
+
+	// events are never debounced
+	a.Notify("block_found", "block_found:aa", "block found", map[string]any{"height": 10})
+	a.Notify("block_found", "block_found:bb", "block found", nil)
+	a.Wait()
+
+	alerts := rcv.get()
+	if len(alerts) != 2 {
+		t.Fatalf("expected 2 events, got %+v", alerts)
+	}
+	for _, v := range alerts {
+		if v.Status != StatusEvent || v.Kind != "block_found" {
+			t.Fatalf("unexpected event %+v", v)
+		}
+	}
+	if a.Active("block_found:aa") {
+		t.Fatal("events are not active alerts")
+	}
+}
+
+func TestAlerterWebhookError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	a := New(Config{
+		Webhooks: []string{srv.URL},
+	})
+
+	err := a.postWebhook(srv.URL, []byte("{}"))
+	if err == nil {
+		t.Fatal("expected an error for status 500")
+	}
+}
@@ -1,74 +1,121 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"xatum-proxy/config"
 	"xatum-proxy/log"
+	"xatum-proxy/proxy"
 )
 
-type Config struct {
-	WalletAddress   string
-	PoolAddress     string
-	XatumBindPort   uint16
-	GetworkBindPort uint16
-	Debug           bool
-}
+// prefix of the environment variables which override the configuration, like
+// XATUM_PROXY_WALLET_ADDRESS
+const ENV_PREFIX = "XATUM_PROXY_"
 
-// 5210: Getwork
-// 5211: Xatum
-// 5212: Xatum public (mining pools)
+// configuration files looked up in path() if --config is not given, in order
+var cfgFiles = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
 
-var Cfg = Config{
-	Debug:           false,
-	WalletAddress:   "YOUR WALLET ADDRESS HERE",
-	PoolAddress:     "auto.xatum.xelpool.com:5212",
-	XatumBindPort:   5211,
-	GetworkBindPort: 5210,
-}
+var Cfg = proxy.DefaultConfig()
 
-func init() {
-	loadCfg()
+// path of the configuration file
+var cfgFile string
 
-	if Cfg.Debug {
-		log.LogLevel = 2
+// loads the configuration: the defaults, then the configuration file, then the XATUM_PROXY_*
+// environment variables, then the command-line flags
+func loadCfg(file string, flags *flag.FlagSet) error {
+	cfgFile = file
+	if cfgFile == "" {
+		cfgFile = findCfg()
 	}
-}
 
-func loadCfg() {
-	data, err := os.ReadFile(path() + "/config.json")
+	err := config.LoadFile(cfgFile, &Cfg)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Warn("configuration file not found, creating", cfgFile)
+		err = config.SaveFile(cfgFile, &Cfg)
+		if err != nil {
+			log.Err("failed to save configuration:", err)
+		}
+	} else if err != nil {
+		return err
+	}
 
+	unknown, err := config.ApplyEnv(&Cfg, ENV_PREFIX, os.Environ())
 	if err != nil {
-		log.Warn("failed to open configuration:", err)
-		saveCfg()
+		return err
+	}
+	for _, v := range unknown {
+		log.Warn("unknown environment variable", v)
+	}
+
+	return config.ApplyFlags(flags, &Cfg)
+}
+
+// returns the first configuration file which exists, or config.json
+func findCfg() string {
+	for _, v := range cfgFiles {
+		p := filepath.Join(path(), v)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(path(), cfgFiles[0])
+}
+
+// saves the wallet address in the configuration file. The other fields are saved as they are in
+// the file, without the environment and the flags.
+func saveWallet(addr string) {
+	fileCfg := proxy.DefaultConfig()
+
+	err := config.LoadFile(cfgFile, &fileCfg)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Err("failed to save the wallet address:", err)
 		return
 	}
 
-	err = json.Unmarshal(data, &Cfg)
+	fileCfg.WalletAddress = addr
 
+	err = config.SaveFile(cfgFile, &fileCfg)
 	if err != nil {
-		log.Warn("failed to decode configuration:", err)
-		return
+		log.Err("failed to save the wallet address:", err)
 	}
 }
 
-func saveCfg() {
-	data, err := json.MarshalIndent(Cfg, "", "\t")
+// prints the configuration in the format of the configuration file
+func printCfg() error {
+	format, err := config.Format(cfgFile)
 	if err != nil {
-		log.Fatal(err)
+		format = config.FORMAT_JSON
 	}
 
-	err = os.WriteFile(path()+"/config.json", data, 0o666)
+	data, err := config.Encode(&Cfg, format)
 	if err != nil {
-		log.Err(err)
+		return err
 	}
+
+	fmt.Print(string(data))
+	return nil
 }
 
+// returns the directory of the executable, which has the configuration file, the TLS certificate
+// and the audit log, whatever the working directory is
 func path() string {
-	return "."
-	/*ex, err := os.Executable()
+	exe, err := executable()
+	if err != nil {
+		log.Warn("failed to find the executable, using the working directory:", err)
+		return "."
+	}
+	return filepath.Dir(exe)
+}
+
+// returns the path of the executable, without symlinks
+func executable() (string, error) {
+	exe, err := os.Executable()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	exPath := filepath.Dir(ex)
-	return strings.TrimSuffix(exPath, string(os.PathSeparator))*/
+	return filepath.EvalSymlinks(exe)
 }
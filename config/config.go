@@ -1,6 +1,9 @@
 package config
 
-const ALGO = "xel/0"
+import "xatum-proxy/xelishash"
+
+// ALGO is the algorithm assumed for jobs that don't specify one
+const ALGO = xelishash.ALGO_V1
 
 const TIMEOUT = 10
 const SLAVE_MINER_TIMEOUT = 30
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testNested struct {
+	Webhooks []string
+	Ratio    float64
+}
+
+type testConfig struct {
+	WalletAddress string
+	XatumBindPort uint16
+	GetworkTLS    bool
+	XatumListen   []string
+	Alerts        testNested
+
+	hidden string
+}
+
+func defaults() testConfig {
+	return testConfig{
+		WalletAddress: "default",
+		XatumBindPort: 5211,
+		XatumListen:   []string{},
+		Alerts: testNested{
+			Webhooks: []string{},
+			Ratio:    0.1,
+		},
+	}
+}
+
+func TestNames(t *testing.T) {
+	cfg := defaults()
+
+	expected := map[string][2]string{
+		"WalletAddress":   {"wallet-address", "XP_WALLET_ADDRESS"},
+		"XatumBindPort":   {"xatum-bind-port", "XP_XATUM_BIND_PORT"},
+		"GetworkTLS":      {"getwork-tls", "XP_GETWORK_TLS"},
+		"XatumListen":     {"xatum-listen", "XP_XATUM_LISTEN"},
+		"Alerts.Webhooks": {"alerts-webhooks", "XP_ALERTS_WEBHOOKS"},
+		"Alerts.Ratio":    {"alerts-ratio", "XP_ALERTS_RATIO"},
+	}
+
+	fields := Fields(&cfg)
+	if len(fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d", len(expected), len(fields))
+	}
+
+	for _, f := range fields {
+		names, ok := expected[f.Name()]
+		if !ok {
+			t.Fatalf("unexpected field %s", f.Name())
+		}
+		if f.FlagName() != names[0] || f.EnvName("XP_") != names[1] {
+			t.Fatalf("field %s: expected %v, got %s %s", f.Name(), names, f.FlagName(), f.EnvName("XP_"))
+		}
+	}
+
+	if w := splitWords("TLSConfigV2"); !reflect.DeepEqual(w, []string{"TLS", "Config", "V2"}) {
+		t.Fatalf("unexpected words %v", w)
+	}
+}
+
+func TestDecodeFormats(t *testing.T) {
+	files := map[string]string{
+		FORMAT_JSON: `{"WalletAddress": "xet:abc", "xatumbindport": 1234, "XatumListen": ["a", "b"], "Alerts": {"Ratio": 0.5}}`,
+		FORMAT_YAML: "WalletAddress: xet:abc\nxatumbindport: 1234\nXatumListen:\n  - a\n  - b\nAlerts:\n  Ratio: 0.5\n",
+		FORMAT_TOML: "WalletAddress = \"xet:abc\"\nxatumbindport = 1234\nXatumListen = [\"a\", \"b\"]\n[Alerts]\nRatio = 0.5\n",
+	}
+
+	for format, data := range files {
+		cfg := defaults()
+
+		err := Decode([]byte(data), format, &cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		exp := defaults()
+		exp.WalletAddress = "xet:abc"
+		exp.XatumBindPort = 1234
+		exp.XatumListen = []string{"a", "b"}
+		exp.Alerts.Ratio = 0.5
+
+		if !reflect.DeepEqual(cfg, exp) {
+			t.Fatalf("%s: expected %+v, got %+v", format, exp, cfg)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		err    string
+	}{
+		{FORMAT_JSON, "{\n\"WalletAddres\": \"x\"}", `unknown field "WalletAddres"`},
+		{FORMAT_YAML, "Alerts:\n  Foo: 1\n", `unknown field "Foo"`},
+		{FORMAT_JSON, "{\n\"XatumBindPort\": 99999}", "line 2: field XatumBindPort: expected uint16"},
+		{FORMAT_TOML, "GetworkTLS = \"yes\"", "field GetworkTLS: expected bool"},
+		{FORMAT_JSON, "{\n\n\"WalletAddress\": }", "line 3:"},
+		{FORMAT_YAML, "WalletAddress: [\n", "yaml:"},
+	}
+
+	for _, v := range tests {
+		cfg := defaults()
+
+		err := Decode([]byte(v.data), v.format, &cfg)
+		if err == nil || !strings.Contains(err.Error(), v.err) {
+			t.Fatalf("%s %q: expected error containing %q, got %v", v.format, v.data, v.err, err)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	for _, ext := range []string{".json", ".yaml", ".toml"} {
+		path := filepath.Join(t.TempDir(), "config"+ext)
+
+		cfg := defaults()
+		cfg.XatumListen = []string{"[::]:5211", "unix:/run/xatum.sock"}
+		cfg.GetworkTLS = true
+
+		err := SaveFile(path, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "WalletAddress") {
+			t.Fatalf("%s: field names should be kept, got:\n%s", ext, data)
+		}
+
+		loaded := defaults()
+		err = LoadFile(path, &loaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(cfg, loaded) {
+			t.Fatalf("%s: expected %+v, got %+v", ext, cfg, loaded)
+		}
+	}
+
+	_, err := Format("config.ini")
+	if err == nil {
+		t.Fatal("expected an error for an unsupported format")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := defaults()
+
+	unknown, err := ApplyEnv(&cfg, "XP_", []string{
+		"XP_WALLET_ADDRESS=xet:env",
+		"XP_GETWORK_TLS=true",
+		"XP_XATUM_LISTEN=a, b,,c",
+		"XP_ALERTS_RATIO=0.25",
+		"XP_TYPO=1",
+		"HOME=/root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(unknown, []string{"XP_TYPO"}) {
+		t.Fatalf("unexpected unknown variables %v", unknown)
+	}
+
+	exp := defaults()
+	exp.WalletAddress = "xet:env"
+	exp.GetworkTLS = true
+	exp.XatumListen = []string{"a", "b", "c"}
+	exp.Alerts.Ratio = 0.25
+
+	if !reflect.DeepEqual(cfg, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, cfg)
+	}
+
+	_, err = ApplyEnv(&cfg, "XP_", []string{"XP_XATUM_BIND_PORT=70000"})
+	if err == nil || !strings.Contains(err.Error(), "XP_XATUM_BIND_PORT") {
+		t.Fatalf("expected an error naming the variable, got %v", err)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	cfg := defaults()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs, &cfg, "XP_")
+
+	err := fs.Parse([]string{"--getwork-tls", "--xatum-listen", "a", "--xatum-listen", "b,c", "--wallet-address", "xet:flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file and the environment are applied before the flags, which override them
+	cfg.WalletAddress = "xet:file"
+	cfg.XatumBindPort = 1000
+
+	err = ApplyFlags(fs, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := defaults()
+	exp.WalletAddress = "xet:flag"
+	exp.XatumBindPort = 1000
+	exp.GetworkTLS = true
+	exp.XatumListen = []string{"a", "b", "c"}
+
+	if !reflect.DeepEqual(cfg, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, cfg)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs, &cfg, "XP_")
+	err = fs.Parse([]string{"--alerts-ratio", "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ApplyFlags(fs, &cfg)
+	if err == nil || !strings.Contains(err.Error(), "--alerts-ratio") {
+		t.Fatalf("expected an error naming the flag, got %v", err)
+	}
+}
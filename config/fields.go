@@ -0,0 +1,270 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Layered configuration: defaults, then a file (JSON, YAML or TOML, chosen by the extension), then
+// environment variables, then command-line flags.
+// Fields are named after the Go fields of the configuration struct: WalletAddress is
+// "WalletAddress" in the file, PREFIX_WALLET_ADDRESS in the environment and --wallet-address on
+// the command line. Nested structs add a prefix, like Alerts.Webhooks, PREFIX_ALERTS_WEBHOOKS
+// and --alerts-webhooks. Lists are comma-separated in the environment and in the flags.
+
+// Field is a configurable field of a struct
+type Field struct {
+	Path  []string // Go field names, like ["Alerts", "Webhooks"]
+	Value reflect.Value
+}
+
+// Fields returns the fields of the struct v points to, including the fields of the nested structs
+func Fields(v any) []Field {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		panic("config: Fields needs a pointer to a struct")
+	}
+	return fields(rv.Elem(), nil)
+}
+
+func fields(rv reflect.Value, path []string) []Field {
+	res := make([]Field, 0, rv.NumField())
+
+	for i := 0; i < rv.NumField(); i++ {
+		sf := rv.Type().Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		p := append(slices.Clone(path), sf.Name)
+
+		if sf.Type.Kind() == reflect.Struct {
+			res = append(res, fields(rv.Field(i), p)...)
+			continue
+		}
+
+		res = append(res, Field{
+			Path:  p,
+			Value: rv.Field(i),
+		})
+	}
+
+	return res
+}
+
+// Name returns the name of the field, like "Alerts.Webhooks"
+func (f Field) Name() string {
+	return strings.Join(f.Path, ".")
+}
+
+// FlagName returns the name of the field's flag, like "alerts-webhooks"
+func (f Field) FlagName() string {
+	words := make([]string, 0, len(f.Path))
+	for _, v := range f.Path {
+		words = append(words, splitWords(v)...)
+	}
+	return strings.ToLower(strings.Join(words, "-"))
+}
+
+// EnvName returns the name of the field's environment variable, like "PREFIX_ALERTS_WEBHOOKS"
+func (f Field) EnvName(prefix string) string {
+	return prefix + strings.ReplaceAll(strings.ToUpper(f.FlagName()), "-", "_")
+}
+
+// splits a Go name into words: "GetworkTLSPort" is "Getwork", "TLS", "Port"
+func splitWords(s string) []string {
+	r := []rune(s)
+	words := make([]string, 0, 2)
+
+	start := 0
+	for i := 1; i < len(r); i++ {
+		lowerBefore := unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1])
+		acronymEnd := unicode.IsUpper(r[i-1]) && i+1 < len(r) && unicode.IsLower(r[i+1])
+
+		if unicode.IsUpper(r[i]) && (lowerBefore || acronymEnd) {
+			words = append(words, string(r[start:i]))
+			start = i
+		}
+	}
+
+	return append(words, string(r[start:]))
+}
+
+// Set parses s and sets it as the value of the field. Lists are comma-separated.
+func (f Field) Set(s string) error {
+	v := f.Value
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer between 0 and %d", s, uint64(1)<<v.Type().Bits()-1)
+		}
+		v.SetUint(n)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", v.Type())
+		}
+
+		list := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// String returns the value of the field, in the format accepted by Set
+func (f Field) String() string {
+	if f.Value.Kind() == reflect.Slice {
+		return strings.Join(f.Value.Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.Value.Interface())
+}
+
+// ApplyEnv sets the fields from the environment variables with the given prefix, like
+// XATUM_PROXY_. The environment is a list of "key=value", as returned by os.Environ. Variables
+// with the prefix which don't match any field are returned, so they can be reported.
+func ApplyEnv(v any, prefix string, environ []string) (unknown []string, err error) {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		k, val, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(k, prefix) {
+			env[k] = val
+		}
+	}
+
+	for _, f := range Fields(v) {
+		name := f.EnvName(prefix)
+
+		val, ok := env[name]
+		if !ok {
+			continue
+		}
+		delete(env, name)
+
+		err := f.Set(val)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+
+	for k := range env {
+		unknown = append(unknown, k)
+	}
+	slices.Sort(unknown)
+
+	return unknown, nil
+}
+
+// a flag which stores its values, so they can be applied after the configuration file
+type fieldFlag struct {
+	path   []string
+	values []string
+	isBool bool
+	isList bool
+}
+
+func (f *fieldFlag) String() string {
+	return strings.Join(f.values, ",")
+}
+
+func (f *fieldFlag) Set(s string) error {
+	f.values = append(f.values, s)
+	return nil
+}
+
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// RegisterFlags adds a flag for each field of the struct v points to. The flags' values are only
+// set by ApplyFlags, after the configuration file and the environment.
+// Lists can be given more than once, like --xatum-listen a --xatum-listen b.
+func RegisterFlags(fs *flag.FlagSet, v any, envPrefix string) {
+	for _, f := range Fields(v) {
+		// the text in backquotes is the value's name in the help
+		var usage string
+		switch f.Value.Kind() {
+		case reflect.Bool:
+			usage = "sets " + f.Name()
+		case reflect.Slice:
+			usage = "sets " + f.Name() + " to a comma-separated `list`"
+		default:
+			usage = "sets " + f.Name() + " to a `" + f.Value.Type().String() + "`"
+		}
+		usage += " (environment variable " + f.EnvName(envPrefix) + ")"
+
+		fs.Var(&fieldFlag{
+			path:   f.Path,
+			isBool: f.Value.Kind() == reflect.Bool,
+			isList: f.Value.Kind() == reflect.Slice,
+		}, f.FlagName(), usage)
+	}
+}
+
+// ApplyFlags sets the fields of v from the flags registered with RegisterFlags and given on the
+// command line. fs must be already parsed.
+func ApplyFlags(fs *flag.FlagSet, v any) error {
+	byName := make(map[string]Field)
+	for _, f := range Fields(v) {
+		byName[f.Name()] = f
+	}
+
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		ff, ok := fl.Value.(*fieldFlag)
+		if !ok || err != nil {
+			return
+		}
+
+		f, ok := byName[strings.Join(ff.path, ".")]
+		if !ok {
+			return
+		}
+
+		val := ff.values[len(ff.values)-1]
+		if ff.isList {
+			val = strings.Join(ff.values, ",")
+		}
+
+		e := f.Set(val)
+		if e != nil {
+			err = fmt.Errorf("flag --%s: %w", fl.Name, e)
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_TOML = "toml"
+)
+
+// Format returns the format of a configuration file, from its extension
+func Format(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FORMAT_JSON, nil
+	case ".yaml", ".yml":
+		return FORMAT_YAML, nil
+	case ".toml":
+		return FORMAT_TOML, nil
+	default:
+		return "", fmt.Errorf("unsupported configuration format %q, use .json, .yaml or .toml", filepath.Ext(path))
+	}
+}
+
+// LoadFile decodes the configuration file into v. The fields which are not in the file keep their
+// value, so v should hold the defaults.
+func LoadFile(path string, v any) error {
+	format, err := Format(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = Decode(data, format, v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Decode decodes a configuration in the given format into v. Field names are the Go field names,
+// case-insensitive; unknown fields are an error.
+func Decode(data []byte, format string, v any) error {
+	raw := data
+
+	// YAML and TOML are converted to JSON, so all the formats have the same field names and checks
+	if format != FORMAT_JSON {
+		var m map[string]any
+
+		var err error
+		switch format {
+		case FORMAT_YAML:
+			err = yaml.Unmarshal(data, &m)
+		case FORMAT_TOML:
+			err = toml.Unmarshal(data, &m)
+		default:
+			return fmt.Errorf("unsupported configuration format %q", format)
+		}
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return nil
+		}
+
+		raw, err = json.Marshal(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err != nil {
+		return jsonError(raw, err, format == FORMAT_JSON)
+	}
+	return nil
+}
+
+// makes the JSON errors readable. The line numbers are only meaningful for JSON files.
+func jsonError(data []byte, err error, withLine bool) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("line %d: %s", lineOf(data, syntaxErr.Offset), syntaxErr)
+	case errors.As(err, &typeErr):
+		msg := fmt.Sprintf("field %s: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		if withLine {
+			return fmt.Errorf("line %d: %s", lineOf(data, typeErr.Offset), msg)
+		}
+		return errors.New(msg)
+	}
+
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fmt.Errorf("unknown field %s", name)
+	}
+	return err
+}
+
+func lineOf(data []byte, offset int64) int {
+	offset = min(offset, int64(len(data)))
+	return bytes.Count(data[:offset], []byte{'\n'}) + 1
+}
+
+// SaveFile writes v to the configuration file, in the format of its extension
+func SaveFile(path string, v any) error {
+	format, err := Format(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := Encode(v, format)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o600)
+}
+
+// Encode encodes v in the given format, with the Go field names
+func Encode(v any, format string) ([]byte, error) {
+	switch format {
+	case FORMAT_JSON:
+		data, err := json.MarshalIndent(v, "", "\t")
+		return append(data, '\n'), err
+	case FORMAT_YAML:
+		node, err := yamlNode(reflect.ValueOf(v))
+		if err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(node)
+	case FORMAT_TOML:
+		buf := &bytes.Buffer{}
+		err := toml.NewEncoder(buf).Encode(v)
+		return buf.Bytes(), err
+	default:
+		return nil, fmt.Errorf("unsupported configuration format %q", format)
+	}
+}
+
+// yaml.v3 lowercases the field names, this keeps them as they are and in order
+func yamlNode(rv reflect.Value) (*yaml.Node, error) {
+	for rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		node := &yaml.Node{}
+		return node, node.Encode(rv.Interface())
+	}
+
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i < rv.NumField(); i++ {
+		sf := rv.Type().Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		val, err := yamlNode(rv.Field(i))
+		if err != nil {
+			return nil, err
+		}
+
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: sf.Name}, val)
+	}
+	return node, nil
+}
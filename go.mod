@@ -3,10 +3,13 @@ module xatum-proxy
 go 1.22.0
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/duggavo/serializer v1.1.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/klauspost/cpuid/v2 v2.2.7
 	github.com/zeebo/blake3 v0.2.3
+	golang.org/x/term v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/sys v0.19.0 // indirect
@@ -0,0 +1,300 @@
+package hashrate
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hashrate estimation from the difficulty of the accepted shares.
+// Shares are grouped in buckets of BUCKET_DURATION, and only non-empty buckets are stored, so idle
+// series are cheap.
+
+const BUCKET_DURATION = 10 * time.Second
+
+// the longest window, older buckets are discarded
+const MAX_WINDOW = 24 * time.Hour
+
+var Windows = [5]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour, 24 * time.Hour}
+
+// Clock returns the current time. It can be replaced in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var SystemClock Clock = systemClock{}
+
+// Rates contains the estimated hashrate in H/s for each of the Windows
+type Rates struct {
+	M1  float64 `json:"1m"`
+	M5  float64 `json:"5m"`
+	M15 float64 `json:"15m"`
+	H1  float64 `json:"1h"`
+	H24 float64 `json:"24h"`
+}
+
+type bucket struct {
+	start time.Time
+	diff  uint64
+}
+
+type series struct {
+	created   time.Time
+	lastShare time.Time
+	buckets   []bucket
+}
+
+func (s *series) add(now time.Time, diff uint64) {
+	start := now.Truncate(BUCKET_DURATION)
+
+	if n := len(s.buckets); n > 0 && s.buckets[n-1].start.Equal(start) {
+		s.buckets[n-1].diff += diff
+	} else {
+		s.buckets = append(s.buckets, bucket{start: start, diff: diff})
+	}
+	s.lastShare = now
+}
+
+// removes the buckets older than MAX_WINDOW
+func (s *series) prune(now time.Time) {
+	i := 0
+	for i < len(s.buckets) && now.Sub(s.buckets[i].start) > MAX_WINDOW {
+		i++
+	}
+	if i > 0 {
+		s.buckets = append(s.buckets[:0], s.buckets[i:]...)
+	}
+}
+
+func (s *series) rate(now time.Time, window time.Duration) float64 {
+	// a series younger than the window is averaged over its lifetime, so new miners don't show a
+	// very low hashrate
+	elapsed := now.Sub(s.created)
+	if elapsed > window {
+		elapsed = window
+	}
+	if elapsed < BUCKET_DURATION {
+		elapsed = BUCKET_DURATION
+	}
+
+	var sum uint64
+	for i := len(s.buckets) - 1; i >= 0; i-- {
+		if now.Sub(s.buckets[i].start) >= window {
+			break
+		}
+		sum += s.buckets[i].diff
+	}
+
+	return float64(sum) / elapsed.Seconds()
+}
+
+func (s *series) rates(now time.Time) Rates {
+	return Rates{
+		M1:  s.rate(now, Windows[0]),
+		M5:  s.rate(now, Windows[1]),
+		M15: s.rate(now, Windows[2]),
+		H1:  s.rate(now, Windows[3]),
+		H24: s.rate(now, Windows[4]),
+	}
+}
+
+// Estimator keeps the hashrate of every connection, worker, wallet and of the whole proxy.
+// Workers are identified by wallet and worker name, so their hashrate survives reconnections.
+type Estimator struct {
+	clock Clock
+
+	total   *series
+	conns   map[uint64]*series
+	workers map[WorkerKey]*series
+	wallets map[string]*series
+
+	sync.RWMutex
+}
+
+type WorkerKey struct {
+	Wallet string
+	Worker string
+}
+
+func NewEstimator(clock Clock) *Estimator {
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	return &Estimator{
+		clock:   clock,
+		total:   &series{created: clock.Now()},
+		conns:   make(map[uint64]*series),
+		workers: make(map[WorkerKey]*series),
+		wallets: make(map[string]*series),
+	}
+}
+
+// AddShare records an accepted share with the given difficulty
+func (e *Estimator) AddShare(connId uint64, wallet, worker string, diff uint64) {
+	e.Lock()
+	defer e.Unlock()
+
+	now := e.clock.Now()
+
+	// the first share of a series is the result of some previous work, which is assumed to last one
+	// bucket
+	created := now.Add(-BUCKET_DURATION)
+
+	e.total.add(now, diff)
+
+	s, ok := e.conns[connId]
+	if !ok {
+		s = &series{created: created}
+		e.conns[connId] = s
+	}
+	s.add(now, diff)
+
+	key := WorkerKey{Wallet: wallet, Worker: worker}
+	s, ok = e.workers[key]
+	if !ok {
+		s = &series{created: created}
+		e.workers[key] = s
+	}
+	s.add(now, diff)
+
+	s, ok = e.wallets[wallet]
+	if !ok {
+		s = &series{created: created}
+		e.wallets[wallet] = s
+	}
+	s.add(now, diff)
+}
+
+// RemoveConnection forgets the hashrate of a connection. The worker and wallet are kept.
+func (e *Estimator) RemoveConnection(connId uint64) {
+	e.Lock()
+	defer e.Unlock()
+
+	delete(e.conns, connId)
+}
+
+func (e *Estimator) Total() Rates {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.total.rates(e.clock.Now())
+}
+
+func (e *Estimator) Connection(connId uint64) Rates {
+	e.RLock()
+	defer e.RUnlock()
+
+	s, ok := e.conns[connId]
+	if !ok {
+		return Rates{}
+	}
+	return s.rates(e.clock.Now())
+}
+
+func (e *Estimator) Worker(wallet, worker string) Rates {
+	e.RLock()
+	defer e.RUnlock()
+
+	s, ok := e.workers[WorkerKey{Wallet: wallet, Worker: worker}]
+	if !ok {
+		return Rates{}
+	}
+	return s.rates(e.clock.Now())
+}
+
+func (e *Estimator) Wallet(wallet string) Rates {
+	e.RLock()
+	defer e.RUnlock()
+
+	s, ok := e.wallets[wallet]
+	if !ok {
+		return Rates{}
+	}
+	return s.rates(e.clock.Now())
+}
+
+// Workers returns the hashrate of all the known workers
+func (e *Estimator) Workers() map[WorkerKey]Rates {
+	e.RLock()
+	defer e.RUnlock()
+
+	now := e.clock.Now()
+
+	res := make(map[WorkerKey]Rates, len(e.workers))
+	for k, v := range e.workers {
+		res[k] = v.rates(now)
+	}
+	return res
+}
+
+// Wallets returns the hashrate of all the known wallets
+func (e *Estimator) Wallets() map[string]Rates {
+	e.RLock()
+	defer e.RUnlock()
+
+	now := e.clock.Now()
+
+	res := make(map[string]Rates, len(e.wallets))
+	for k, v := range e.wallets {
+		res[k] = v.rates(now)
+	}
+	return res
+}
+
+// LastShare returns the time of the last share of a worker, and false if the worker is unknown
+func (e *Estimator) LastShare(wallet, worker string) (time.Time, bool) {
+	e.RLock()
+	defer e.RUnlock()
+
+	s, ok := e.workers[WorkerKey{Wallet: wallet, Worker: worker}]
+	if !ok {
+		return time.Time{}, false
+	}
+	return s.lastShare, true
+}
+
+// Prune removes old buckets, and the workers and wallets without shares in the last MAX_WINDOW.
+// It should be called periodically.
+func (e *Estimator) Prune() {
+	e.Lock()
+	defer e.Unlock()
+
+	now := e.clock.Now()
+
+	e.total.prune(now)
+	for _, v := range e.conns {
+		v.prune(now)
+	}
+	for k, v := range e.workers {
+		v.prune(now)
+		if now.Sub(v.lastShare) > MAX_WINDOW {
+			delete(e.workers, k)
+		}
+	}
+	for k, v := range e.wallets {
+		v.prune(now)
+		if now.Sub(v.lastShare) > MAX_WINDOW {
+			delete(e.wallets, k)
+		}
+	}
+}
+
+// Format returns a human-readable hashrate, like "1.23 MH/s"
+func Format(h float64) string {
+	units := []string{"H/s", "KH/s", "MH/s", "GH/s", "TH/s", "PH/s"}
+
+	i := 0
+	for h >= 1000 && i < len(units)-1 {
+		h /= 1000
+		i++
+	}
+
+	return strconv.FormatFloat(h, 'f', 2, 64) + " " + units[i]
+}
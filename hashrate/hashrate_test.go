@@ -0,0 +1,115 @@
+package hashrate
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+func (c *fakeClock) Add(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 0.01*math.Max(math.Abs(a), math.Abs(b))+1e-9
+}
+
+func TestEstimator(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+
+	e := NewEstimator(clock)
+
+	// 1000 H/s for 2 hours: a share of difficulty 10000 every 10 seconds
+	for i := 0; i < 720; i++ {
+		clock.Add(10 * time.Second)
+		e.AddShare(1, "wallet", "rig1", 10000)
+	}
+
+	r := e.Total()
+	if !almostEqual(r.M5, 1000) || !almostEqual(r.M15, 1000) || !almostEqual(r.H1, 1000) {
+		t.Fatalf("unexpected total hashrate %+v", r)
+	}
+	// the series is 2 hours old, so the 24h window is averaged over 2 hours
+	if !almostEqual(r.H24, 1000) {
+		t.Fatalf("unexpected 24h hashrate %+v", r)
+	}
+
+	if w := e.Worker("wallet", "rig1"); w != r {
+		t.Fatalf("worker hashrate %+v does not match total %+v", w, r)
+	}
+	if w := e.Wallet("wallet"); w != r {
+		t.Fatalf("wallet hashrate %+v does not match total %+v", w, r)
+	}
+
+	// the miner stops for 10 minutes
+	clock.Add(10 * time.Minute)
+
+	r = e.Total()
+	if r.M1 != 0 || r.M5 != 0 {
+		t.Fatalf("expected zero short-term hashrate, got %+v", r)
+	}
+	if !almostEqual(r.M15, 1000.0*5/15) {
+		t.Fatalf("unexpected 15m hashrate %+v", r)
+	}
+}
+
+func TestEstimatorReconnect(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+
+	e := NewEstimator(clock)
+
+	for i := 0; i < 30; i++ {
+		clock.Add(10 * time.Second)
+		e.AddShare(1, "wallet", "rig1", 5000)
+	}
+
+	e.RemoveConnection(1)
+
+	if r := e.Connection(1); r != (Rates{}) {
+		t.Fatalf("expected no hashrate for removed connection, got %+v", r)
+	}
+
+	// same worker, new connection
+	for i := 0; i < 30; i++ {
+		clock.Add(10 * time.Second)
+		e.AddShare(2, "wallet", "rig1", 5000)
+	}
+
+	if r := e.Worker("wallet", "rig1"); !almostEqual(r.M5, 500) {
+		t.Fatalf("unexpected worker hashrate after reconnect %+v", r)
+	}
+	if r := e.Connection(2); !almostEqual(r.M5, 500) {
+		t.Fatalf("unexpected connection hashrate %+v", r)
+	}
+}
+
+func TestEstimatorPrune(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+
+	e := NewEstimator(clock)
+
+	e.AddShare(1, "wallet", "rig1", 5000)
+	e.AddShare(2, "wallet2", "rig2", 5000)
+
+	clock.Add(MAX_WINDOW + time.Minute)
+	e.AddShare(2, "wallet2", "rig2", 5000)
+
+	e.Prune()
+
+	if len(e.Workers()) != 1 {
+		t.Fatalf("expected 1 worker after pruning, got %d", len(e.Workers()))
+	}
+	if len(e.Wallets()) != 1 {
+		t.Fatalf("expected 1 wallet after pruning, got %d", len(e.Wallets()))
+	}
+	if _, ok := e.LastShare("wallet", "rig1"); ok {
+		t.Fatal("worker rig1 should have been pruned")
+	}
+}
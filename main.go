@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"xatum-proxy/config"
+	"xatum-proxy/log"
+	"xatum-proxy/proxy"
+	"xatum-proxy/systemd"
+	"xatum-proxy/tui"
+	"xatum-proxy/xelisutil"
+)
+
+func main() {
+	cfgPath := flag.String("config", "", "path of the configuration file, JSON, YAML or TOML (default config.json)")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	walletAddr := flag.String("wallet", "", "your xelis address, same as --wallet-address")
+	useTui := flag.Bool("tui", false, "show the full-screen terminal UI instead of the logs")
+	config.RegisterFlags(flag.CommandLine, &Cfg, ENV_PREFIX)
+	flag.Usage = usage
+	flag.Parse()
+
+	// the other commands don't need the configuration
+	if flag.NArg() > 0 && flag.Arg(0) != "install" {
+		serviceCommand(flag.Args())
+		return
+	}
+
+	err := loadCfg(*cfgPath, flag.CommandLine)
+	if err != nil {
+		log.Err("invalid configuration:", err)
+		os.Exit(1)
+	}
+
+	if *walletAddr != "" {
+		Cfg.WalletAddress = *walletAddr
+	}
+
+	if *printConfig {
+		err = printCfg()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = Cfg.Validate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid configuration:\n"+err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() > 0 {
+		serviceCommand(flag.Args())
+		return
+	}
+
+	if Cfg.Debug {
+		log.LogLevel = 2
+	}
+
+	if Cfg.WalletAddress == "YOUR WALLET ADDRESS HERE" {
+		Cfg.WalletAddress = StringPrompt("Enter your wallet address:")
+
+		addr, err := xelisutil.ParseAddress(Cfg.WalletAddress)
+		if err != nil {
+			log.Err(err)
+			os.Exit(0)
+		}
+		if !addr.Mainnet {
+			log.Warn("the wallet address is a testnet address")
+		}
+
+		saveWallet(Cfg.WalletAddress)
+	}
+
+	if Cfg.DataDir == "" {
+		Cfg.DataDir = path()
+	}
+
+	log.Title("")
+	log.Title(log.Bold + "          XATUM-PROXY v" + proxy.VERSION)
+	log.Title(log.Purple + " (c) 2024 XelPool, licensed under MIT")
+	log.Title("")
+	log.Title(log.Reset+log.Cyan+" OS:", runtime.GOOS, "- arch:", runtime.GOARCH, "- threads:", runtime.NumCPU())
+	log.Title("")
+
+	p, err := proxy.New(Cfg)
+	if err != nil {
+		log.Err(err)
+		os.Exit(1)
+	}
+
+	if *useTui && !tui.IsTerminal() {
+		log.Warn("stdout isn't a terminal, showing the logs instead of the terminal UI")
+		*useTui = false
+	}
+
+	var ui *tui.TUI
+	if *useTui {
+		ui, err = tui.New(p)
+		if err != nil {
+			log.Warn("failed to start the terminal UI:", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = p.Start(ctx)
+	if err != nil {
+		if ui != nil {
+			ui.Close()
+		}
+		log.Fatal(err)
+	}
+
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		notifySystemd(ctx, p)
+	}()
+
+	if ui != nil {
+		ui.Run(ctx)
+	} else {
+		<-ctx.Done()
+	}
+	stop()
+
+	systemd.Notify(systemd.STOPPING)
+
+	log.Info("Stopping the proxy")
+	p.Stop()
+	<-notified
+
+	// the logs are restored once nothing logs to the terminal UI anymore
+	if ui != nil {
+		ui.Close()
+		log.Info("Proxy stopped")
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Commands, to run the proxy as a systemd service:")
+	fmt.Fprintln(out, "  install [--user USER] [--dir DIR]")
+	fmt.Fprintf(out, "    \tinstalls the service, run by USER (default %s) in DIR (default %s),\n", SERVICE_NAME, SERVICE_DIR)
+	fmt.Fprintln(out, "    \twith the configuration given by the flags, the environment and the configuration file")
+	fmt.Fprintln(out, "  uninstall\n    \tremoves the service, but keeps its directory and its user")
+	fmt.Fprintln(out, "  start, stop, status\n    \tstarts, stops or shows the service")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func StringPrompt(label string) string {
+	var s string
+	r := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, label+" ")
+		var err error
+		s, err = r.ReadString('\n')
+		// stdin is closed when the proxy runs as a service
+		if s != "" || err != nil {
+			break
+		}
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,602 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"xatum-proxy/agent"
+	"xatum-proxy/hashrate"
+	"xatum-proxy/log"
+	"xatum-proxy/util"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xatum/server"
+)
+
+// Admin HTTP/JSON API, used for managing the miners without restarting the proxy.
+// Every request must have the header "Authorization: Bearer <AdminToken>".
+
+type AdminConnection struct {
+	Id        uint64         `json:"id"`
+	Protocol  string         `json:"protocol"`
+	IP        string         `json:"ip"`
+	Wallet    string         `json:"wallet,omitempty"`
+	Worker    string         `json:"worker,omitempty"`
+	Agent     string         `json:"agent,omitempty"`
+	Software  string         `json:"software"`          // name of the mining software, from the agent
+	Version   string         `json:"version,omitempty"` // version of the mining software
+	Algos     []string       `json:"algos,omitempty"`
+	XnSlice   string         `json:"xn_slice,omitempty"` // extra nonce slice of downstream proxies
+	Pool      string         `json:"pool"`               // pool of the miner's jobs
+	Diff      uint64         `json:"diff"`
+	Shares    uint64         `json:"shares"`
+	LastShare int64          `json:"last_share,omitempty"` // unix milliseconds
+	Hashrate  hashrate.Rates `json:"hashrate"`
+}
+
+type AdminHashrate struct {
+	Total   hashrate.Rates            `json:"total"`
+	Wallets map[string]hashrate.Rates `json:"wallets"`
+	Workers []AdminWorkerHashrate     `json:"workers"`
+}
+
+type AdminAgentStats struct {
+	Software string  `json:"software"`
+	Version  string  `json:"version,omitempty"`
+	Known    bool    `json:"known"`
+	Miners   int     `json:"miners"`
+	Hashrate float64 `json:"hashrate"` // 5 minutes average, in H/s
+}
+
+type AdminWorkerHashrate struct {
+	Wallet   string         `json:"wallet"`
+	Worker   string         `json:"worker"`
+	Hashrate hashrate.Rates `json:"hashrate"`
+}
+
+type AdminKickRequest struct {
+	Id     uint64 `json:"id,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Wallet string `json:"wallet,omitempty"`
+}
+
+type AdminMessageRequest struct {
+	Id  uint64 `json:"id,omitempty"` // 0 to send the message to all the Xatum miners
+	Msg string `json:"msg"`
+	Lvl uint8  `json:"lvl"`
+}
+
+type AdminPoolRequest struct {
+	Address string `json:"address"`
+}
+
+type AdminDiffRequest struct {
+	Id   uint64 `json:"id"`
+	Diff uint64 `json:"diff"` // 0 to use the pool's difficulty
+}
+
+type AdminReconnectRequest struct {
+	Id     uint64 `json:"id,omitempty"`     // 0 to move all the Xatum miners
+	Host   string `json:"host,omitempty"`   // empty to reconnect to the proxy
+	Port   uint16 `json:"port,omitempty"`   // 0 to keep the current port
+	Wait   uint32 `json:"wait,omitempty"`   // seconds the miners wait before reconnecting
+	Spread uint32 `json:"spread,omitempty"` // random seconds added to wait, so miners don't reconnect all at once
+}
+
+type AdminBanRequest struct {
+	IP       string `json:"ip"`
+	Duration uint64 `json:"duration,omitempty"` // in seconds, 0 for a permanent ban
+}
+
+type AuditEntry struct {
+	Time   int64  `json:"time"` // unix milliseconds
+	Remote string `json:"remote"`
+	Action string `json:"action"`
+	Params any    `json:"params,omitempty"`
+	Result string `json:"result"`
+}
+
+// appends an entry to the audit log file
+func (p *Proxy) audit(r *http.Request, action string, params any, result string) {
+	log.Infof("admin: %s %+v from %s: %s", action, params, r.RemoteAddr, result)
+
+	data, err := json.Marshal(AuditEntry{
+		Time:   time.Now().UnixMilli(),
+		Remote: r.RemoteAddr,
+		Action: action,
+		Params: params,
+		Result: result,
+	})
+	if err != nil {
+		log.Err(err)
+		return
+	}
+
+	p.auditMut.Lock()
+	defer p.auditMut.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(p.cfg.DataDir, "audit.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Err("failed to open audit log:", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		log.Err("failed to write audit log:", err)
+	}
+}
+
+func (p *Proxy) listenAdmin() error {
+	if p.cfg.AdminBindPort == 0 {
+		return nil
+	}
+	if p.cfg.AdminToken == "" {
+		log.Warn("admin API is disabled: AdminToken is not set")
+		return nil
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/connections", p.adminAuth(p.adminConnections))
+	mux.HandleFunc("/api/kick", p.adminAuth(p.adminKick))
+	mux.HandleFunc("/api/message", p.adminAuth(p.adminMessage))
+	mux.HandleFunc("/api/pool", p.adminAuth(p.adminPool))
+	mux.HandleFunc("/api/difficulty", p.adminAuth(p.adminDifficulty))
+	mux.HandleFunc("/api/bans", p.adminAuth(p.adminBans))
+	mux.HandleFunc("/api/reconnect", p.adminAuth(p.adminReconnect))
+	mux.HandleFunc("/api/hashrate", p.adminAuth(p.adminHashrate))
+	mux.HandleFunc("/api/agents", p.adminAuth(p.adminAgents))
+	mux.HandleFunc("/api/blocks", p.adminAuth(p.adminBlocks))
+
+	ip := "127.0.0.1:" + strconv.FormatUint(uint64(p.cfg.AdminBindPort), 10)
+
+	listener, err := net.Listen("tcp", ip)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Admin API listening on port", p.cfg.AdminBindPort)
+
+	s := &http.Server{
+		Handler: mux,
+	}
+	p.serveHttp(s, func() error {
+		return s.Serve(listener)
+	})
+
+	return nil
+}
+
+func (p *Proxy) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.cfg.AdminToken)) != 1 {
+			log.Warn("admin: unauthorized request from", r.RemoteAddr)
+			adminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func adminReply(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Warn("admin: failed to send reply:", err)
+	}
+}
+
+// decodes the body of a POST request, and sends an error if it fails
+func adminDecode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(v)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) adminConnections(w http.ResponseWriter, r *http.Request) {
+	adminReply(w, p.listConnections())
+}
+
+// returns the Xatum and Getwork miners connected to the proxy
+func (p *Proxy) listConnections() []AdminConnection {
+	conns := make([]AdminConnection, 0)
+
+	p.srv.RLock()
+	for _, v := range p.srv.Connections {
+		v.RLock()
+		a := agent.Parse(v.Agent)
+		conns = append(conns, AdminConnection{
+			Id:        v.Id,
+			Protocol:  "xatum",
+			IP:        util.RemovePort(v.Conn.RemoteAddr().String()),
+			Wallet:    v.Wallet,
+			Worker:    v.Worker,
+			Agent:     v.Agent,
+			Software:  a.Name,
+			Version:   agentVersion(a),
+			Algos:     v.Algos,
+			XnSlice:   hex.EncodeToString(v.XnSlice),
+			Pool:      p.lanePool(p.minerLane(v.Id)),
+			Diff:      v.CurrentJob.Diff,
+			Shares:    v.Shares,
+			LastShare: v.LastShare.UnixMilli(),
+			Hashrate:  p.hashrates.Connection(v.Id),
+		})
+		v.RUnlock()
+	}
+	p.srv.RUnlock()
+
+	p.socketsMut.RLock()
+	for _, v := range p.sockets {
+		if v == nil {
+			continue
+		}
+		v.RLock()
+		a := agent.Parse(v.Agent)
+		conns = append(conns, AdminConnection{
+			Id:        v.Id,
+			Protocol:  "getwork",
+			IP:        v.IP(),
+			Wallet:    v.Wallet,
+			Worker:    v.Worker,
+			Agent:     v.Agent,
+			Software:  a.Name,
+			Version:   agentVersion(a),
+			Algos:     []string{v.CurrentJob.Algo},
+			Pool:      p.lanePool(p.minerLane(v.Id)),
+			Diff:      v.CurrentJob.Diff,
+			Shares:    v.Shares,
+			LastShare: v.LastShare.UnixMilli(),
+			Hashrate:  p.hashrates.Connection(v.Id),
+		})
+		v.RUnlock()
+	}
+	p.socketsMut.RUnlock()
+
+	return conns
+}
+
+func (p *Proxy) adminHashrate(w http.ResponseWriter, r *http.Request) {
+	res := AdminHashrate{
+		Total:   p.hashrates.Total(),
+		Wallets: p.hashrates.Wallets(),
+		Workers: make([]AdminWorkerHashrate, 0),
+	}
+
+	for k, v := range p.hashrates.Workers() {
+		res.Workers = append(res.Workers, AdminWorkerHashrate{
+			Wallet:   k.Wallet,
+			Worker:   k.Worker,
+			Hashrate: v,
+		})
+	}
+
+	adminReply(w, res)
+}
+
+func (p *Proxy) adminKick(w http.ResponseWriter, r *http.Request) {
+	req := AdminKickRequest{}
+	if !adminDecode(w, r, &req) {
+		return
+	}
+	if req.Id == 0 && req.IP == "" && req.Wallet == "" {
+		adminError(w, http.StatusBadRequest, errors.New("one of id, ip or wallet is required"))
+		return
+	}
+
+	match := func(id uint64, ip, wallet string) bool {
+		return (req.Id != 0 && id == req.Id) ||
+			(req.IP != "" && ip == req.IP) ||
+			(req.Wallet != "" && wallet == req.Wallet)
+	}
+
+	p.srv.Lock()
+	toKick := make([]uint64, 0)
+	for _, v := range p.srv.Connections {
+		v.RLock()
+		if match(v.Id, util.RemovePort(v.Conn.RemoteAddr().String()), v.Wallet) {
+			toKick = append(toKick, v.Id)
+		}
+		v.RUnlock()
+	}
+	for _, id := range toKick {
+		p.srv.Kick(id)
+	}
+	p.srv.Unlock()
+
+	kicked := len(toKick) + p.kickGetwork(match)
+
+	p.audit(r, "kick", req, "kicked "+strconv.Itoa(kicked)+" miners")
+
+	adminReply(w, map[string]int{"kicked": kicked})
+}
+
+// closes the Getwork websockets and forgets the HTTP clients which match, and returns their number.
+// A forgotten HTTP client gets new jobs at its next request.
+func (p *Proxy) kickGetwork(match func(id uint64, ip, wallet string) bool) int {
+	kicked := 0
+
+	p.socketsMut.RLock()
+	for _, c := range p.sockets {
+		if c == nil {
+			continue
+		}
+		c.RLock()
+		ok := match(c.Id, c.ip, c.Wallet)
+		c.RUnlock()
+		if ok {
+			c.Close()
+			kicked++
+		}
+	}
+	p.socketsMut.RUnlock()
+
+	p.httpClientsMut.Lock()
+	for k, v := range p.httpClients {
+		if match(v.conn.Id, k, v.conn.Wallet) {
+			delete(p.httpClients, k)
+			p.removeLane(v.conn.Id)
+			kicked++
+		}
+	}
+	p.httpClientsMut.Unlock()
+
+	return kicked
+}
+
+func (p *Proxy) adminMessage(w http.ResponseWriter, r *http.Request) {
+	req := AdminMessageRequest{}
+	if !adminDecode(w, r, &req) {
+		return
+	}
+	if req.Msg == "" {
+		adminError(w, http.StatusBadRequest, errors.New("msg is required"))
+		return
+	}
+
+	sent := 0
+
+	p.srv.RLock()
+	for _, v := range p.srv.Connections {
+		if req.Id != 0 && v.Id != req.Id {
+			continue
+		}
+
+		v.Lock()
+		err := v.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+			Msg: req.Msg,
+			Lvl: req.Lvl,
+		})
+		v.Unlock()
+		if err != nil {
+			log.Warn("admin: failed to send message:", err)
+			continue
+		}
+		sent++
+	}
+	p.srv.RUnlock()
+
+	p.audit(r, "message", req, "sent to "+strconv.Itoa(sent)+" miners")
+
+	adminReply(w, map[string]int{"sent": sent})
+}
+
+// moves the miners to another address, or asks them to reconnect later during maintenance
+func (p *Proxy) adminReconnect(w http.ResponseWriter, r *http.Request) {
+	req := AdminReconnectRequest{}
+	if !adminDecode(w, r, &req) {
+		return
+	}
+
+	if uint64(req.Wait)+uint64(req.Spread) > math.MaxUint32 {
+		adminError(w, http.StatusBadRequest, errors.New("wait + spread is too large"))
+		return
+	}
+
+	moved := p.reconnectMiners(req)
+
+	p.audit(r, "reconnect", req, "moved "+strconv.Itoa(moved)+" miners")
+
+	adminReply(w, map[string]int{"moved": moved})
+}
+
+// sends the reconnect packet to the Xatum miners of the request, kicks them, and returns their
+// number
+func (p *Proxy) reconnectMiners(req AdminReconnectRequest) int {
+	p.srv.Lock()
+	defer p.srv.Unlock()
+
+	toKick := make([]uint64, 0)
+	for _, v := range p.srv.Connections {
+		if req.Id != 0 && v.Id != req.Id {
+			continue
+		}
+
+		wait := req.Wait
+		if req.Spread != 0 {
+			wait += uint32(util.RandomUint64() % (uint64(req.Spread) + 1))
+		}
+
+		v.Lock()
+		err := sendReconnect(v, xatum.S2C_Reconnect{
+			Host: req.Host,
+			Port: req.Port,
+			Wait: wait,
+		})
+		v.Unlock()
+		if err != nil {
+			log.Warn("admin: failed to send reconnect:", err)
+		}
+		toKick = append(toKick, v.Id)
+	}
+	for _, id := range toKick {
+		p.srv.Kick(id)
+	}
+
+	return len(toKick)
+}
+
+func (p *Proxy) adminPool(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		adminReply(w, AdminPoolRequest{Address: p.PoolAddress()})
+		return
+	}
+
+	req := AdminPoolRequest{}
+	if !adminDecode(w, r, &req) {
+		return
+	}
+	if req.Address == "" {
+		adminError(w, http.StatusBadRequest, errors.New("address is required"))
+		return
+	}
+
+	p.SetPoolAddress(req.Address)
+
+	p.audit(r, "pool", req, "ok")
+
+	adminReply(w, req)
+}
+
+func (p *Proxy) adminDifficulty(w http.ResponseWriter, r *http.Request) {
+	req := AdminDiffRequest{}
+	if !adminDecode(w, r, &req) {
+		return
+	}
+
+	var conn *server.Connection
+
+	p.srv.RLock()
+	for _, v := range p.srv.Connections {
+		if v.Id == req.Id {
+			conn = v
+			break
+		}
+	}
+	p.srv.RUnlock()
+
+	gw := p.findSocket(req.Id)
+
+	if conn == nil && gw == nil {
+		adminError(w, http.StatusNotFound, errors.New("connection not found"))
+		return
+	}
+
+	// the pool would reject the shares below its difficulty
+	job := p.minerJob(req.Id)
+	if req.Diff != 0 && req.Diff < job.Diff {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("difficulty %d is lower than the pool difficulty %d", req.Diff, job.Diff))
+		return
+	}
+
+	if conn != nil {
+		conn.Lock()
+		conn.Diff = req.Diff
+		conn.Unlock()
+
+		// send the new difficulty, so it is applied immediately
+		if job.Diff != 0 {
+			conn.Lock()
+			SendDiff(conn, job)
+			conn.Unlock()
+		}
+	} else {
+		gw.Lock()
+		gw.Diff = req.Diff
+		// Getwork has no difficulty packet, so a new job is sent
+		if job.Diff != 0 {
+			err := gw.WriteJSON(map[string]any{
+				"new_job": newBlockTemplate(gw.newJob(job)),
+			})
+			if err != nil {
+				log.Warn("admin: failed to send job:", err)
+			}
+		}
+		gw.Unlock()
+	}
+
+	p.audit(r, "difficulty", req, "ok")
+
+	adminReply(w, req)
+}
+
+func (p *Proxy) adminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		bans := p.srv.Bans()
+
+		res := make(map[string]int64, len(bans))
+		for k, v := range bans {
+			if v.IsZero() {
+				res[k] = 0
+			} else {
+				res[k] = v.Unix()
+			}
+		}
+
+		adminReply(w, res)
+	case http.MethodPost:
+		req := AdminBanRequest{}
+		if !adminDecode(w, r, &req) {
+			return
+		}
+		if req.IP == "" {
+			adminError(w, http.StatusBadRequest, errors.New("ip is required"))
+			return
+		}
+
+		p.srv.Ban(req.IP, time.Duration(req.Duration)*time.Second)
+		p.kickGetwork(func(id uint64, ip, wallet string) bool {
+			return ip == req.IP || util.IPKey(ip) == req.IP
+		})
+
+		p.audit(r, "ban", req, "ok")
+
+		adminReply(w, req)
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if ip == "" {
+			adminError(w, http.StatusBadRequest, errors.New("ip is required"))
+			return
+		}
+
+		if !p.srv.Unban(ip) {
+			p.audit(r, "unban", ip, "not banned")
+			adminError(w, http.StatusNotFound, errors.New("ip is not banned"))
+			return
+		}
+
+		p.audit(r, "unban", ip, "ok")
+
+		adminReply(w, map[string]string{"ip": ip})
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
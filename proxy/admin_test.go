@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminDifficulty(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 1)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+	connects := make(chan ConnectionInfo, 1)
+	p.Hooks.OnConnect = func(c ConnectionInfo) {
+		connects <- c
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	poolConn := pool.accept(t)
+	poolConn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(100))
+	recv(t, jobs)
+
+	miner := dialMiner(t, cfg)
+	miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+		Addr:  testMiner,
+		Work:  "rig1",
+		Agent: testAgent,
+		Algos: []string{xelishash.ALGO_V1},
+	})
+	info := recv(t, connects)
+
+	minerJob := xatum.S2C_Job{}
+	miner.read(t, xatum.PacketS2C_Job, &minerJob)
+
+	setDiff := func(diff uint64) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"id":%d,"diff":%d}`, info.Id, diff)
+		p.adminDifficulty(w, httptest.NewRequest(http.MethodPost, "/api/difficulty", strings.NewReader(body)))
+		return w
+	}
+
+	// the pool would reject the shares below its difficulty
+	if w := setDiff(50); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "lower than the pool difficulty") {
+		t.Fatalf("unexpected reply %d %s", w.Code, w.Body)
+	}
+
+	if w := setDiff(200); w.Code != http.StatusOK {
+		t.Fatalf("unexpected reply %d %s", w.Code, w.Body)
+	}
+	miner.read(t, xatum.PacketS2C_Job, &minerJob)
+	if minerJob.Diff != 200 {
+		t.Fatalf("expected difficulty 200, got %d", minerJob.Diff)
+	}
+
+	// a new pool difficulty above the miner's is used instead
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(300))
+	miner.read(t, xatum.PacketS2C_Job, &minerJob)
+	if minerJob.Diff != 300 {
+		t.Fatalf("expected difficulty 300, got %d", minerJob.Diff)
+	}
+}
+
+func TestAdminGetwork(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 1)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+	connects := make(chan ConnectionInfo, 2)
+	p.Hooks.OnConnect = func(c ConnectionInfo) {
+		connects <- c
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	poolConn := pool.accept(t)
+	poolConn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(100))
+	recv(t, jobs)
+
+	srv := httptest.NewServer(http.HandlerFunc(p.wsHandler))
+	defer srv.Close()
+
+	dial := func() (*websocket.Conn, ConnectionInfo) {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/getwork/"+testMiner+"/rig1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			ws.Close()
+		})
+		return ws, recv(t, connects)
+	}
+	readJob := func(ws *websocket.Conn) BlockTemplate {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg := map[string]BlockTemplate{}
+		err := ws.ReadJSON(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg["new_job"]
+	}
+	closed := func(ws *websocket.Conn) {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := ws.ReadMessage()
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected the websocket to be closed, got %v", err)
+		}
+	}
+	admin := func(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected reply %d %s", w.Code, w.Body)
+		}
+		return w
+	}
+
+	ws, info := dial()
+	readJob(ws)
+
+	// Getwork has no difficulty packet, so the difficulty comes with a new job
+	admin(p.adminDifficulty, "/api/difficulty", fmt.Sprintf(`{"id":%d,"diff":200}`, info.Id))
+	if job := readJob(ws); job.Difficulty != "200" {
+		t.Fatalf("expected difficulty 200, got %s", job.Difficulty)
+	}
+
+	p.httpClient("10.0.0.1")
+
+	w := admin(p.adminKick, "/api/kick", `{"wallet":"`+testMiner+`"}`)
+	if !strings.Contains(w.Body.String(), `"kicked":1`) {
+		t.Fatalf("unexpected reply %s", w.Body)
+	}
+	closed(ws)
+
+	w = admin(p.adminKick, "/api/kick", `{"ip":"10.0.0.1"}`)
+	if !strings.Contains(w.Body.String(), `"kicked":1`) {
+		t.Fatalf("unexpected reply %s", w.Body)
+	}
+	p.httpClientsMut.Lock()
+	n := len(p.httpClients)
+	p.httpClientsMut.Unlock()
+	if n != 0 {
+		t.Fatalf("expected the HTTP client to be forgotten, %d remain", n)
+	}
+
+	// a ban closes the websockets from the IP
+	ws, _ = dial()
+	readJob(ws)
+	admin(p.adminBans, "/api/bans", `{"ip":"127.0.0.1"}`)
+	closed(ws)
+}
+
+func TestAdminReconnect(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connects := make(chan ConnectionInfo, 1)
+	p.Hooks.OnConnect = func(c ConnectionInfo) {
+		connects <- c
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	miner := dialMiner(t, cfg)
+	miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+		Addr:    testMiner,
+		Work:    "rig1",
+		Agent:   testAgent,
+		Algos:   []string{xelishash.ALGO_V1},
+		Version: 1,
+		Caps:    []string{xatum.CapReconnect},
+	})
+	recv(t, connects)
+
+	reconnect := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.adminReconnect(w, httptest.NewRequest(http.MethodPost, "/api/reconnect", strings.NewReader(body)))
+		return w
+	}
+
+	// the wait can't overflow
+	if w := reconnect(`{"wait":1,"spread":4294967295}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected reply %d %s", w.Code, w.Body)
+	}
+
+	// the largest spread doesn't wrap to a modulo by zero
+	if w := reconnect(`{"spread":4294967295}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"moved":1`) {
+		t.Fatalf("unexpected reply %d %s", w.Code, w.Body)
+	}
+	miner.read(t, xatum.PacketS2C_Reconnect, &xatum.S2C_Reconnect{})
+
+	// the server isn't left locked
+	if len(p.Connections()) != 0 {
+		t.Fatalf("unexpected connections %+v", p.Connections())
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"xatum-proxy/agent"
+	"xatum-proxy/log"
+)
+
+// returns the version of the miner's software, empty if its user agent has none
+func agentVersion(a agent.Agent) string {
+	if !a.HasVersion {
+		return ""
+	}
+	return a.Version.String()
+}
+
+// logs the warning of the miner's software. Unknown miners are common, so they are only logged as info.
+func logAgentWarning(a agent.Agent, wallet, worker string) {
+	if a.Known {
+		log.Warnf("miner %s.%s runs %s: %s", wallet, worker, a, a.Warning)
+	} else {
+		log.Infof("miner %s.%s runs mining software unknown to the proxy (%s)", wallet, worker, a)
+	}
+}
+
+// returns the number of miners and their hashrate by software and version, the most used first
+func agentStats(conns []AdminConnection) []AdminAgentStats {
+	res := make([]AdminAgentStats, 0)
+
+	for _, c := range conns {
+		i := slices.IndexFunc(res, func(v AdminAgentStats) bool {
+			return v.Software == c.Software && v.Version == c.Version
+		})
+		if i == -1 {
+			res = append(res, AdminAgentStats{
+				Software: c.Software,
+				Version:  c.Version,
+				Known:    agent.Parse(c.Agent).Known,
+			})
+			i = len(res) - 1
+		}
+		res[i].Miners++
+		res[i].Hashrate += c.Hashrate.M5
+	}
+
+	slices.SortFunc(res, func(a, b AdminAgentStats) int {
+		return cmp.Or(cmp.Compare(b.Miners, a.Miners), cmp.Compare(a.Software, b.Software), cmp.Compare(a.Version, b.Version))
+	})
+	return res
+}
+
+func (p *Proxy) adminAgents(w http.ResponseWriter, r *http.Request) {
+	adminReply(w, agentStats(p.listConnections()))
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"xatum-proxy/hashrate"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+)
+
+func TestAgentStats(t *testing.T) {
+	conn := func(ua, software, version string, h float64) AdminConnection {
+		return AdminConnection{
+			Agent:    ua,
+			Software: software,
+			Version:  version,
+			Hashrate: hashrate.Rates{M5: h},
+		}
+	}
+
+	stats := agentStats([]AdminConnection{
+		conn("lolMiner 1.82", "lolMiner", "1.82.0", 10),
+		conn("xelis-miner/1.2.0", "xelis-miner", "1.2.0", 5),
+		conn("foo-miner", "foo-miner", "", 1),
+		conn("xelis-miner/1.2.0", "xelis-miner", "1.2.0", 7),
+	})
+
+	exp := []AdminAgentStats{
+		{Software: "xelis-miner", Version: "1.2.0", Known: true, Miners: 2, Hashrate: 12},
+		{Software: "foo-miner", Known: false, Miners: 1, Hashrate: 1},
+		{Software: "lolMiner", Version: "1.82.0", Known: true, Miners: 1, Hashrate: 10},
+	}
+	if len(stats) != len(exp) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	for i := range exp {
+		if stats[i] != exp[i] {
+			t.Fatalf("expected %+v, got %+v", exp[i], stats[i])
+		}
+	}
+}
+
+func TestAgentQuirks(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 1)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// the pool fixes more bytes of the extra nonce than legacy miners keep
+	poolConn := pool.accept(t)
+	poolConn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	job := testJob(100)
+	job.XnPrefix = 30
+	poolConn.send(t, xatum.PacketS2C_Job, job)
+	recv(t, jobs)
+
+	dial := func(agent string) *fakeConn {
+		miner := dialMiner(t, cfg)
+		miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+			Addr:  testMiner,
+			Work:  "rig1",
+			Agent: agent,
+			Algos: []string{xelishash.ALGO_V1},
+		})
+		return miner
+	}
+
+	// an unknown miner gets a warning, and the job
+	miner := dial("foo-miner/1.0")
+	msg := xatum.S2C_Print{}
+	miner.read(t, xatum.PacketS2C_Print, &msg)
+	if msg.Lvl != 2 || !strings.Contains(msg.Msg, "foo-miner is unknown") {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	minerJob := xatum.S2C_Job{}
+	miner.read(t, xatum.PacketS2C_Job, &minerJob)
+	if minerJob.XnPrefix != 30 {
+		t.Fatalf("expected xn_prefix 30, got %d", minerJob.XnPrefix)
+	}
+
+	// a miner which ignores xn_prefix doesn't get the job
+	miner = dial("XelMiner ALPHA")
+	miner.read(t, xatum.PacketS2C_Print, &msg)
+	if msg.Lvl != 3 || !strings.Contains(msg.Msg, "supports xn_prefix") {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	stats := agentStats(p.Connections())
+	if len(stats) != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+	"xatum-proxy/log"
+)
+
+const ALERTS_CHECK_INTERVAL = 30 * time.Second
+
+// the rejected shares ratio is only checked when there are at least this many results
+const MIN_SHARES_FOR_REJECT_ALERT = 10
+
+type AlertConfig struct {
+	Webhooks          []string
+	Command           string
+	DebounceSeconds   uint32
+	DeadWorkerSeconds uint32  // a worker without shares for this long is considered dead
+	JobStallSeconds   uint32  // alert if the pool doesn't send jobs for this long
+	RejectedRatio     float64 // alert if more than this fraction of shares is rejected
+}
+
+func (p *Proxy) setLastJobTime() {
+	p.mutLastJobTime.Lock()
+	p.lastJobTime = time.Now()
+	p.mutLastJobTime.Unlock()
+}
+
+func (p *Proxy) alertsHandler() {
+	if !p.alerter.Enabled() {
+		log.Debug("alerts are disabled, no webhook or command configured")
+		return
+	}
+
+	log.Info("Alerts enabled,", len(p.cfg.Alerts.Webhooks), "webhooks")
+
+	var lastAccepted, lastRejected uint64
+
+	for sleep(p.ctx, ALERTS_CHECK_INTERVAL) {
+		p.checkDeadWorkers()
+		p.checkJobStall()
+
+		p.stats.RLock()
+		accepted, rejected := p.stats.SharesAccepted, p.stats.SharesRejected
+		p.stats.RUnlock()
+
+		p.checkRejected(accepted-lastAccepted, rejected-lastRejected)
+
+		lastAccepted, lastRejected = accepted, rejected
+	}
+}
+
+func (p *Proxy) checkDeadWorkers() {
+	timeout := time.Duration(p.cfg.Alerts.DeadWorkerSeconds) * time.Second
+	if timeout == 0 {
+		return
+	}
+
+	for k := range p.hashrates.Workers() {
+		last, ok := p.hashrates.LastShare(k.Wallet, k.Worker)
+		if !ok {
+			continue
+		}
+
+		key := "worker_dead:" + k.Wallet + "." + k.Worker
+
+		if time.Since(last) > timeout {
+			p.alerter.Fire("worker_dead", key, fmt.Sprintf("worker %s.%s has not sent shares since %s",
+				k.Wallet, k.Worker, last.Format(time.RFC3339)), map[string]any{
+				"wallet":     k.Wallet,
+				"worker":     k.Worker,
+				"last_share": last.UnixMilli(),
+			})
+		} else {
+			p.alerter.Resolve("worker_dead", key, fmt.Sprintf("worker %s.%s is sending shares again", k.Wallet, k.Worker))
+		}
+	}
+}
+
+func (p *Proxy) checkJobStall() {
+	timeout := time.Duration(p.cfg.Alerts.JobStallSeconds) * time.Second
+	if timeout == 0 {
+		return
+	}
+
+	p.mutLastJobTime.RLock()
+	last := p.lastJobTime
+	p.mutLastJobTime.RUnlock()
+
+	if last.IsZero() {
+		return
+	}
+
+	if time.Since(last) > timeout {
+		p.alerter.Fire("job_stall", "job_stall", fmt.Sprintf("no jobs received from the pool since %s",
+			last.Format(time.RFC3339)), map[string]any{
+			"last_job": last.UnixMilli(),
+		})
+	} else {
+		p.alerter.Resolve("job_stall", "job_stall", "the pool is sending jobs again")
+	}
+}
+
+func (p *Proxy) checkRejected(accepted, rejected uint64) {
+	if p.cfg.Alerts.RejectedRatio == 0 || accepted+rejected < MIN_SHARES_FOR_REJECT_ALERT {
+		return
+	}
+
+	ratio := float64(rejected) / float64(accepted+rejected)
+
+	if ratio > p.cfg.Alerts.RejectedRatio {
+		p.alerter.Fire("rejected_shares", "rejected_shares", fmt.Sprintf("%.1f%% of the shares were rejected",
+			ratio*100), map[string]any{
+			"accepted": accepted,
+			"rejected": rejected,
+		})
+	} else {
+		p.alerter.Resolve("rejected_shares", "rejected_shares", "the rejected shares ratio is back to normal")
+	}
+}
+
+func (p *Proxy) alertUpstreamDown(addr string) {
+	p.alerter.Fire("upstream_down", "upstream_down", "disconnected from pool "+addr, map[string]any{
+		"pool": addr,
+	})
+}
+
+func (p *Proxy) alertJobKeyMismatch(addr, wallet string, key [32]byte) {
+	p.alerter.Fire("job_key_mismatch", "job_key_mismatch", "pool "+addr+" sent a job paying to another wallet", map[string]any{
+		"pool":    addr,
+		"job_key": hex.EncodeToString(key[:]),
+		"wallet":  wallet,
+	})
+}
+
+func (p *Proxy) alertJobKeyValid(addr string) {
+	p.alerter.Resolve("job_key_mismatch", "job_key_mismatch", "pool "+addr+" is sending jobs paying to the wallet")
+}
+
+func (p *Proxy) alertUpstreamUp(addr string) {
+	p.alerter.Resolve("upstream_down", "upstream_down", "receiving jobs from pool "+addr)
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"xatum-proxy/log"
+	"xatum-proxy/xatum/server"
+	"xatum-proxy/xelisutil"
+)
+
+// Block-found detection. The network difficulty comes from the daemon of Config.DaemonAddress, or
+// else from the pool's jobs. So does the height, when the pool doesn't send it. A share whose PoW hash meets it is a block candidate: it's logged,
+// saved to blocks.log, notified to the alerts' webhooks and shown in the stats. The pool decides
+// if the block is valid, so it's only a candidate.
+
+const DAEMON_POLL_INTERVAL = 10 * time.Second
+const DAEMON_TIMEOUT = 10 * time.Second
+
+// BlockCandidate is a share which meets the network difficulty
+type BlockCandidate struct {
+	Time     int64  `json:"time"` // unix milliseconds
+	Height   uint64 `json:"height,omitempty"`
+	Workhash string `json:"workhash"`
+	PowHash  string `json:"pow_hash"`
+	Wallet   string `json:"wallet"`
+	Worker   string `json:"worker"`
+	NetDiff  uint64 `json:"net_diff"`
+	Pool     string `json:"pool"`
+}
+
+// returns the network difficulty: the daemon's if it's known, or else the pool's
+func (p *Proxy) networkDiff(poolDiff uint64) uint64 {
+	if d := atomic.LoadUint64(&p.daemonDiff); d != 0 {
+		return d
+	}
+	return poolDiff
+}
+
+// returns the height of the pool's job, or else of the block mined on the daemon's chain, 0 if it
+// isn't known
+func (p *Proxy) jobHeight(poolHeight uint64) uint64 {
+	if poolHeight != 0 {
+		return poolHeight
+	}
+	if h := atomic.LoadUint64(&p.daemonHeight); h != 0 {
+		return h + 1
+	}
+	return 0
+}
+
+// polls the daemon for the network difficulty and height. While the daemon is unreachable, the
+// pool's are used.
+func (p *Proxy) daemonHandler() {
+	if p.cfg.DaemonAddress == "" {
+		return
+	}
+
+	client := &http.Client{
+		Timeout: DAEMON_TIMEOUT,
+	}
+
+	failing := false
+	for {
+		diff, height, err := p.getDaemonInfo(client)
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if !failing {
+				log.Warn("failed to get the network difficulty from the daemon:", err)
+				p.stats.AddEvent("warn", "failed to get the network difficulty from the daemon")
+			}
+			failing = true
+			atomic.StoreUint64(&p.daemonDiff, 0)
+			atomic.StoreUint64(&p.daemonHeight, 0)
+		} else {
+			atomic.StoreUint64(&p.daemonHeight, height)
+			if atomic.SwapUint64(&p.daemonDiff, diff) == 0 {
+				log.Infof("network difficulty from the daemon: %d", diff)
+			}
+			failing = false
+		}
+
+		if !sleep(p.ctx, DAEMON_POLL_INTERVAL) {
+			return
+		}
+	}
+}
+
+// returns the network difficulty and the height from the get_info method of the daemon
+func (p *Proxy) getDaemonInfo(client *http.Client) (uint64, uint64, error) {
+	body, err := json.Marshal(RpcRequest{
+		JsonRpc: "2.0",
+		Id:      json.RawMessage("1"),
+		Method:  "get_info",
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, p.cfg.DaemonAddress, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	// the daemons send the difficulty as a string, older ones as a number
+	reply := struct {
+		Result *struct {
+			Height     uint64          `json:"height"`
+			Difficulty json.RawMessage `json:"difficulty"`
+		} `json:"result"`
+		Error *RpcError `json:"error"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&reply)
+	if err != nil {
+		return 0, 0, err
+	}
+	if reply.Error != nil {
+		return 0, 0, fmt.Errorf("daemon error %d: %s", reply.Error.Code, reply.Error.Message)
+	}
+	if reply.Result == nil {
+		return 0, 0, errors.New("empty reply")
+	}
+
+	diff, err := strconv.ParseUint(string(bytes.Trim(reply.Result.Difficulty, `"`)), 10, 64)
+	if err != nil || diff == 0 {
+		return 0, 0, fmt.Errorf("invalid difficulty %s", reply.Result.Difficulty)
+	}
+	return diff, reply.Result.Height, nil
+}
+
+// returns the PoW hash of a Xatum share if the miner's hash meets the network difficulty. The PoW
+// hash is only computed then, to check the miner's hash.
+func (p *Proxy) xatumBlockHash(share Share, job server.ConnJob) ([32]byte, bool) {
+	netDiff := p.networkDiff(job.NetDiff)
+	if netDiff == 0 {
+		return [32]byte{}, false
+	}
+
+	claimed, err := hex.DecodeString(share.Submit.Hash)
+	if err != nil || len(claimed) != 32 || !xelisutil.CheckDiff([32]byte(claimed), netDiff) {
+		return [32]byte{}, false
+	}
+
+	pow, err := xelisutil.BlockMiner(share.Submit.Data).PowHashAlgo(job.Algo)
+	if err != nil {
+		log.Err(err)
+		return [32]byte{}, false
+	}
+	if pow != [32]byte(claimed) {
+		log.Warnf("miner %s.%s sent a share with a wrong PoW hash %s", share.Wallet, share.Worker, share.Submit.Hash)
+		return [32]byte{}, false
+	}
+	return pow, true
+}
+
+// records the share as a block candidate if its PoW hash meets the network difficulty, and
+// returns the candidate
+func (p *Proxy) checkBlock(share Share, pow [32]byte, height, poolNetDiff uint64) (BlockCandidate, bool) {
+	netDiff := p.networkDiff(poolNetDiff)
+	if netDiff == 0 || !xelisutil.CheckDiff(pow, netDiff) {
+		return BlockCandidate{}, false
+	}
+
+	pool := ""
+	if up := p.findUpstream(share.Upstream); up != nil {
+		pool = p.upstreamPool(up)
+	}
+
+	workhash := xelisutil.BlockMiner(share.Submit.Data).GetWorkhash()
+	b := BlockCandidate{
+		Time:     time.Now().UnixMilli(),
+		Height:   height,
+		Workhash: hex.EncodeToString(workhash[:]),
+		PowHash:  hex.EncodeToString(pow[:]),
+		Wallet:   share.Wallet,
+		Worker:   share.Worker,
+		NetDiff:  netDiff,
+		Pool:     pool,
+	}
+
+	msg := fmt.Sprintf("block found by %s.%s at height %d, work hash %s", b.Wallet, b.Worker, b.Height, b.Workhash)
+	log.Info("BLOCK FOUND:", msg)
+
+	p.stats.AddBlock(b)
+	p.stats.AddEvent("block", "%s", msg)
+	p.alerter.Notify("block_found", "block_found:"+b.Workhash, msg, map[string]any{
+		"height":   b.Height,
+		"workhash": b.Workhash,
+		"pow_hash": b.PowHash,
+		"wallet":   b.Wallet,
+		"worker":   b.Worker,
+		"net_diff": b.NetDiff,
+		"pool":     b.Pool,
+	})
+	p.saveBlock(b)
+
+	if p.Hooks.OnBlock != nil {
+		p.Hooks.OnBlock(b)
+	}
+
+	return b, true
+}
+
+// appends the block candidate to the blocks log file
+func (p *Proxy) saveBlock(b BlockCandidate) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		log.Err(err)
+		return
+	}
+
+	p.blocksMut.Lock()
+	defer p.blocksMut.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(p.cfg.DataDir, "blocks.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Err("failed to open blocks log:", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		log.Err("failed to write blocks log:", err)
+	}
+}
+
+func (p *Proxy) adminBlocks(w http.ResponseWriter, r *http.Request) {
+	adminReply(w, p.stats.Blocks())
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+func TestDaemonDiff(t *testing.T) {
+	reply := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := RpcRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "get_info" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(reply))
+	}))
+	defer srv.Close()
+
+	p := &Proxy{
+		cfg: Config{DaemonAddress: srv.URL},
+		ctx: context.Background(),
+	}
+
+	for exp, v := range map[uint64]string{
+		123456789: `{"jsonrpc":"2.0","id":1,"result":{"height":10,"difficulty":"123456789"}}`,
+		42:        `{"jsonrpc":"2.0","id":1,"result":{"height":10,"difficulty":42}}`,
+	} {
+		reply = v
+		diff, height, err := p.getDaemonInfo(srv.Client())
+		if err != nil || diff != exp || height != 10 {
+			t.Fatalf("%s: expected %d at height 10, got %d at height %d %v", v, exp, diff, height, err)
+		}
+	}
+
+	for exp, v := range map[string]string{
+		"daemon error -32601": `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found"}}`,
+		"invalid difficulty":  `{"jsonrpc":"2.0","id":1,"result":{"difficulty":"0"}}`,
+		"empty reply":         `{"jsonrpc":"2.0","id":1}`,
+	} {
+		reply = v
+		_, _, err := p.getDaemonInfo(srv.Client())
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Fatalf("%s: expected an error containing %q, got %v", v, exp, err)
+		}
+	}
+
+	// the daemon's difficulty is used before the pool's
+	if p.networkDiff(100) != 100 {
+		t.Fatal("expected the pool's difficulty without the daemon's")
+	}
+	atomic.StoreUint64(&p.daemonDiff, 200)
+	if p.networkDiff(100) != 200 || p.networkDiff(0) != 200 {
+		t.Fatal("expected the daemon's difficulty")
+	}
+
+	// the pool's height is used before the daemon's, and it isn't guessed without them
+	if p.jobHeight(0) != 0 || p.jobHeight(5) != 5 {
+		t.Fatal("expected the pool's height without the daemon's")
+	}
+	atomic.StoreUint64(&p.daemonHeight, 10)
+	if p.jobHeight(5) != 5 || p.jobHeight(0) != 11 {
+		t.Fatal("expected the height of the block mined on the daemon's chain")
+	}
+}
+
+func TestBlockFound(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 1)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+	blocks := make(chan BlockCandidate, 1)
+	p.Hooks.OnBlock = func(b BlockCandidate) {
+		blocks <- b
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// every hash meets the network difficulty 1. The pool gets its job IDs back with the shares.
+	poolConn := pool.accept(t)
+	poolConn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	poolConn.send(t, xatum.PacketS2C_Hello, xatum.S2C_Hello{Version: 1, Caps: []string{xatum.CapJobId}})
+	job := testJob(1)
+	job.Height = 1000
+	job.NetDiff = 1
+	job.Id = "job1"
+	poolConn.send(t, xatum.PacketS2C_Job, job)
+	recv(t, jobs)
+
+	miner := dialMiner(t, cfg)
+	miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+		Addr:  testMiner,
+		Work:  "rig1",
+		Agent: testAgent,
+		Algos: []string{xelishash.ALGO_V1},
+	})
+
+	minerJob := xatum.S2C_Job{}
+	miner.read(t, xatum.PacketS2C_Job, &minerJob)
+	if minerJob.NetDiff != 1 {
+		t.Fatalf("expected the network difficulty in the job, got %d", minerJob.NetDiff)
+	}
+
+	pow, err := xelisutil.BlockMiner(minerJob.Blob).PowHashAlgo(xelishash.ALGO_V1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a share with a wrong hash isn't a block
+	wrong := pow
+	wrong[0] ^= 1
+	miner.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: minerJob.Blob, Hash: hex.EncodeToString(wrong[:])})
+	readSubmit(t, poolConn)
+
+	miner.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: minerJob.Blob, Hash: hex.EncodeToString(pow[:])})
+	if s := readSubmit(t, poolConn); string(s.Data) != string(minerJob.Blob) || s.Job != "job1" {
+		t.Fatalf("unexpected share submitted to the pool %+v", s)
+	}
+
+	b := recv(t, blocks)
+	workhash := xelisutil.BlockMiner(minerJob.Blob).GetWorkhash()
+	if b.Height != 1000 || b.Worker != "rig1" || b.Wallet != testMiner || b.NetDiff != 1 ||
+		b.PowHash != hex.EncodeToString(pow[:]) || b.Workhash != hex.EncodeToString(workhash[:]) ||
+		b.Pool != cfg.PoolAddress {
+		t.Fatalf("unexpected block %+v", b)
+	}
+
+	msg := xatum.S2C_Print{}
+	miner.read(t, xatum.PacketS2C_Print, &msg)
+	if !strings.Contains(msg.Msg, "you found a block at height 1000") {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	// it's in the stats and in the blocks log
+	if got := p.stats.Blocks(); len(got) != 1 || got[0] != b {
+		t.Fatalf("unexpected blocks %+v", got)
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.DataDir, "blocks.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 || !strings.Contains(string(data), b.PowHash) {
+		t.Fatalf("unexpected blocks log %q", data)
+	}
+
+	// Getwork shares are checked too
+	c := p.httpClient("127.0.0.1")
+	err = p.submitGetworkWork(hex.EncodeToString(c.CurrentJob.BlockMiner[:]), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readSubmit(t, poolConn); s.Job != "job1" {
+		t.Fatalf("expected the pool's job ID, got %q", s.Job)
+	}
+	if b := recv(t, blocks); b.Worker != "127.0.0.1" || b.Wallet != testWallet {
+		t.Fatalf("unexpected block %+v", b)
+	}
+}
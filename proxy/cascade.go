@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"xatum-proxy/log"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelisutil"
+)
+
+// Extra nonce delegation to downstream proxies (see xatum.DEFAULT_XN_PREFIX).
+// Each downstream proxy gets a distinct slice of the extra nonce, right after the prefix fixed by
+// the pool, and it can only change the bytes after its slice. At least xatum.MIN_XN_FREE bytes
+// are left after the slice, for the miners of the downstream proxy.
+
+const MAX_XN_SLICE_ATTEMPTS = 1000
+
+// allocates a new extra nonce slice of n bytes for the connection
+func (p *Proxy) allocXnSlice(connId uint64, n uint8) ([]byte, error) {
+	p.mutCurJob.RLock()
+	prefix := p.curJob.XnPrefix
+	p.mutCurJob.RUnlock()
+
+	if prefix == 0 {
+		prefix = xatum.DEFAULT_XN_PREFIX
+	}
+
+	if n == 0 || int(prefix)+int(n) > 32-xatum.MIN_XN_FREE {
+		return nil, fmt.Errorf("cannot delegate %d extra nonce bytes, only %d are available", n, max(32-xatum.MIN_XN_FREE-int(prefix), 0))
+	}
+
+	p.mutXnSlices.Lock()
+	defer p.mutXnSlices.Unlock()
+
+	slice := make([]byte, n)
+	for i := 0; i < MAX_XN_SLICE_ATTEMPTS; i++ {
+		_, err := rand.Read(slice)
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.xnSliceUsed(slice) {
+			p.xnSlices[connId] = slice
+			return slice, nil
+		}
+	}
+
+	return nil, errors.New("no free extra nonce slices")
+}
+
+// two slices overlap if one is a prefix of the other
+// mutXnSlices MUST be locked before calling this
+func (p *Proxy) xnSliceUsed(slice []byte) bool {
+	for _, v := range p.xnSlices {
+		l := min(len(v), len(slice))
+		if bytes.Equal(v[:l], slice[:l]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) freeXnSlice(connId uint64) {
+	p.mutXnSlices.Lock()
+	delete(p.xnSlices, connId)
+	p.mutXnSlices.Unlock()
+}
+
+// sets random bytes in the extra nonce after the first prefix bytes, so miners don't do duplicate
+// work
+func setRandomExtraNonce(blMiner *xelisutil.BlockMiner, prefix uint8) {
+	nonceExtra := blMiner.GetExtraNonce()
+
+	_, err := rand.Read(nonceExtra[prefix:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	blMiner.SetExtraNonce(nonceExtra)
+}
+
+// returns true if the first prefix bytes of the extra nonces match
+func validExtraNonce(a, b xelisutil.BlockMiner, prefix uint8) bool {
+	xa, xb := a.GetExtraNonce(), b.GetExtraNonce()
+	return bytes.Equal(xa[:prefix], xb[:prefix])
+}
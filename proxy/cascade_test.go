@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"testing"
+	"xatum-proxy/xatum"
+)
+
+func TestAllocXnSlice(t *testing.T) {
+	p := &Proxy{
+		xnSlices: make(map[uint64][]byte),
+	}
+
+	// the downstream proxies keep xatum.MIN_XN_FREE bytes for their miners
+	maxBytes := 32 - xatum.DEFAULT_XN_PREFIX - xatum.MIN_XN_FREE
+	if _, err := p.allocXnSlice(1, uint8(maxBytes+1)); err == nil {
+		t.Fatal("expected an error, the slice leaves no free bytes")
+	}
+
+	a, err := p.allocXnSlice(1, uint8(maxBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.allocXnSlice(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a[0] == b[0] {
+		t.Fatalf("slices %x and %x overlap", a, b)
+	}
+
+	p.curJob.XnPrefix = 32 - xatum.MIN_XN_FREE
+	if _, err := p.allocXnSlice(3, 1); err == nil {
+		t.Fatal("expected an error, the pool's prefix leaves no bytes to delegate")
+	}
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"xatum-proxy/log"
+	"xatum-proxy/proxyproto"
+	"xatum-proxy/util"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+type Config struct {
+	WalletAddress   string
+	PoolAddress     string
+	XatumBindPort   uint16
+	GetworkBindPort uint16
+	Debug           bool
+
+	// listen addresses, like "0.0.0.0:5211", "[::]:5211" or "unix:/run/xatum-proxy.sock".
+	// If empty, XatumBindPort and GetworkBindAddress:GetworkBindPort are used.
+	XatumListen   []string
+	GetworkListen []string
+
+	GetworkBindAddress    string
+	GetworkTLS            bool
+	GetworkToken          string   // if set, Getwork miners must send it to connect
+	GetworkAllowedWallets []string // if not empty, only these wallets can connect to Getwork
+	GetworkAllowedOrigins []string // allowed websocket origins, "*" allows all of them
+
+	// PROXY protocol and X-Forwarded-For are only accepted from the trusted proxies, which are IP
+	// addresses or CIDR prefixes
+	XatumProxyProtocol   bool
+	GetworkProxyProtocol bool
+	GetworkForwardedFor  bool
+	TrustedProxies       []string
+
+	// refuse the jobs which don't pay to WalletAddress, and fail over to BackupPools. Disable it
+	// with pools which mine to their own wallet: the jobs paying to another wallet are then only
+	// alerted.
+	VerifyJobKey bool
+	// pools to fail over to, in order, when the pool sends jobs paying to another wallet
+	BackupPools []string
+
+	// switches the pool or the wallet on a schedule, like "5% - xel:..." for 5% of each hour to
+	// another wallet, or "* 22-23,0-5 * * * night.pool:5209" for a cron expression. See
+	// ParseSchedule. Cron lists have commas, so they can only be set in the configuration file.
+	Schedule []string
+	// splits the miners between pools by hashrate, like "30% other.pool:5209" for 30% of the
+	// hashrate to another pool. The rest goes to the pool of the schedule. See ParseSplit.
+	Split []string
+	// sends the work of the matching miners to another pool or wallet, like
+	// "worker=acme-* acme.pool:5209 xel:..." or "ip=10.1.0.0/16 - xel:...". See ParseRoutes.
+	Routes []string
+
+	// JSON-RPC URL of a XELIS daemon, like "http://127.0.0.1:8080/json_rpc", which gives the
+	// network difficulty to detect the found blocks, and the height if the pool doesn't send it. If
+	// empty, the pool's are used, when it sends them.
+	DaemonAddress string
+
+	// optional algorithms to advertise to the pool and the miners besides xel/0, like "xel/1". An
+	// algorithm is also enabled when the pool sends a job with it, after a hard fork.
+	Algorithms []string
+
+	// extra nonce bytes requested from the pool, if it's another xatum-proxy. Set it when the
+	// proxy is connected to another proxy, 0 to disable it.
+	UpstreamXnBytes uint8
+
+	AdminBindPort uint16 // admin API port, 0 to disable it
+	AdminToken    string
+
+	// the dashboard shows the miners' IPs and wallets, so it requires AdminToken
+	DashboardEnabled  bool
+	DashboardBindPort uint16 // on GetworkBindAddress, 0 to serve the dashboard on the Getwork port
+
+	Alerts AlertConfig
+
+	DataDir string // directory of the TLS certificate, the audit log and the blocks log, the working directory if empty
+}
+
+// 5210: Getwork
+// 5211: Xatum
+// 5212: Xatum public (mining pools)
+
+// DefaultConfig returns the default configuration
+func DefaultConfig() Config {
+	return Config{
+		Debug:           false,
+		WalletAddress:   "YOUR WALLET ADDRESS HERE",
+		PoolAddress:     "auto.xatum.xelpool.com:5212",
+		XatumBindPort:   5211,
+		GetworkBindPort: 5210,
+
+		XatumListen:   []string{},
+		GetworkListen: []string{},
+		BackupPools:   []string{},
+		Schedule:      []string{},
+		Split:         []string{},
+		Routes:        []string{},
+		Algorithms:    []string{},
+
+		VerifyJobKey: true,
+
+		GetworkBindAddress:    "0.0.0.0",
+		GetworkAllowedWallets: []string{},
+		GetworkAllowedOrigins: []string{},
+		TrustedProxies:        []string{},
+
+		Alerts: AlertConfig{
+			Webhooks:          []string{},
+			DebounceSeconds:   300,
+			DeadWorkerSeconds: 600,
+			JobStallSeconds:   300,
+			RejectedRatio:     0.1,
+		},
+	}
+}
+
+// Validate checks the configuration, and returns an error for each invalid field
+func (c Config) Validate() error {
+	errs := make([]error, 0)
+	invalid := func(field string, format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, a...)...))
+	}
+
+	if strings.TrimSpace(c.WalletAddress) == "" {
+		invalid("WalletAddress", "is required")
+	} else if _, err := xelisutil.ParseAddress(c.WalletAddress); err != nil {
+		invalid("WalletAddress", "%s", err)
+	}
+
+	for _, v := range c.GetworkAllowedWallets {
+		if _, err := xelisutil.ParseAddress(v); err != nil {
+			invalid("GetworkAllowedWallets", "%q: %s", v, err)
+		}
+	}
+
+	if c.PoolAddress == "" {
+		invalid("PoolAddress", "is required")
+	} else if err := checkHostPort(c.PoolAddress); err != nil {
+		invalid("PoolAddress", "%s, expected host:port", err)
+	}
+
+	for _, v := range c.BackupPools {
+		if err := checkHostPort(v); err != nil {
+			invalid("BackupPools", "%q: %s, expected host:port", v, err)
+		}
+	}
+
+	checkUpstreams := func(field string, ups []Upstream) {
+		for _, v := range ups {
+			if v.Pool != "" {
+				if err := checkHostPort(v.Pool); err != nil {
+					invalid(field, "pool %q: %s, expected host:port", v.Pool, err)
+				}
+			}
+			if v.Wallet != "" {
+				if _, err := xelisutil.ParseAddress(v.Wallet); err != nil {
+					invalid(field, "wallet %q: %s", v.Wallet, err)
+				}
+			}
+		}
+	}
+
+	if sched, err := ParseSchedule(c.Schedule); err != nil {
+		invalid("Schedule", "%s", err)
+	} else {
+		checkUpstreams("Schedule", sched.Upstreams())
+	}
+
+	if split, err := ParseSplit(c.Split); err != nil {
+		invalid("Split", "%s", err)
+	} else {
+		ups := make([]Upstream, 0, len(split))
+		for _, v := range split {
+			ups = append(ups, v.Upstream)
+		}
+		checkUpstreams("Split", ups)
+	}
+
+	if routes, err := ParseRoutes(c.Routes); err != nil {
+		invalid("Routes", "%s", err)
+	} else {
+		ups := make([]Upstream, 0, len(routes))
+		for _, v := range routes {
+			if v.Wallet != "" {
+				if _, err := xelisutil.ParseAddress(v.Wallet); err != nil {
+					invalid("Routes", "wallet %q: %s", v.Wallet, err)
+				}
+			}
+			ups = append(ups, v.Upstream)
+		}
+		checkUpstreams("Routes", ups)
+	}
+
+	for _, v := range c.XatumListen {
+		if err := checkListenAddr(v); err != nil {
+			invalid("XatumListen", "%q: %s", v, err)
+		}
+	}
+	for _, v := range c.GetworkListen {
+		if err := checkListenAddr(v); err != nil {
+			invalid("GetworkListen", "%q: %s", v, err)
+		}
+	}
+
+	if _, err := proxyproto.ParseTrusted(c.TrustedProxies); err != nil {
+		invalid("TrustedProxies", "%s", err)
+	}
+
+	if c.DaemonAddress != "" {
+		u, err := url.Parse(c.DaemonAddress)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("DaemonAddress", "%q is not an http or https URL", c.DaemonAddress)
+		}
+	}
+
+	for _, v := range c.Algorithms {
+		if !xelishash.Supported(v) {
+			invalid("Algorithms", "unknown algorithm %q", v)
+		}
+	}
+
+	const maxXnBytes = 32 - xatum.DEFAULT_XN_PREFIX - xatum.MIN_XN_FREE
+	if c.UpstreamXnBytes > maxXnBytes {
+		invalid("UpstreamXnBytes", "must be at most %d", maxXnBytes)
+	}
+
+	if c.DashboardEnabled && c.AdminToken == "" {
+		invalid("DashboardEnabled", "requires AdminToken")
+	}
+	if c.DashboardEnabled && c.DashboardBindPort != 0 && c.DashboardBindPort == c.AdminBindPort {
+		invalid("DashboardBindPort", "is the same as AdminBindPort")
+	}
+
+	for _, v := range c.Alerts.Webhooks {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("Alerts.Webhooks", "%q is not an http or https URL", v)
+		}
+	}
+
+	if c.Alerts.RejectedRatio < 0 || c.Alerts.RejectedRatio > 1 {
+		invalid("Alerts.RejectedRatio", "must be between 0 and 1")
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func checkListenAddr(addr string) error {
+	network, address := util.ListenAddr(addr)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("empty unix socket path")
+		}
+		return nil
+	}
+	return checkHostPort(address)
+}
+
+func (p *Proxy) xatumListenAddrs() []string {
+	if len(p.cfg.XatumListen) > 0 {
+		return p.cfg.XatumListen
+	}
+	return []string{"0.0.0.0:" + strconv.FormatUint(uint64(p.cfg.XatumBindPort), 10)}
+}
+
+func (p *Proxy) getworkListenAddrs() []string {
+	if len(p.cfg.GetworkListen) > 0 {
+		return p.cfg.GetworkListen
+	}
+	return []string{net.JoinHostPort(p.cfg.GetworkBindAddress, strconv.FormatUint(uint64(p.cfg.GetworkBindPort), 10))}
+}
+
+func (p *Proxy) initTrustedProxies() error {
+	var err error
+	p.trustedProxies, err = proxyproto.ParseTrusted(p.cfg.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid TrustedProxies: %w", err)
+	}
+
+	if (p.cfg.XatumProxyProtocol || p.cfg.GetworkProxyProtocol || p.cfg.GetworkForwardedFor) && len(p.trustedProxies) == 0 {
+		log.Warn("PROXY protocol or X-Forwarded-For is enabled, but TrustedProxies is empty")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WalletAddress = "xel:vs3mfyywt0fjys0rgslue7mm4wr23xdgejsjk0ld7f2kxng4d4nqqnkdufz"
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatalf("default configuration is invalid: %v", err)
+	}
+
+	cfg.WalletAddress = " "
+	cfg.PoolAddress = "pool.example.com"
+	cfg.XatumListen = []string{"[::]:5211", "unix:", "0.0.0.0:port"}
+	cfg.BackupPools = []string{"backup.example.com:5212", "backup"}
+	cfg.GetworkAllowedWallets = []string{"xel:qqq"}
+	cfg.TrustedProxies = []string{"10.0.0.0/8", "nope"}
+	cfg.Schedule = []string{"10% - xel:qqq"}
+	cfg.Routes = []string{"worker=acme-* acme.pool"}
+	cfg.DaemonAddress = "127.0.0.1:8080"
+	cfg.DashboardEnabled = true
+	cfg.Algorithms = []string{"xel/1", "xel/9"}
+	cfg.UpstreamXnBytes = 5
+	cfg.Alerts.Webhooks = []string{"https://example.com/hook", "ftp://example.com"}
+	cfg.Alerts.RejectedRatio = 1.5
+
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+
+	for _, v := range []string{
+		"WalletAddress: is required",
+		"PoolAddress: address pool.example.com: missing port in address",
+		`XatumListen: "unix:": empty unix socket path`,
+		`XatumListen: "0.0.0.0:port": invalid port "port"`,
+		`BackupPools: "backup": address backup: missing port in address`,
+		`GetworkAllowedWallets: "xel:qqq": invalid address: too short`,
+		"TrustedProxies:",
+		`Schedule: wallet "xel:qqq": invalid address: too short`,
+		`Routes: pool "acme.pool": address acme.pool: missing port in address`,
+		`DaemonAddress: "127.0.0.1:8080" is not an http or https URL`,
+		`Algorithms: unknown algorithm "xel/9"`,
+		"UpstreamXnBytes: must be at most 2",
+		"DashboardEnabled: requires AdminToken",
+		`Alerts.Webhooks: "ftp://example.com" is not an http or https URL`,
+		"Alerts.RejectedRatio: must be between 0 and 1",
+	} {
+		if !strings.Contains(err.Error(), v) {
+			t.Errorf("expected error %q in:\n%s", v, err)
+		}
+	}
+
+	if n := strings.Count(err.Error(), "\n") + 1; n != 15 {
+		t.Errorf("expected 15 errors, got %d:\n%s", n, err)
+	}
+}
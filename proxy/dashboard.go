@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"xatum-proxy/log"
+
+	"github.com/gorilla/websocket"
+)
+
+// Web dashboard. The page is embedded in the executable, and receives the proxy state over a
+// websocket. It shows the miners' IPs and wallets, so it requires the AdminToken, in the token
+// query parameter of the page, like /dashboard/?token=..., or in the Authorization header.
+
+//go:embed dashboard/index.html
+var dashboardHtml []byte
+
+const DASHBOARD_UPDATE_INTERVAL = 2 * time.Second
+
+type DashboardState struct {
+	Time    int64  `json:"time"` // unix milliseconds
+	Version string `json:"version"`
+
+	Upstream struct {
+		Connected bool   `json:"connected"`
+		Address   string `json:"address"`
+		Wallet    string `json:"wallet"`
+		Since     int64  `json:"since"` // unix milliseconds
+	} `json:"upstream"`
+
+	Job struct {
+		Diff     uint64 `json:"diff"`
+		Algo     string `json:"algo"`
+		Workhash string `json:"workhash"`
+		NetDiff  uint64 `json:"net_diff"` // 0 if unknown
+	} `json:"job"`
+
+	Shares struct {
+		Submitted uint64 `json:"submitted"`
+		Accepted  uint64 `json:"accepted"`
+		Rejected  uint64 `json:"rejected"`
+	} `json:"shares"`
+
+	BlocksFound uint64 `json:"blocks_found"`
+
+	Hashrate []HashrateSample  `json:"hashrate"`
+	Workers  []AdminConnection `json:"workers"`
+	Agents   []AdminAgentStats `json:"agents"`
+	Blocks   []BlockCandidate  `json:"blocks"`
+	Events   []Event           `json:"events"`
+}
+
+var dashboardUpgrader = websocket.Upgrader{}
+
+func (p *Proxy) listenDashboard() error {
+	if !p.cfg.DashboardEnabled || p.cfg.DashboardBindPort == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	p.registerDashboard(mux)
+
+	addr := net.JoinHostPort(p.cfg.GetworkBindAddress, strconv.FormatUint(uint64(p.cfg.DashboardBindPort), 10))
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Dashboard listening on", addr)
+
+	s := &http.Server{
+		Handler: mux,
+	}
+	p.serveHttp(s, func() error {
+		return s.Serve(listener)
+	})
+
+	return nil
+}
+
+func (p *Proxy) registerDashboard(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard/", p.dashboardAuth(dashboardHandler))
+	mux.HandleFunc("/dashboard/ws", p.dashboardAuth(p.dashboardWsHandler))
+}
+
+// like adminAuth, but the token can be in the query, as browsers can't set the header of the
+// page or of the websocket
+func (p *Proxy) dashboardAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if p.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.cfg.AdminToken)) != 1 {
+			log.Warn("dashboard: unauthorized request from", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHtml)
+}
+
+func (p *Proxy) dashboardState() DashboardState {
+	st := DashboardState{
+		Time:    time.Now().UnixMilli(),
+		Version: VERSION,
+	}
+
+	st.Upstream.Wallet = p.Upstream().Wallet
+
+	p.stats.RLock()
+	st.Upstream.Connected = p.stats.UpstreamConnected
+	st.Upstream.Address = p.stats.UpstreamAddress
+	st.Upstream.Since = p.stats.UpstreamSince.UnixMilli()
+	st.Shares.Submitted = p.stats.SharesSubmitted
+	st.Shares.Accepted = p.stats.SharesAccepted
+	st.Shares.Rejected = p.stats.SharesRejected
+	st.BlocksFound = p.stats.BlocksFound
+	p.stats.RUnlock()
+
+	p.mutCurJob.RLock()
+	st.Job.Diff = p.curJob.Diff
+	st.Job.Algo = p.curJob.Algo
+	st.Job.NetDiff = p.networkDiff(p.curJob.NetDiff)
+	workhash := p.curJob.Blob.GetWorkhash()
+	p.mutCurJob.RUnlock()
+	st.Job.Workhash = hex.EncodeToString(workhash[:])
+
+	st.Hashrate = p.stats.Samples()
+	st.Workers = p.listConnections()
+	st.Agents = agentStats(st.Workers)
+	st.Blocks = p.stats.Blocks()
+	st.Events = p.stats.Events()
+
+	return st
+}
+
+func (p *Proxy) dashboardWsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := dashboardUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn("dashboard upgrade:", err)
+		return
+	}
+	defer conn.Close()
+
+	log.Debug("dashboard client connected:", conn.RemoteAddr().String())
+
+	// read messages only to detect the disconnection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		err := conn.WriteJSON(p.dashboardState())
+		if err != nil {
+			log.Debug("dashboard client disconnected:", err)
+			return
+		}
+
+		select {
+		case <-closed:
+			log.Debug("dashboard client disconnected")
+			return
+		case <-p.ctx.Done():
+			return
+		case <-time.After(DASHBOARD_UPDATE_INTERVAL):
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDashboardAuth(t *testing.T) {
+	p := &Proxy{
+		cfg: Config{AdminToken: "secret"},
+	}
+
+	mux := http.NewServeMux()
+	p.registerDashboard(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(path, auth string) int {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for _, v := range []struct {
+		path, auth string
+		status     int
+	}{
+		{"/dashboard/", "", http.StatusUnauthorized},
+		{"/dashboard/?token=wrong", "", http.StatusUnauthorized},
+		{"/dashboard/ws", "", http.StatusUnauthorized},
+		{"/dashboard/", "Bearer wrong", http.StatusUnauthorized},
+		{"/dashboard/?token=secret", "", http.StatusOK},
+		{"/dashboard/", "Bearer secret", http.StatusOK},
+	} {
+		if s := get(v.path, v.auth); s != v.status {
+			t.Fatalf("%s %q: expected status %d, got %d", v.path, v.auth, v.status, s)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"xatum-proxy/log"
+	"xatum-proxy/util"
+)
+
+// Emulation of the XELIS daemon JSON-RPC methods used by the miners.
+// HTTP is stateless, so the HTTP clients are identified by IP. Each one gets its own extra nonce,
+// like the websocket miners, and is forgotten after HTTP_CLIENT_TIMEOUT without requests.
+
+const HTTP_CLIENT_TIMEOUT = 10 * time.Minute
+
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_INTERNAL_ERROR   = -32603
+)
+
+type RpcRequest struct {
+	JsonRpc string          `json:"jsonrpc,omitempty"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type RpcResponse struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *RpcError       `json:"error,omitempty"`
+}
+
+type RpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type RpcGetInfoResult struct {
+	Height       uint64 `json:"height"`
+	TopoHeight   uint64 `json:"topoheight"`
+	StableHeight uint64 `json:"stableheight"`
+	Difficulty   string `json:"difficulty"`
+	Version      string `json:"version"`
+	Network      string `json:"network"`
+}
+
+type RpcBlockTemplateResult struct {
+	Template   string `json:"template"`
+	Algorithm  string `json:"algorithm"`
+	Height     uint64 `json:"height"`
+	TopoHeight uint64 `json:"topoheight"`
+	Difficulty string `json:"difficulty"`
+}
+
+type RpcSubmitBlockParams struct {
+	BlockTemplate string `json:"block_template"`
+	MinerWork     string `json:"miner_work,omitempty"`
+}
+
+func newRpcError(id json.RawMessage, code int, msg string) RpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+
+	return RpcResponse{
+		JsonRpc: "2.0",
+		Id:      id,
+		Error: &RpcError{
+			Code:    code,
+			Message: msg,
+		},
+	}
+}
+
+func newRpcResult(id json.RawMessage, result any) RpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+
+	return RpcResponse{
+		JsonRpc: "2.0",
+		Id:      id,
+		Result:  result,
+	}
+}
+
+func (p *Proxy) handleRpcRequest(req RpcRequest, c *GetworkConn) RpcResponse {
+	log.Debugf("RPC request %s", req.Method)
+
+	if req.JsonRpc != "2.0" {
+		return newRpcError(req.Id, RPC_INVALID_REQUEST, "invalid JSON-RPC version")
+	}
+
+	// the miners work on their own job, of their lane
+	c.RLock()
+	job := Job{
+		Blob:   c.CurrentJob.BlockMiner,
+		Diff:   c.CurrentJob.Diff,
+		Algo:   c.CurrentJob.Algo,
+		Height: c.CurrentJob.Height,
+	}
+	c.RUnlock()
+
+	switch req.Method {
+	case "get_version":
+		return newRpcResult(req.Id, VERSION)
+	case "get_height", "get_topoheight", "get_stable_height":
+		return newRpcResult(req.Id, job.Height)
+	case "get_info":
+		return newRpcResult(req.Id, RpcGetInfoResult{
+			Height:       job.Height,
+			TopoHeight:   job.Height,
+			StableHeight: job.Height,
+			Difficulty:   strconv.FormatUint(job.Diff, 10),
+			Version:      VERSION,
+			Network:      p.wallet.Network(),
+		})
+	case "get_block_template", "get_miner_work":
+		if job.Diff == 0 {
+			return newRpcError(req.Id, RPC_INTERNAL_ERROR, "no job available")
+		}
+
+		return newRpcResult(req.Id, RpcBlockTemplateResult{
+			Template:   hex.EncodeToString(job.Blob[:]),
+			Algorithm:  getworkAlgoName(job.Algo),
+			Height:     job.Height,
+			TopoHeight: job.Height,
+			Difficulty: strconv.FormatUint(job.Diff, 10),
+		})
+	case "submit_block":
+		params := RpcSubmitBlockParams{}
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return newRpcError(req.Id, RPC_INVALID_PARAMS, "invalid params: "+err.Error())
+		}
+
+		work := params.MinerWork
+		if work == "" {
+			work = params.BlockTemplate
+		}
+
+		err = p.submitGetworkWork(work, c)
+		if err != nil {
+			return newRpcError(req.Id, RPC_INVALID_PARAMS, err.Error())
+		}
+
+		return newRpcResult(req.Id, true)
+	default:
+		return newRpcError(req.Id, RPC_METHOD_NOT_FOUND, "method not found: "+req.Method)
+	}
+}
+
+// handles JSON-RPC requests over HTTP POST
+func (p *Proxy) rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := p.getworkRemoteIP(r)
+
+	if p.srv.IsBanned(ip) {
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+
+	err := p.authorizeGetwork(r, "")
+	if err != nil {
+		log.Warn("refusing Getwork RPC request from", ip+":", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var res RpcResponse
+
+	req := RpcRequest{}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		res = newRpcError(nil, RPC_PARSE_ERROR, "parse error")
+	} else {
+		res = p.handleRpcRequest(req, p.httpClient(ip))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Warn("failed to send RPC reply:", err)
+	}
+}
+
+type httpClient struct {
+	conn     *GetworkConn
+	lastSeen time.Time
+}
+
+// returns the Getwork connection of an HTTP client, with a job of its own for the job of its lane
+func (p *Proxy) httpClient(ip string) *GetworkConn {
+	now := time.Now()
+
+	p.httpClientsMut.Lock()
+	cl, ok := p.httpClients[ip]
+	if !ok {
+		cl = &httpClient{
+			conn: &GetworkConn{
+				ip:     ip,
+				Id:     util.RandomUint64(),
+				Worker: ip,
+			},
+		}
+		p.httpClients[ip] = cl
+
+		// like the websocket miners, it gets the lane of its route or a lane of the split
+		p.assignLane(cl.conn.info())
+	}
+	cl.lastSeen = now
+
+	for k, v := range p.httpClients {
+		if now.Sub(v.lastSeen) > HTTP_CLIENT_TIMEOUT {
+			delete(p.httpClients, k)
+			p.removeLane(v.conn.Id)
+		}
+	}
+	p.httpClientsMut.Unlock()
+
+	c := cl.conn
+	job := p.minerJob(c.Id)
+
+	c.Lock()
+	defer c.Unlock()
+
+	cur := c.CurrentJob
+	if job.Diff != 0 && (cur.Diff != job.Diff || cur.BlockMiner.GetWorkhash() != job.Blob.GetWorkhash() ||
+		cur.BlockMiner.GetPublickey() != job.Blob.GetPublickey()) {
+		c.newJob(job)
+	}
+
+	return c
+}
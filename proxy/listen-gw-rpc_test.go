@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+func TestRpcHttpClients(t *testing.T) {
+	p, err := New(testConfig(t, "127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.curJob = Job{
+		Blob:     xelisutil.BlockMiner(testJob(1).Blob),
+		Diff:     1,
+		Algo:     xelishash.ALGO_V1,
+		Id:       "1",
+		XnPrefix: xatum.DEFAULT_XN_PREFIX,
+	}
+
+	call := func(ip, body string) RpcResponse {
+		r := httptest.NewRequest(http.MethodPost, "/json_rpc", strings.NewReader(body))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		p.rpcHandler(w, r)
+
+		res := RpcResponse{}
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	template := func(ip string) string {
+		res := call(ip, `{"jsonrpc":"2.0","id":1,"method":"get_block_template"}`)
+		if res.Error != nil {
+			t.Fatal(res.Error.Message)
+		}
+		return res.Result.(map[string]any)["template"].(string)
+	}
+	submit := func(ip, work string) *RpcError {
+		return call(ip, `{"jsonrpc":"2.0","id":1,"method":"submit_block","params":{"miner_work":"`+work+`"}}`).Error
+	}
+
+	// the network is the wallet's
+	res := call("10.0.0.1", `{"jsonrpc":"2.0","id":1,"method":"get_info"}`)
+	if n := res.Result.(map[string]any)["network"]; n != "testnet" {
+		t.Fatalf("expected testnet, got %v", n)
+	}
+
+	// each client has its own extra nonce, which stays the same until the job changes
+	a, b := template("10.0.0.1"), template("10.0.0.2")
+	if a == b {
+		t.Fatal("the clients have the same extra nonce")
+	}
+	if template("10.0.0.1") != a {
+		t.Fatal("the client's job changed")
+	}
+
+	if err := submit("10.0.0.1", a); err != nil {
+		t.Fatal(err.Message)
+	}
+	if err := submit("10.0.0.1", a); err == nil || err.Message != "duplicate share" {
+		t.Fatalf("expected a duplicate share, got %+v", err)
+	}
+	// the work of another client is unknown
+	if err := submit("10.0.0.1", b); err == nil || err.Message != "stale or unknown job" {
+		t.Fatalf("expected an unknown job, got %+v", err)
+	}
+}
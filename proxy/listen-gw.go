@@ -0,0 +1,643 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xatum-proxy/agent"
+	"xatum-proxy/log"
+	"xatum-proxy/proxyproto"
+	"xatum-proxy/util"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xatum/server"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+
+	"github.com/gorilla/websocket"
+)
+
+func fmtMessageType(mt int) string {
+	if mt == websocket.BinaryMessage {
+		return "binary"
+	} else if mt == websocket.TextMessage {
+		return "text"
+	} else {
+		return "Unknown Message Type"
+	}
+}
+
+type GetworkConn struct {
+	conn *websocket.Conn
+	ip   string // client IP, from X-Forwarded-For if enabled
+	Id   uint64
+
+	// miner identity, from the URL path /getwork/<wallet>/<worker>
+	Wallet string
+	Worker string
+
+	Agent  string // the User-Agent header
+	Quirks agent.Quirks
+
+	Diff uint64 // difficulty set with the admin API, 0 for the pool's
+
+	CurrentJob server.ConnJob
+	LastJob    server.ConnJob
+
+	Shares    uint64 // valid shares
+	Rejected  uint64 // shares rejected by the proxy
+	LastShare time.Time
+
+	sync.RWMutex
+}
+
+// sets a new job with a distinct extra nonce, and returns it
+// GetworkConn MUST be locked before calling this
+func (g *GetworkConn) newJob(job Job) Job {
+	setRandomExtraNonce(&job.Blob, job.XnPrefix)
+	job.Diff = max(job.Diff, g.Diff)
+
+	g.LastJob = g.CurrentJob
+	g.CurrentJob = server.ConnJob{
+		Id:              job.Id,
+		Diff:            job.Diff,
+		Algo:            job.Algo,
+		XnPrefix:        job.XnPrefix,
+		Height:          job.Height,
+		NetDiff:         job.NetDiff,
+		BlockMiner:      job.Blob,
+		SubmittedNonces: make([]uint64, 0, 8),
+		Upstream:        job.Upstream,
+	}
+
+	return job
+}
+
+// returns the job which the submitted blob belongs to
+// GetworkConn MUST be locked before calling this
+func (g *GetworkConn) findJob(blob xelisutil.BlockMiner) (*server.ConnJob, error) {
+	for _, j := range []*server.ConnJob{&g.CurrentJob, &g.LastJob} {
+		if j.Diff == 0 {
+			continue
+		}
+
+		if j.BlockMiner.GetWorkhash() == blob.GetWorkhash() &&
+			j.BlockMiner.GetExtraNonce() == blob.GetExtraNonce() &&
+			j.BlockMiner.GetPublickey() == blob.GetPublickey() {
+			return j, nil
+		}
+	}
+
+	return nil, errors.New("stale or unknown job")
+}
+
+// returns the websocket with the connection ID, or nil
+func (p *Proxy) findSocket(id uint64) *GetworkConn {
+	p.socketsMut.RLock()
+	defer p.socketsMut.RUnlock()
+
+	for _, c := range p.sockets {
+		if c != nil && c.Id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// removes a websocket from the list of sockets
+func (p *Proxy) removeSocket(c *GetworkConn) {
+	p.socketsMut.Lock()
+	defer p.socketsMut.Unlock()
+
+	for i, v := range p.sockets {
+		if v == c {
+			p.sockets[i] = nil
+		}
+	}
+}
+
+// GetworkConn MUST be locked before calling this
+func (g *GetworkConn) WriteJSON(data interface{}) error {
+	return g.conn.WriteJSON(data)
+}
+
+func (g *GetworkConn) IP() string {
+	return g.ip
+}
+
+// returns the connection info, for the hooks
+func (g *GetworkConn) info() ConnectionInfo {
+	g.RLock()
+	defer g.RUnlock()
+
+	return ConnectionInfo{
+		Id:       g.Id,
+		Protocol: "getwork",
+		IP:       g.ip,
+		Wallet:   g.Wallet,
+		Worker:   g.Worker,
+		Agent:    g.Agent,
+	}
+}
+
+func (g *GetworkConn) Close() error {
+	return g.conn.Close()
+}
+
+// sends a job to the websockets of the lane, and removes old websockets
+func (p *Proxy) sendJobToWebsocket(job Job, lane int) {
+	p.socketsMut.Lock()
+	defer p.socketsMut.Unlock()
+
+	log.Dev("sendJobToWebsocket: num sockets:", len(p.sockets))
+
+	log.Dev("sendJobToWebsocket: socketsMut Lock success")
+
+	// remove disconnected sockets
+
+	sockets2 := make([]*GetworkConn, 0, len(p.sockets))
+	for _, c := range p.sockets {
+		if c == nil {
+			continue
+		}
+		sockets2 = append(sockets2, c)
+	}
+	log.Dev("sendJobToWebsocket: going from", len(p.sockets), "to", len(sockets2), "getwork miners")
+	p.sockets = sockets2
+
+	if len(p.sockets) > 0 {
+		log.Info("Sending job to", len(p.sockets), "GetWork miners")
+	}
+
+	// send jobs to the remaining sockets
+
+	for _, cx := range p.sockets {
+		if cx == nil {
+			log.Dev("cx is nil")
+			continue
+		}
+		if p.minerLane(cx.Id) != lane {
+			continue
+		}
+
+		c := cx
+
+		// send job in a new thread to avoid blocking the main thread and reduce latency
+		go func() {
+			log.Debug("sendJobToWebsocket: sending to IP", c.IP())
+
+			c.Lock()
+			err := c.WriteJSON(map[string]any{
+				"new_job": newBlockTemplate(c.newJob(job)),
+			})
+			c.Unlock()
+
+			log.Debug("sendJobToWebsocket: sent to IP", c.IP())
+
+			// if write failed, close the connection (if it isn't already closed) and remove it from
+			// the list of sockets
+			if err != nil {
+				log.Warn("sendJobToWebsocket: cannot send job:", err)
+				c.Lock()
+				c.Close()
+				c.Unlock()
+
+				p.removeSocket(c)
+
+				log.Warn("sendJobToWebsocket: cannot send job DONE")
+				return
+			}
+
+			c.RLock()
+			log.Debug("sendJobToWebsocket: done, sent to IP", c.IP())
+			c.RUnlock()
+		}()
+	}
+}
+
+func (p *Proxy) listenGetwork() error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", p.wsHandler)
+	mux.HandleFunc("/json_rpc", p.rpcHandler)
+
+	if p.cfg.DashboardEnabled && p.cfg.DashboardBindPort == 0 {
+		p.registerDashboard(mux)
+	}
+
+	s := &http.Server{
+		Handler: mux,
+	}
+
+	if p.cfg.GetworkTLS {
+		cert, err := server.LoadCertificate(p.cfg.DataDir)
+		if err != nil {
+			return err
+		}
+
+		s.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	listeners := make([]net.Listener, 0)
+
+	for _, addr := range p.getworkListenAddrs() {
+		network, address := util.ListenAddr(addr)
+
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if p.cfg.GetworkProxyProtocol {
+			listener = proxyproto.NewListener(listener, p.trustedProxies)
+		}
+
+		if p.cfg.GetworkTLS {
+			log.Info("Getwork server listening on", addr, "with TLS")
+		} else {
+			log.Info("Getwork server listening on", addr)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners {
+		if p.cfg.GetworkTLS {
+			p.serveHttp(s, func() error {
+				return s.ServeTLS(listener, "", "")
+			})
+		} else {
+			p.serveHttp(s, func() error {
+				return s.Serve(listener)
+			})
+		}
+	}
+
+	return nil
+}
+
+// checks the Origin header of websocket connections. Miners usually don't send it, while browsers
+// always do.
+func (p *Proxy) checkGetworkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(p.cfg.GetworkAllowedOrigins) == 0 {
+		// same as the websocket default: only allow the same host
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, v := range p.cfg.GetworkAllowedOrigins {
+		if v == "*" || strings.EqualFold(v, origin) {
+			return true
+		}
+	}
+
+	log.Debug("refusing Getwork connection with origin", origin)
+	return false
+}
+
+// checks the Getwork token, sent as the "token" query parameter or as a bearer token, and the wallet
+// allow-list. The wallet is empty for HTTP JSON-RPC requests, so they are refused if the allow-list
+// is enabled.
+func (p *Proxy) authorizeGetwork(r *http.Request, wallet string) error {
+	if p.cfg.GetworkToken != "" {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.cfg.GetworkToken)) != 1 {
+			return errors.New("invalid token")
+		}
+	}
+
+	if len(p.cfg.GetworkAllowedWallets) > 0 && !slices.Contains(p.cfg.GetworkAllowedWallets, wallet) {
+		return fmt.Errorf("wallet %s is not allowed", wallet)
+	}
+
+	return nil
+}
+
+type BlockTemplate struct {
+	Algorithm  string `json:"algorithm"`
+	Difficulty string `json:"difficulty"`
+	Height     uint64 `json:"height"`
+	TopoHeight uint64 `json:"topoheight"`
+	MinerWork  string `json:"miner_work"`
+	Template   string `json:"template"` // same as MinerWork, for older miners
+}
+
+// GetworkMessage is a message received from a Getwork miner. It is either a work submission or a
+// JSON-RPC request.
+type GetworkMessage struct {
+	MinerWork     string `json:"miner_work"`
+	BlockTemplate string `json:"block_template"`
+
+	RpcRequest
+}
+
+func newBlockTemplate(job Job) BlockTemplate {
+	blob := hex.EncodeToString(job.Blob[:])
+
+	return BlockTemplate{
+		Algorithm:  getworkAlgoName(job.Algo),
+		Difficulty: strconv.FormatUint(job.Diff, 10),
+		Height:     job.Height,
+		TopoHeight: job.Height,
+		MinerWork:  blob,
+		Template:   blob,
+	}
+}
+
+// XELIS daemons name the algorithms differently from Xatum
+func getworkAlgoName(algo string) string {
+	switch algo {
+	case xelishash.ALGO_V1:
+		return "xel/v1"
+	case xelishash.ALGO_V2:
+		return "xel/v2"
+	default:
+		return algo
+	}
+}
+
+// returns the IP of a Getwork client, using X-Forwarded-For if enabled
+func (p *Proxy) getworkRemoteIP(r *http.Request) string {
+	ip := util.RemovePort(r.RemoteAddr)
+	if !p.cfg.GetworkForwardedFor {
+		return ip
+	}
+	return proxyproto.ForwardedFor(p.trustedProxies, ip, strings.Join(r.Header.Values("X-Forwarded-For"), ","))
+}
+
+func (p *Proxy) wsHandler(w http.ResponseWriter, r *http.Request) {
+	ip := p.getworkRemoteIP(r)
+
+	if p.srv.IsBanned(ip) {
+		log.Debug("refusing Getwork connection from banned IP", ip)
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+
+	wallet, worker := parseGetworkPath(r.URL.Path)
+
+	if wallet != "" {
+		err := p.checkMinerAddress(wallet)
+		if err != nil {
+			log.Warn("refusing Getwork connection from", ip+":", err)
+			http.Error(w, "invalid wallet address: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := p.authorizeGetwork(r, wallet)
+	if err != nil {
+		log.Warn("refusing Getwork connection from", ip+":", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn("upgrade:", err)
+		return
+	}
+	defer conn.Close()
+	if worker == "" {
+		worker = ip
+	}
+
+	userAgent := r.Header.Get("User-Agent")
+	minerAgent := agent.Parse(userAgent)
+
+	log.Info("Miner with IP", ip, "connected to Getwork | Address:", wallet, "Worker:", worker, "UserAgent:", userAgent, "("+minerAgent.String()+")")
+	p.stats.AddEvent("info", "Getwork miner %s (%s) connected", worker, ip)
+
+	// Getwork miners can't get messages, the warning is only logged
+	if minerAgent.Warning != "" {
+		logAgentWarning(minerAgent, wallet, worker)
+	}
+
+	p.socketsMut.Lock()
+	c := &GetworkConn{
+		conn:   conn,
+		ip:     ip,
+		Id:     util.RandomUint64(),
+		Wallet: wallet,
+		Worker: worker,
+		Agent:  userAgent,
+		Quirks: minerAgent.Quirks,
+	}
+	p.sockets = append(p.sockets, c)
+	p.socketsMut.Unlock()
+
+	if p.Hooks.OnConnect != nil {
+		p.Hooks.OnConnect(c.info())
+	}
+
+	// send first job, of the miner's lane
+	job := p.laneJob(p.assignLane(c.info()))
+
+	if job.Diff == 0 {
+		log.Debug("not sending first job, because there is no first job yet")
+	} else {
+		log.Debug("sending first job")
+
+		c.Lock()
+		err = c.WriteJSON(map[string]any{
+			"new_job": newBlockTemplate(c.newJob(job)),
+		})
+		c.Unlock()
+		if err != nil {
+			log.Warn("failed to send first job:", err)
+		}
+
+		log.Debug("done sending first job")
+	}
+
+	for {
+		mt, message, err := c.conn.ReadMessage()
+		if err != nil {
+			log.Info("Getwork miner disconnected:", err)
+			p.stats.AddEvent("info", "Getwork miner %s (%s) disconnected", c.Worker, ip)
+			p.hashrates.RemoveConnection(c.Id)
+			p.removeLane(c.Id)
+			p.removeSocket(c)
+
+			if p.Hooks.OnDisconnect != nil {
+				p.Hooks.OnDisconnect(c.info())
+			}
+			break
+		}
+
+		log.Debugf("recv: %s, type: %s", message, fmtMessageType(mt))
+
+		msg := GetworkMessage{}
+
+		err = json.Unmarshal(message, &msg)
+		if err != nil {
+			log.Warn("Getwork miner sent invalid JSON:", err)
+
+			c.Lock()
+			err = c.WriteJSON(newRpcError(nil, RPC_PARSE_ERROR, "parse error"))
+			c.Unlock()
+			if err != nil {
+				log.Warn("failed to send reply:", err)
+			}
+			continue
+		}
+
+		// some miners speak JSON-RPC on the websocket too
+		if msg.Method != "" {
+			res := p.handleRpcRequest(msg.RpcRequest, c)
+
+			c.Lock()
+			err = c.WriteJSON(res)
+			c.Unlock()
+			if err != nil {
+				log.Warn("failed to send reply:", err)
+			}
+			continue
+		}
+
+		// miners with the block_template quirk submit the work with that key. Unknown miners may
+		// too, so it's used whenever miner_work is empty.
+		minerWork := msg.MinerWork
+		if minerWork == "" || (c.Quirks.BlockTemplate && msg.BlockTemplate != "") {
+			minerWork = msg.BlockTemplate
+		}
+		if minerWork == "" {
+			log.Debug("miner_work and block_template are empty")
+			continue
+		}
+
+		err = p.submitGetworkWork(minerWork, c)
+
+		c.Lock()
+		if err != nil {
+			log.Warn("Getwork share rejected:", err)
+			err = c.WriteJSON(map[string]string{
+				"block_rejected": err.Error(),
+			})
+		} else {
+			err = c.conn.WriteMessage(websocket.TextMessage, []byte(`"block_accepted"`))
+		}
+		c.Unlock()
+		if err != nil {
+			log.Err("failed to send submission reply:", err)
+		}
+	}
+}
+
+// parses the wallet and worker from a /getwork/<wallet>/<worker> path. Missing parts are empty.
+func parseGetworkPath(path string) (wallet, worker string) {
+	rest, ok := strings.CutPrefix(path, "/getwork/")
+	if !ok {
+		return "", ""
+	}
+
+	spl := strings.SplitN(strings.Trim(rest, "/"), "/", 2)
+	wallet = spl[0]
+	if len(spl) > 1 {
+		worker = spl[1]
+	}
+
+	return wallet, worker
+}
+
+// checks the work submitted by a Getwork miner, and sends it to the pool
+func (p *Proxy) submitGetworkWork(minerWork string, c *GetworkConn) error {
+	minerBlob, err := hex.DecodeString(minerWork)
+	if err != nil {
+		return fmt.Errorf("invalid hex: %w", err)
+	}
+
+	if len(minerBlob) != xelisutil.BLOCKMINER_LENGTH {
+		return fmt.Errorf("invalid miner work length %d", len(minerBlob))
+	}
+
+	blob := xelisutil.BlockMiner(minerBlob)
+
+	share := Share{
+		Wallet: p.cfg.WalletAddress,
+	}
+
+	c.Lock()
+	job, err := c.findJob(blob)
+	if err != nil {
+		c.Rejected++
+		c.Unlock()
+		return err
+	}
+	if slices.Contains(job.SubmittedNonces, blob.GetNonce()) {
+		c.Rejected++
+		c.Unlock()
+		return errors.New("duplicate share")
+	}
+	job.SubmittedNonces = append(job.SubmittedNonces, blob.GetNonce())
+
+	diff, algo := job.Diff, job.Algo
+	height, netDiff := job.Height, job.NetDiff
+	jobId := job.Id
+
+	share.Upstream = job.Upstream
+	share.ConnId = c.Id
+	share.Worker = c.Worker
+	if c.Wallet != "" {
+		share.Wallet = c.Wallet
+	}
+	c.Unlock()
+
+	// calculate PoW (unfortunatly it's needed), with the algorithm of the job
+	pow, err := blob.PowHashAlgo(algo)
+	if err != nil {
+		return err
+	}
+
+	if !xelisutil.CheckDiff(pow, diff) {
+		c.Lock()
+		c.Rejected++
+		c.Unlock()
+		return errors.New("low difficulty share")
+	}
+
+	c.Lock()
+	c.Shares++
+	c.LastShare = time.Now()
+	c.Unlock()
+
+	p.stats.ShareSubmitted()
+
+	// the pool's job ID, like the Xatum shares
+	share.Submit = xatum.C2S_Submit{
+		Data: minerBlob,
+		Hash: hex.EncodeToString(pow[:]),
+		Job:  jobId,
+	}
+	share.Diff = diff
+
+	// send share to pool
+	p.submitShare(share)
+
+	p.checkBlock(share, pow, height, netDiff)
+
+	return nil
+}
@@ -0,0 +1,515 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"xatum-proxy/agent"
+	"xatum-proxy/config"
+	"xatum-proxy/log"
+	"xatum-proxy/util"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xatum/server"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+// extensions supported by the proxy
+var xatumCaps = []string{
+	xatum.CapJobId,
+	xatum.CapShareResult,
+	xatum.CapDiff,
+	xatum.CapReconnect,
+}
+
+func (p *Proxy) waitConnections() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case conn := <-p.srv.NewConnections:
+			go p.handleConn(p.srv, conn)
+		}
+	}
+}
+
+func (p *Proxy) handleConn(s *server.Server, conn *server.Connection) {
+	log.Dev("handleConn")
+	rdr := bufio.NewReader(conn.Conn)
+
+	packetsRecv := 0
+
+	go p.sendPingPackets(s, conn)
+
+	for {
+		conn.Lock()
+		conn.Conn.SetReadDeadline(time.Now().Add(config.SLAVE_MINER_TIMEOUT * time.Second))
+		conn.Unlock()
+
+		str, err := rdr.ReadString('\n')
+
+		packetsRecv++
+
+		if err != nil {
+			conn.RLock()
+			p.stats.AddEvent("info", "Xatum miner %s.%s disconnected", conn.Wallet, conn.Worker)
+			info := xatumConnInfo(conn)
+			conn.RUnlock()
+
+			if p.Hooks.OnDisconnect != nil && packetsRecv > 1 {
+				p.Hooks.OnDisconnect(info)
+			}
+
+			p.hashrates.RemoveConnection(conn.Id)
+			p.freeXnSlice(conn.Id)
+			p.removeLane(conn.Id)
+
+			s.Lock() // TODO: put this Lock in pool too
+			defer s.Unlock()
+
+			s.Kick(conn.Id)
+			return
+		}
+
+		log.Net("<<<", str)
+
+		err = p.handleConnPacket(s, conn, str, packetsRecv)
+		if err != nil {
+			log.Err(err)
+			return
+		}
+	}
+}
+
+func (p *Proxy) sendPingPackets(s *server.Server, conn *server.Connection) {
+	for {
+		if !sleep(p.ctx, (config.SLAVE_MINER_TIMEOUT-5)*time.Second) {
+			return
+		}
+
+		err := conn.Send(xatum.PacketS2C_Ping, map[string]any{})
+		if err != nil {
+			log.Warn(err)
+			conn.Conn.Close()
+			s.Kick(conn.Id)
+			return
+		}
+	}
+}
+
+func (p *Proxy) handleConnPacket(s *server.Server, conn *server.Connection, str string, packetsRecv int) error {
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	spl := strings.SplitN(str, "~", 2)
+	if spl == nil || len(spl) < 2 {
+		log.Warn("packet data is malformed, spl:", spl)
+		conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+			Msg: "malformed packet data",
+			Lvl: 3,
+		})
+		return nil
+	}
+
+	pack := spl[0]
+
+	if packetsRecv == 1 && spl[0] != xatum.PacketC2S_Handshake {
+		err := fmt.Errorf("first packet must be %s, got %s", xatum.PacketC2S_Handshake, spl[0])
+		conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+			Msg: "first packet must be a handshake",
+			Lvl: 3,
+		})
+		s.Kick(conn.Id)
+		return err
+	}
+
+	if pack == xatum.PacketC2S_Handshake {
+		if packetsRecv != 1 {
+			err := fmt.Errorf("client sent more than one handshake")
+			conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: "more than one handshake received",
+				Lvl: 3,
+			})
+			s.Kick(conn.Id)
+			return err
+		}
+
+		pData := xatum.C2S_Handshake{}
+
+		err := json.Unmarshal([]byte(spl[1]), &pData)
+		if err != nil {
+			err = fmt.Errorf("failed to parse data: %v", err)
+			conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: "failed to parse data",
+				Lvl: 3,
+			})
+			s.Kick(conn.Id)
+			return err
+		}
+
+		err = p.checkMinerAddress(pData.Addr)
+		if err != nil {
+			conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: "invalid wallet address " + pData.Addr + ": " + err.Error(),
+				Lvl: 3,
+			})
+			s.Kick(conn.Id)
+			return fmt.Errorf("miner sent wallet address %q: %w", pData.Addr, err)
+		}
+
+		algos := negotiateAlgos(pData.Algos)
+		if len(algos) == 0 {
+			err := fmt.Errorf("miner does not support any of the algorithms %s", xelishash.Algorithms())
+			conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: "your miner does not support any of the algorithms " + strings.Join(xelishash.Algorithms(), ", "),
+				Lvl: 3,
+			})
+			s.Kick(conn.Id)
+			return err
+		}
+
+		minerAgent := agent.Parse(pData.Agent)
+
+		log.Infof("New miner | Address: %s %s UserAgent: %s (%s) Algos: %s", pData.Addr, pData.Work, pData.Agent, minerAgent, pData.Algos)
+		p.stats.AddEvent("info", "Xatum miner %s.%s connected", pData.Addr, pData.Work)
+
+		conn.Wallet = pData.Addr
+		conn.Worker = pData.Work
+		conn.Agent = pData.Agent
+		conn.Algos = algos
+		conn.Quirks = minerAgent.Quirks
+
+		if pData.XnBytes > 0 {
+			slice, err := p.allocXnSlice(conn.Id, pData.XnBytes)
+			if err != nil {
+				conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+					Msg: err.Error(),
+					Lvl: 3,
+				})
+				s.Kick(conn.Id)
+				return err
+			}
+
+			log.Infof("Downstream proxy %s.%s got extra nonce slice %x", pData.Addr, pData.Work, slice)
+			conn.XnSlice = slice
+		}
+
+		// legacy miners don't know the hello packet
+		conn.Version, conn.Caps = xatum.Negotiate(pData.Version, pData.Caps, xatumCaps)
+		if conn.Version > 0 {
+			conn.Send(xatum.PacketS2C_Hello, xatum.S2C_Hello{
+				Version: conn.Version,
+				Caps:    conn.Caps,
+			})
+		}
+
+		if minerAgent.Warning != "" {
+			logAgentWarning(minerAgent, pData.Addr, pData.Work)
+			conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: minerAgent.Warning,
+				Lvl: 2,
+			})
+		}
+
+		if p.Hooks.OnConnect != nil {
+			p.Hooks.OnConnect(xatumConnInfo(conn))
+		}
+
+		// send first job, of the miner's lane
+
+		job := p.laneJob(p.assignLane(xatumConnInfo(conn)))
+
+		if job.Diff == 0 {
+			log.Debug("not sending first job, because there is no first job yet")
+		} else {
+			log.Debugf("first job diff %d blob %x algo %s", job.Diff, job.Blob, job.Algo)
+
+			SendJob(conn, job)
+		}
+	} else if pack == xatum.PacketC2S_Pong {
+		log.Dev("received pong packet")
+	} else if pack == xatum.PacketC2S_Submit {
+
+		pData := xatum.C2S_Submit{}
+
+		err := json.Unmarshal([]byte(spl[1]), &pData)
+		if err != nil {
+			err := fmt.Errorf("failed to parse data")
+			conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: "failed to parse data",
+				Lvl: 3,
+			})
+			s.Kick(conn.Id)
+			return err
+		}
+
+		minerShareId := uint64(0)
+		if conn.Has(xatum.CapShareResult) {
+			minerShareId = pData.Id
+		}
+
+		job, err := findShareJob(conn, pData)
+		if err != nil {
+			log.Warnf("miner %s.%s sent an invalid share: %s", conn.Wallet, conn.Worker, err)
+			conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: "invalid share: " + err.Error(),
+				Lvl: 2,
+			})
+			replyShareResult(conn, minerShareId, err.Error())
+			p.stats.ShareResult(false, err.Error())
+			return nil
+		}
+
+		// the pool's job ID, the share ID is set when submitting to the pool
+		pData.Job = job.Id
+		pData.Id = 0
+
+		// the extra nonce has the slices of all the hops, after the pool's prefix
+		if conn.XnSlice != nil {
+			log.Infof("share from downstream proxy %s.%s with slice %x, extra nonce %x", conn.Wallet, conn.Worker,
+				conn.XnSlice, xelisutil.BlockMiner(pData.Data).GetExtraNonce())
+		}
+
+		conn.LastShare = time.Now()
+		conn.Shares++
+
+		p.stats.ShareSubmitted()
+
+		// send the share to pool
+
+		log.Dev("sending share to the pool")
+		share := Share{
+			Submit: pData,
+			ConnId: conn.Id,
+			Wallet: conn.Wallet,
+			Worker: conn.Worker,
+			Diff:   job.Diff,
+
+			MinerShareId: minerShareId,
+			Upstream:     job.Upstream,
+		}
+		p.submitShare(share)
+
+		if pow, ok := p.xatumBlockHash(share, job); ok {
+			if b, ok := p.checkBlock(share, pow, job.Height, job.NetDiff); ok {
+				conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+					Msg: fmt.Sprintf("you found a block at height %d!", b.Height),
+					Lvl: 1,
+				})
+			}
+		}
+	} else {
+		err := fmt.Errorf("unknown packet %s", pack)
+		conn.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+			Msg: "unknown packet " + pack,
+			Lvl: 3,
+		})
+		s.Kick(conn.Id)
+		return err
+	}
+
+	return nil
+}
+
+// Connection MUST be locked before calling this
+func xatumConnInfo(conn *server.Connection) ConnectionInfo {
+	return ConnectionInfo{
+		Id:       conn.Id,
+		Protocol: "xatum",
+		IP:       util.RemovePort(conn.Conn.RemoteAddr().String()),
+		Wallet:   conn.Wallet,
+		Worker:   conn.Worker,
+		Agent:    conn.Agent,
+	}
+}
+
+// returns the job of the share. The share's extra nonce must be in the slice given to the miner.
+// Connection MUST be locked before calling this
+func findShareJob(conn *server.Connection, share xatum.C2S_Submit) (server.ConnJob, error) {
+	if len(share.Data) != xelisutil.BLOCKMINER_LENGTH {
+		return server.ConnJob{}, errors.New("invalid blob length")
+	}
+	blob := xelisutil.BlockMiner(share.Data)
+
+	for _, j := range []server.ConnJob{conn.CurrentJob, conn.LastJob} {
+		if j.Diff == 0 || (conn.Has(xatum.CapJobId) && share.Job != "" && share.Job != j.Id) {
+			continue
+		}
+		if j.BlockMiner.GetWorkhash() == blob.GetWorkhash() && validExtraNonce(j.BlockMiner, blob, j.XnPrefix) {
+			return j, nil
+		}
+	}
+
+	if conn.Has(xatum.CapJobId) && share.Job != "" && share.Job != conn.CurrentJob.Id && share.Job != conn.LastJob.Id {
+		return server.ConnJob{}, errors.New("unknown job")
+	}
+	return server.ConnJob{}, errors.New("invalid extra nonce")
+}
+
+// sends the result of a share to miners with CapShareResult
+// Connection MUST be locked before calling this
+func replyShareResult(conn *server.Connection, id uint64, msg string) {
+	if !conn.Has(xatum.CapShareResult) {
+		return
+	}
+
+	err := conn.Send(xatum.PacketS2C_Success, xatum.S2C_Success{
+		Msg: msg,
+		Id:  id,
+	})
+	if err != nil {
+		log.Debug("failed to send share result:", err)
+	}
+}
+
+// sends the pool's result of a share to the miner which found it
+func (p *Proxy) sendShareResult(connId uint64, id uint64, msg string) {
+	p.srv.RLock()
+	defer p.srv.RUnlock()
+
+	for _, v := range p.srv.Connections {
+		if v.Id == connId {
+			v.Lock()
+			replyShareResult(v, id, msg)
+			v.Unlock()
+			return
+		}
+	}
+}
+
+// asks the miner to reconnect. Miners without CapReconnect only receive a message, and have to
+// reconnect by themselves after being kicked.
+// Connection MUST be locked before calling this
+func sendReconnect(v *server.Connection, r xatum.S2C_Reconnect) error {
+	if !v.Has(xatum.CapReconnect) {
+		return v.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+			Msg: "the proxy is going into maintenance, please reconnect later",
+			Lvl: 2,
+		})
+	}
+
+	return v.Send(xatum.PacketS2C_Reconnect, r)
+}
+
+// returns the algorithms supported by both the miner and the proxy
+func negotiateAlgos(minerAlgos []string) []string {
+	algos := make([]string, 0, len(minerAlgos))
+	for _, v := range minerAlgos {
+		if _, err := xelishash.Get(v); err == nil && !slices.Contains(algos, v) {
+			algos = append(algos, v)
+		}
+	}
+	return algos
+}
+
+// Sends job to a miner connected to the proxy
+// NOTE: Connection MUST be locked before calling this
+func SendJob(v *server.Connection, job Job) {
+	if !slices.Contains(v.Algos, job.Algo) {
+		log.Warnf("miner with ID %d does not support algorithm %s, not sending job", v.Id, job.Algo)
+		v.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+			Msg: "the pool switched to algorithm " + job.Algo + ", which your miner does not support",
+			Lvl: 3,
+		})
+		return
+	}
+
+	prefix := job.XnPrefix
+	if prefix == 0 {
+		prefix = xatum.DEFAULT_XN_PREFIX
+	}
+
+	blMiner := job.Blob
+
+	// downstream proxies get their own slice of the extra nonce
+	if v.XnSlice != nil {
+		if int(prefix)+len(v.XnSlice) > 32-xatum.MIN_XN_FREE {
+			log.Warnf("proxy with ID %d has an extra nonce slice of %d bytes, but only %d are available", v.Id, len(v.XnSlice), max(32-xatum.MIN_XN_FREE-int(prefix), 0))
+			v.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+				Msg: "the extra nonce slice of this proxy does not fit in the pool's extra nonce",
+				Lvl: 3,
+			})
+			return
+		}
+
+		nonceExtra := blMiner.GetExtraNonce()
+		copy(nonceExtra[prefix:], v.XnSlice)
+		blMiner.SetExtraNonce(nonceExtra)
+
+		prefix += uint8(len(v.XnSlice))
+	}
+
+	// miners which ignore xn_prefix would change the bytes of the extra nonce fixed by the pool
+	if v.Quirks.NoXnPrefix && v.XnSlice == nil && prefix > xatum.DEFAULT_XN_PREFIX {
+		log.Warnf("miner with ID %d ignores xn_prefix, but the pool fixes %d bytes of the extra nonce, not sending job", v.Id, prefix)
+		v.Send(xatum.PacketS2C_Print, xatum.S2C_Print{
+			Msg: "the pool needs a miner which supports xn_prefix, please update your miner",
+			Lvl: 3,
+		})
+		return
+	}
+
+	setRandomExtraNonce(&blMiner, prefix)
+
+	v.LastJob = v.CurrentJob
+
+	// the miner's difficulty is never lower than the pool's, which would reject the shares
+	blockDiff := job.Diff
+	if v.Diff > blockDiff {
+		blockDiff = v.Diff
+	}
+
+	v.CurrentJob = server.ConnJob{
+		Id:              job.Id,
+		Diff:            blockDiff,
+		Algo:            job.Algo,
+		XnPrefix:        prefix,
+		Height:          job.Height,
+		NetDiff:         job.NetDiff,
+		BlockMiner:      blMiner,
+		SubmittedNonces: make([]uint64, 0, 8),
+		Upstream:        job.Upstream,
+	}
+
+	jobId := ""
+	if v.Has(xatum.CapJobId) {
+		jobId = job.Id
+	}
+
+	log.Devf("sending job to miner with ID %d", v.Id)
+	v.SendJob(xatum.S2C_Job{
+		Diff:     blockDiff,
+		Blob:     blMiner[:],
+		Algo:     job.Algo,
+		Height:   job.Height,
+		XnPrefix: prefix,
+		Id:       jobId,
+		NetDiff:  job.NetDiff,
+	})
+}
+
+// changes the difficulty of the miner's current job. Miners without CapDiff get the job again.
+// NOTE: Connection MUST be locked before calling this
+func SendDiff(v *server.Connection, job Job) {
+	if !v.Has(xatum.CapDiff) || v.CurrentJob.Diff == 0 || v.CurrentJob.Id != job.Id {
+		SendJob(v, job)
+		return
+	}
+
+	diff := job.Diff
+	if v.Diff != 0 {
+		diff = v.Diff
+	}
+
+	v.CurrentJob.Diff = diff
+
+	v.Send(xatum.PacketS2C_Diff, xatum.S2C_Diff{
+		Diff: diff,
+		Job:  v.CurrentJob.Id,
+	})
+}
@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"xatum-proxy/config"
+	"xatum-proxy/log"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xatum/client"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+const VERSION = "0.1.8"
+
+// Job is a fast & efficient struct used for storing a job in memory
+type Job struct {
+	Blob   xelisutil.BlockMiner
+	Diff   uint64
+	Target [32]byte
+	Algo   string
+	Height uint64
+	Id     string // job ID of the pool, or generated by the proxy
+
+	XnPrefix uint8 // extra nonce bytes fixed by the pool
+
+	NetDiff uint64 // difficulty of the network, 0 if unknown
+
+	Upstream uint64 // ID of the upstream which sent the job
+}
+
+// Share is a share found by a miner, waiting to be submitted to the pool
+type Share struct {
+	Submit xatum.C2S_Submit
+
+	ConnId uint64
+	Wallet string
+	Worker string
+	Diff   uint64
+
+	MinerShareId uint64 // ID of the share sent by the miner, with CapShareResult
+
+	Upstream uint64 // ID of the upstream which sent the job, the share is submitted to it
+}
+
+// the longest wait accepted in a reconnect request
+const MAX_RECONNECT_WAIT = 10 * time.Minute
+
+// connects to the upstream's pool, and reconnects until the upstream is closed
+func (p *Proxy) runUpstream(up *upstream) {
+	// address the pool redirected us to, only used for the next connection
+	redirectAddr := ""
+
+	for up.ctx.Err() == nil {
+		poolAddr := p.upstreamPool(up)
+		if redirectAddr != "" {
+			poolAddr = redirectAddr
+			redirectAddr = ""
+		}
+
+		log.Info("Starting a new connection to the pool", poolAddr)
+
+		up.mutPendingShares.Lock()
+		up.pendingShares = up.pendingShares[:0]
+		up.mutPendingShares.Unlock()
+
+		cl, err := client.Dial(up.ctx, poolAddr)
+		if err != nil {
+			log.Errf("%v", err)
+			if p.isActive(up) {
+				p.alertUpstreamDown(poolAddr)
+			}
+			sleep(up.ctx, time.Second)
+			continue
+		}
+
+		err = cl.Handshake(xatum.C2S_Handshake{
+			Addr:  up.wallet,
+			Work:  "x",
+			Agent: "XelMiner ALPHA",
+			Algos: xelishash.Algorithms(),
+
+			XnBytes: p.cfg.UpstreamXnBytes,
+		})
+		if err != nil {
+			log.Err(err)
+			cl.Close()
+			sleep(up.ctx, time.Second)
+			continue
+		}
+
+		log.Debug("sent handshake")
+
+		cl.Handlers = client.Handlers{
+			Job: func(job xatum.S2C_Job) {
+				p.handleJob(up, job)
+			},
+			Success: func(res xatum.S2C_Success) {
+				p.handleSuccess(up, res)
+			},
+		}
+
+		p.mutPool.Lock()
+		up.cl = cl
+		active := p.active == up
+		p.mutPool.Unlock()
+
+		if active {
+			p.stats.SetUpstream(true, poolAddr)
+		}
+
+		ctx, cancel := context.WithCancel(up.ctx)
+		go p.recvShares(ctx, up, cl)
+
+		err = cl.Run(ctx)
+		cancel()
+
+		p.mutPool.Lock()
+		up.cl = nil
+		active = p.active == up
+		failedOver := up.failedOver
+		up.failedOver = false
+		p.mutPool.Unlock()
+
+		if active {
+			p.stats.SetUpstream(false, poolAddr)
+		}
+
+		if up.ctx.Err() != nil {
+			return
+		}
+
+		var redirect *client.RedirectError
+		if errors.As(err, &redirect) {
+			redirectAddr = redirect.Address
+			wait := min(time.Duration(redirect.Reconnect.Wait)*time.Second, MAX_RECONNECT_WAIT)
+
+			p.stats.AddEvent("info", "pool redirected the proxy to %s", redirectAddr)
+			log.Infof("reconnecting to %s in %s", redirectAddr, wait)
+
+			sleep(up.ctx, wait)
+			continue
+		}
+
+		// the connection is closed by the proxy to change pool. After a failover it waits like
+		// any reconnection, so pools which all send jobs paying to another wallet aren't hammered.
+		if errors.Is(err, client.ErrClosed) {
+			log.Debug("pool connection closed by the proxy")
+			if failedOver {
+				sleep(up.ctx, time.Second)
+			}
+			continue
+		}
+
+		if active {
+			p.alertUpstreamDown(poolAddr)
+		}
+
+		log.Debug("pool connection closed:", err)
+
+		sleep(up.ctx, time.Second)
+	}
+}
+
+// submits the upstream's shares to the pool until ctx is canceled
+func (p *Proxy) recvShares(ctx context.Context, up *upstream, cl *client.Client) {
+	log.Debug("recvShares started")
+	for {
+		var share Share
+		select {
+		case <-ctx.Done():
+			return
+		case share = <-up.shares:
+		}
+
+		log.Info("share found, submitting to the pool")
+
+		if cl.Closed() {
+			log.Err("pool connection is closed, share lost")
+			return
+		}
+
+		// the share ID is only sent if the pool supports CapShareResult
+		share.Submit.Id = atomic.AddUint64(&p.lastShareId, 1)
+
+		up.mutPendingShares.Lock()
+		up.pendingShares = append(up.pendingShares, share)
+		up.mutPendingShares.Unlock()
+
+		err := cl.Submit(share.Submit)
+		if err != nil {
+			log.Err("failed to submit share to pool:", err)
+			return
+		}
+	}
+}
+
+// queues a valid share to be submitted to the upstream which sent its job. It doesn't block, so
+// miners aren't stalled while the pool is down.
+func (p *Proxy) submitShare(share Share) {
+	if p.Hooks.OnShare != nil {
+		p.Hooks.OnShare(share)
+	}
+
+	up := p.findUpstream(share.Upstream)
+	if up == nil {
+		log.Warn("the upstream of the share's job is closed, share lost")
+		return
+	}
+
+	select {
+	case up.shares <- share:
+	default:
+		log.Err("too many shares waiting for the pool connection, share lost")
+	}
+}
+
+// refuses a job paying to another wallet, and fails over to the next backup pool
+func (p *Proxy) refuseJob(up *upstream, key [32]byte) {
+	pool := p.upstreamPool(up)
+
+	log.Errf("pool %s sent a job paying to public key %x instead of %s, refusing it", pool, key, up.wallet)
+	p.stats.AddEvent("warn", "pool %s sent a job paying to another wallet", pool)
+	p.alertJobKeyMismatch(pool, up.wallet, key)
+
+	p.failover(up)
+}
+
+// switches to the next pool of BackupPools, after the last one it goes back to PoolAddress. Only
+// the upstreams on PoolAddress fail over.
+func (p *Proxy) failover(up *upstream) {
+	p.mutPool.Lock()
+	defer p.mutPool.Unlock()
+
+	if len(p.cfg.BackupPools) == 0 || up.Target.Pool != "" {
+		return
+	}
+
+	p.poolIndex = (p.poolIndex + 1) % (len(p.cfg.BackupPools) + 1)
+
+	// closing the current connection makes runUpstream connect to the next pool
+	if up.cl != nil {
+		up.failedOver = true
+		up.cl.Close()
+	}
+}
+
+// handles the pool's replies to the submitted shares
+func (p *Proxy) handleSuccess(up *upstream, res xatum.S2C_Success) {
+	share, found := up.popPendingShare(res.Id)
+
+	if res.Msg == "ok" {
+		log.Info("share accepted by the pool")
+		p.stats.ShareResult(true, res.Msg)
+
+		if found {
+			p.hashrates.AddShare(share.ConnId, share.Wallet, share.Worker, share.Diff)
+		} else {
+			log.Debug("received a share result, but there are no pending shares")
+		}
+	} else {
+		log.Warn("share rejected by the pool:", res.Msg)
+		p.stats.ShareResult(false, res.Msg)
+	}
+
+	if found {
+		p.sendShareResult(share.ConnId, share.MinerShareId, res.Msg)
+
+		if p.Hooks.OnShareResult != nil {
+			p.Hooks.OnShareResult(share, res.Msg == "ok", res.Msg)
+		}
+	}
+}
+
+// removes the share which the pool replied to from the pending shares. Pools with
+// CapShareResult send the share ID, the others reply in the order the shares were submitted.
+func (up *upstream) popPendingShare(id uint64) (Share, bool) {
+	up.mutPendingShares.Lock()
+	defer up.mutPendingShares.Unlock()
+
+	for i, v := range up.pendingShares {
+		if id == 0 || v.Submit.Id == id {
+			up.pendingShares = append(up.pendingShares[:i], up.pendingShares[i+1:]...)
+			return v, true
+		}
+	}
+	return Share{}, false
+}
+
+// handles the jobs sent by the pool
+func (p *Proxy) handleJob(up *upstream, job xatum.S2C_Job) {
+	if len(job.Blob) != xelisutil.BLOCKMINER_LENGTH {
+		log.Errf("pool sent a job with invalid blob length %d, ignoring it", len(job.Blob))
+		return
+	}
+
+	// a job paying to another key is always alerted, and refused unless VerifyJobKey is disabled,
+	// for pools which mine to their own wallet
+	if key := xelisutil.BlockMiner(job.Blob).GetPublickey(); key != up.walletKey {
+		if p.cfg.VerifyJobKey {
+			p.refuseJob(up, key)
+			return
+		}
+		pool := p.upstreamPool(up)
+		log.Warnf("pool %s sent a job paying to public key %x instead of %s", pool, key, up.wallet)
+		p.alertJobKeyMismatch(pool, up.wallet, key)
+	} else {
+		p.alertJobKeyValid(p.upstreamPool(up))
+	}
+
+	if job.Algo == "" {
+		job.Algo = config.ALGO
+	}
+
+	if _, err := xelishash.Get(job.Algo); err != nil {
+		// the pool switches to the algorithm of a hard fork, even if it wasn't advertised
+		if err := xelishash.Enable(job.Algo); err != nil {
+			log.Errf("pool sent a job with unsupported algorithm %s, ignoring it", job.Algo)
+			return
+		}
+		log.Warnf("pool sent a job with algorithm %s, enabling it. Miners connected before must reconnect to use it", job.Algo)
+	}
+
+	xnPrefix := job.XnPrefix
+	if xnPrefix == 0 {
+		xnPrefix = xatum.DEFAULT_XN_PREFIX
+	}
+	if xnPrefix > 32 {
+		log.Errf("pool sent a job with invalid extra nonce prefix %d, ignoring it", xnPrefix)
+		return
+	}
+
+	// miners with CapJobId need an ID even if the pool doesn't send it
+	jobId := job.Id
+	if jobId == "" {
+		jobId = strconv.FormatUint(atomic.AddUint64(&p.lastJobId, 1), 16)
+	}
+
+	p.mutPool.Lock()
+
+	first := up.job.Diff == 0
+
+	up.job = Job{
+		Blob:   xelisutil.BlockMiner(job.Blob),
+		Diff:   job.Diff,
+		Target: xelisutil.GetTargetBytes(job.Diff),
+		Algo:   job.Algo,
+		Height: p.jobHeight(job.Height),
+		Id:     jobId,
+
+		XnPrefix: xnPrefix,
+
+		NetDiff: p.networkDiff(job.NetDiff),
+
+		Upstream: up.Id,
+	}
+	newJob := up.job
+
+	// the jobs of the other upstreams are kept until they are active again
+	lane := p.upstreamLane(up)
+	if lane == 0 {
+		p.setCurJob(newJob)
+	}
+	p.mutPool.Unlock()
+
+	if lane < 0 {
+		log.Debugf("new job from inactive upstream %d, not sending it", up.Id)
+		return
+	}
+
+	// miners can be moved to the lane now that it has a job
+	if first && len(p.split) > 0 {
+		p.run(p.rebalance)
+	}
+
+	p.broadcastJob(newJob, lane)
+}
+
+// sets the job sent to the miners
+// p.mutPool MUST be locked before calling this
+func (p *Proxy) setCurJob(job Job) {
+	p.mutCurJob.Lock()
+	defer p.mutCurJob.Unlock()
+
+	if p.curJob.Algo != "" && p.curJob.Algo != job.Algo {
+		log.Warnf("pool switched algorithm from %s to %s", p.curJob.Algo, job.Algo)
+	}
+	p.curJob = job
+}
+
+// sends the job of a lane to its miners
+func (p *Proxy) broadcastJob(newJob Job, lane int) {
+	if lane == 0 {
+		p.setLastJobTime()
+		p.alertUpstreamUp(p.PoolAddress())
+
+		log.Infof("new job with difficulty %d, algorithm %s", newJob.Diff, newJob.Algo)
+		p.stats.AddEvent("info", "new job with difficulty %d", newJob.Diff)
+	} else {
+		log.Infof("new job from pool %s with difficulty %d, algorithm %s", p.lanePool(lane), newJob.Diff, newJob.Algo)
+	}
+	log.Debugf("new job: diff %d, blob %x", newJob.Diff, newJob.Blob)
+
+	go func() {
+		p.srv.RLock()
+		defer p.srv.RUnlock()
+
+		for _, v := range p.srv.Connections {
+			if p.minerLane(v.Id) != lane {
+				continue
+			}
+			v.Lock()
+			// miners get their first job after the handshake
+			if len(v.Algos) > 0 {
+				SendJob(v, newJob)
+			}
+			v.Unlock()
+		}
+	}()
+
+	go p.sendJobToWebsocket(newJob, lane)
+
+	if p.Hooks.OnJob != nil {
+		p.Hooks.OnJob(newJob)
+	}
+}
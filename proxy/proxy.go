@@ -0,0 +1,446 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+	"xatum-proxy/alert"
+	"xatum-proxy/hashrate"
+	"xatum-proxy/log"
+	"xatum-proxy/xatum/server"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+
+	"github.com/gorilla/websocket"
+)
+
+// Xatum mining proxy. A Proxy connects to the pool, and serves its jobs to the
+// Xatum and Getwork miners. Many proxies can run in the same process.
+
+// shares waiting to be submitted to the pool. If the pool is down for long, the next shares are lost.
+const SHARES_BUFFER = 64
+
+// ConnectionInfo is a miner connected to the proxy
+type ConnectionInfo struct {
+	Id       uint64
+	Protocol string // "xatum" or "getwork"
+	IP       string
+	Wallet   string
+	Worker   string
+	Agent    string
+}
+
+// Hooks are called when the proxy's events happen. Nil hooks are ignored. They are called from the
+// proxy's goroutines, so they must not block for long.
+type Hooks struct {
+	OnJob         func(job Job)                                // new job from the pool
+	OnShare       func(share Share)                            // valid share, before it's submitted to the pool
+	OnShareResult func(share Share, accepted bool, msg string) // pool's reply to a share
+	OnBlock       func(block BlockCandidate)                   // share which meets the network difficulty
+	OnConnect     func(conn ConnectionInfo)
+	OnDisconnect  func(conn ConnectionInfo)
+}
+
+type Proxy struct {
+	// accessed atomically
+	lastShareId    uint64
+	lastJobId      uint64
+	lastUpstreamId uint64
+	daemonDiff     uint64 // network difficulty from the daemon, 0 if unknown
+	daemonHeight   uint64 // height of the daemon's chain, 0 if unknown
+
+	Hooks Hooks
+
+	cfg    Config
+	wallet xelisutil.Address // decoded WalletAddress
+
+	srv       *server.Server
+	stats     *Stats
+	hashrates *hashrate.Estimator
+	alerter   *alert.Alerter
+	clock     hashrate.Clock
+
+	// the pool connections, and the pool address, which can be changed with the admin API.
+	// The miners get the jobs of the active upstream and of the split's upstreams, the others are
+	// draining.
+	active    *upstream
+	upstreams []*upstream
+	splits    []*upstream // upstreams of the split, splits[i] is for split[i]
+	routed    []*upstream // upstreams of the routes, shared by the routes with the same target
+	poolIndex int         // 0 for PoolAddress, i for BackupPools[i-1]
+	mutPool   sync.RWMutex
+
+	schedule   Schedule
+	split      []SplitRule
+	routes     []RouteRule
+	routeLanes []int // lane of each route, guarded by mutPool
+
+	// lanes of the miners, by connection ID: 0 for the active upstream, i for splits[i-1], then
+	// the lanes of the routes
+	lanes    map[uint64]int
+	mutLanes sync.Mutex
+
+	// the job sent to the miners, the last job of the active upstream
+	curJob    Job
+	mutCurJob sync.RWMutex
+
+	sockets    []*GetworkConn
+	socketsMut sync.RWMutex
+	upgrader   websocket.Upgrader
+
+	httpClients    map[string]*httpClient // Getwork clients of the HTTP JSON-RPC, by IP
+	httpClientsMut sync.Mutex
+
+	// allocated extra nonce slices, by connection ID
+	xnSlices    map[uint64][]byte
+	mutXnSlices sync.Mutex
+
+	trustedProxies []netip.Prefix
+
+	lastJobTime    time.Time
+	mutLastJobTime sync.RWMutex
+
+	auditMut  sync.Mutex
+	blocksMut sync.Mutex // guards the blocks log file
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	startOnce sync.Once
+
+	httpServers []*http.Server
+	mutHttp     sync.Mutex
+}
+
+// New creates a proxy with the given configuration. The proxy doesn't connect to the pool or
+// listen until Start is called.
+func New(cfg Config) (*Proxy, error) {
+	p := &Proxy{
+		cfg:       cfg,
+		srv:       server.NewServer(),
+		stats:     &Stats{},
+		hashrates: hashrate.NewEstimator(nil),
+		alerter: alert.New(alert.Config{
+			Webhooks: cfg.Alerts.Webhooks,
+			Command:  cfg.Alerts.Command,
+			Debounce: time.Duration(cfg.Alerts.DebounceSeconds) * time.Second,
+		}),
+		clock:       hashrate.SystemClock,
+		xnSlices:    make(map[uint64][]byte),
+		lanes:       make(map[uint64]int),
+		httpClients: make(map[string]*httpClient),
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	p.wallet, err = xelisutil.ParseAddress(cfg.WalletAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	p.schedule, err = ParseSchedule(cfg.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	p.split, err = ParseSplit(cfg.Split)
+	if err != nil {
+		return nil, err
+	}
+
+	p.routes, err = ParseRoutes(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range cfg.Algorithms {
+		err = xelishash.Enable(v)
+		if err != nil {
+			return nil, err
+		}
+		if v == xelishash.ALGO_V2 {
+			log.Warnf("algorithm %s is enabled, but isn't verified against the reference implementation yet", v)
+		}
+	}
+
+	if len(cfg.BackupPools) > 0 && !cfg.VerifyJobKey {
+		log.Warn("BackupPools are only used when VerifyJobKey is enabled")
+	}
+
+	err = p.initTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+
+	p.srv.ProxyProtocol = cfg.XatumProxyProtocol
+	p.srv.TrustedProxies = p.trustedProxies
+	p.srv.CertDir = cfg.DataDir
+
+	p.upgrader.CheckOrigin = p.checkGetworkOrigin
+
+	return p, nil
+}
+
+// Start starts listening, and connects to the pool in the background. The proxy runs until ctx is
+// canceled or Stop is called. If a listener fails, Start returns its error and nothing is started.
+func (p *Proxy) Start(ctx context.Context) error {
+	err := errors.New("proxy already started")
+	p.startOnce.Do(func() {
+		err = p.start(ctx)
+	})
+	return err
+}
+
+func (p *Proxy) start(ctx context.Context) error {
+	p.ctx, p.cancel = context.WithCancel(ctx)
+
+	// the upstreams are created before listening, so the first miners already get the lane of
+	// their split or route
+	p.checkSchedule()
+	if len(p.split) > 0 {
+		p.startSplit()
+	}
+	p.startRoutes()
+
+	err := p.srv.Listen(p.xatumListenAddrs())
+	if err != nil {
+		p.abort()
+		return err
+	}
+
+	for _, f := range []func() error{p.listenGetwork, p.listenAdmin, p.listenDashboard} {
+		err = f()
+		if err != nil {
+			p.abort()
+			return err
+		}
+	}
+
+	p.run(p.srv.Serve)
+	p.run(p.waitConnections)
+	p.run(p.statsUpdater)
+	p.run(p.alertsHandler)
+	p.run(p.daemonHandler)
+
+	if len(p.schedule.rules) > 0 {
+		p.run(p.scheduleHandler)
+	}
+	if len(p.split) > 0 {
+		p.run(p.splitHandler)
+	}
+
+	go func() {
+		<-p.ctx.Done()
+		p.close()
+	}()
+
+	return nil
+}
+
+// stops what start has started, when it fails
+func (p *Proxy) abort() {
+	p.cancel()
+	p.close()
+	p.wg.Wait()
+}
+
+// Stop stops the proxy, closing the pool connection and the miners' connections, and waits for its
+// goroutines to return
+func (p *Proxy) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+	p.alerter.Wait()
+}
+
+// runs f in a goroutine which Stop waits for
+func (p *Proxy) run(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+}
+
+// serves an HTTP server in a goroutine which Stop waits for
+func (p *Proxy) serveHttp(s *http.Server, serve func() error) {
+	p.mutHttp.Lock()
+	p.httpServers = append(p.httpServers, s)
+	p.mutHttp.Unlock()
+
+	p.run(func() {
+		err := serve()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Err(err)
+		}
+	})
+}
+
+// closes the listeners and all the connections
+func (p *Proxy) close() {
+	err := p.srv.Close()
+	if err != nil {
+		log.Debug("failed to close the Xatum server:", err)
+	}
+
+	p.mutHttp.Lock()
+	for _, s := range p.httpServers {
+		s.Close()
+	}
+	p.httpServers = nil
+	p.mutHttp.Unlock()
+
+	p.mutPool.Lock()
+	for _, v := range slices.Concat(p.upstreams, p.splits, p.routed) {
+		if v.cl != nil {
+			v.cl.Close()
+		}
+	}
+	p.mutPool.Unlock()
+
+	p.socketsMut.Lock()
+	for _, c := range p.sockets {
+		if c != nil {
+			c.Close()
+		}
+	}
+	p.socketsMut.Unlock()
+}
+
+// Config returns the proxy's configuration
+func (p *Proxy) Config() Config {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+	return p.cfg
+}
+
+// PoolAddress returns the address of the pool in use, which is one of the BackupPools after a
+// failover, or the pool of the schedule
+func (p *Proxy) PoolAddress() string {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+
+	return p.poolAddress(p.active)
+}
+
+// Upstream returns the pool and the wallet in use, with the pool and the wallet of the
+// configuration resolved
+func (p *Proxy) Upstream() Upstream {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+
+	u := Upstream{
+		Pool:   p.poolAddress(p.active),
+		Wallet: p.cfg.WalletAddress,
+	}
+	if p.active != nil {
+		u.Wallet = p.active.wallet
+	}
+	return u
+}
+
+// SetPoolAddress changes the pool address, and reconnects to the new pool
+func (p *Proxy) SetPoolAddress(addr string) {
+	p.mutPool.Lock()
+	defer p.mutPool.Unlock()
+
+	p.cfg.PoolAddress = addr
+	p.poolIndex = 0
+
+	// closing the current connections makes runUpstream reconnect to the new address
+	for _, v := range slices.Concat(p.upstreams, p.splits, p.routed) {
+		if v.Target.Pool == "" && v.cl != nil {
+			err := v.cl.Close()
+			if err != nil {
+				log.Debug("failed to close pool connection:", err)
+			}
+		}
+	}
+}
+
+// CurrentJob returns the last job received from the pool, with zero difficulty if there isn't one
+func (p *Proxy) CurrentJob() Job {
+	p.mutCurJob.RLock()
+	defer p.mutCurJob.RUnlock()
+	return p.curJob
+}
+
+// Connections returns the Xatum and Getwork miners connected to the proxy
+func (p *Proxy) Connections() []AdminConnection {
+	return p.listConnections()
+}
+
+// Hashrate returns the proxy's total hashrate
+func (p *Proxy) Hashrate() hashrate.Rates {
+	return p.hashrates.Total()
+}
+
+// State returns the state shown in the dashboard: upstream, job, shares, hashrate, workers and
+// recent events
+func (p *Proxy) State() DashboardState {
+	return p.dashboardState()
+}
+
+// Kick disconnects the Xatum or Getwork miner with the given id, and returns false if there is no
+// such miner
+func (p *Proxy) Kick(id uint64) bool {
+	found := false
+
+	p.srv.Lock()
+	for _, v := range p.srv.Connections {
+		if v.Id == id {
+			found = true
+		}
+	}
+	if found {
+		p.srv.Kick(id)
+	}
+	p.srv.Unlock()
+
+	if found {
+		return true
+	}
+
+	if c := p.findSocket(id); c != nil {
+		c.Close()
+		return true
+	}
+	return false
+}
+
+// checks a miner's wallet address. Addresses of another network than the proxy's wallet are
+// accepted, since the miners are only identified by them, but they usually are a mistake.
+func (p *Proxy) checkMinerAddress(wallet string) error {
+	addr, err := xelisutil.ParseAddress(wallet)
+	if err != nil {
+		return err
+	}
+
+	if addr.Mainnet != p.wallet.Mainnet {
+		log.Warnf("miner address %s is on %s, but the proxy's wallet is on %s", wallet, addr.Network(), p.wallet.Network())
+	}
+	return nil
+}
+
+// waits for d, and returns false if ctx is canceled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,649 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xatum/server"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+// fakePool is a Xatum pool which accepts the proxies' connections
+type fakePool struct {
+	listener net.Listener
+	conns    chan *fakeConn
+}
+
+type fakeConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+func newFakePool(t *testing.T) *fakePool {
+	// the certificate is written to a temporary directory, like the proxy's CertDir
+	cert, err := server.LoadCertificate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakePool{
+		listener: l,
+		conns:    make(chan *fakeConn, 4),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				err := c.(*tls.Conn).Handshake()
+				if err != nil {
+					c.Close()
+					return
+				}
+				s.conns <- &fakeConn{Conn: c, rdr: bufio.NewReader(c)}
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	return s
+}
+
+func (s *fakePool) accept(t *testing.T) *fakeConn {
+	select {
+	case c := <-s.conns:
+		t.Cleanup(func() {
+			c.Close()
+		})
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the proxy")
+		return nil
+	}
+}
+
+func (c *fakeConn) read(t *testing.T, name string, v any) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		str, err := c.rdr.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spl := strings.SplitN(strings.TrimSpace(str), "~", 2)
+		if len(spl) != 2 {
+			t.Fatalf("malformed packet %q", str)
+		}
+		if spl[0] == xatum.PacketS2C_Ping || spl[0] == xatum.PacketS2C_Hello {
+			continue
+		}
+		if spl[0] != name {
+			t.Fatalf("expected packet %s, got %q", name, str)
+		}
+
+		err = json.Unmarshal([]byte(spl[1]), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+}
+
+func (c *fakeConn) send(t *testing.T, name string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write(append([]byte(name+"~"), append(data, '\n')...))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testnet addresses of the proxy and of the miner
+var (
+	testWallet = xelisutil.Address{PublicKey: [32]byte{1}}.String()
+	testMiner  = xelisutil.Address{PublicKey: [32]byte{2}}.String()
+
+	testWalletKey = [32]byte{1}
+)
+
+// a known miner, which doesn't get a warning at the handshake
+const testAgent = "SRBMiner-MULTI/2.4.5"
+
+func testConfig(t *testing.T, poolAddr string) Config {
+	cfg := DefaultConfig()
+	cfg.WalletAddress = testWallet
+	cfg.PoolAddress = poolAddr
+	cfg.XatumListen = []string{"unix:" + filepath.Join(t.TempDir(), "xatum.sock")}
+	cfg.GetworkListen = []string{"127.0.0.1:0"}
+	cfg.DashboardEnabled = false
+	cfg.DataDir = t.TempDir()
+	return cfg
+}
+
+// returns a job paying to testWallet
+func testJob(diff uint64) xatum.S2C_Job {
+	blob := make([]byte, xelisutil.BLOCKMINER_LENGTH)
+	blob[0] = byte(diff)
+	copy(blob[80:], testWalletKey[:])
+
+	return xatum.S2C_Job{
+		Diff: diff,
+		Blob: blob,
+		Algo: xelishash.ALGO_V1,
+	}
+}
+
+// returns a job paying to the given wallet
+func testJobFor(diff uint64, wallet string) xatum.S2C_Job {
+	job := testJob(diff)
+
+	addr, err := xelisutil.ParseAddress(wallet)
+	if err != nil {
+		panic(err)
+	}
+	copy(job.Blob[80:], addr.PublicKey[:])
+
+	return job
+}
+
+func recv[T any](t *testing.T, c chan T) T {
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+		var v T
+		return v
+	}
+}
+
+// connects a miner to the proxy's Xatum server
+func dialMiner(t *testing.T, cfg Config) *fakeConn {
+	c, err := tls.Dial("unix", strings.TrimPrefix(cfg.XatumListen[0], "unix:"), &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+
+	return &fakeConn{Conn: c, rdr: bufio.NewReader(c)}
+}
+
+func TestTwoProxies(t *testing.T) {
+	pool := newFakePool(t)
+
+	jobs := make(chan Job, 4)
+
+	proxies := make([]*Proxy, 2)
+	for i := range proxies {
+		p, err := New(testConfig(t, pool.listener.Addr().String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Hooks.OnJob = func(job Job) {
+			jobs <- job
+		}
+
+		err = p.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies[i] = p
+
+		conn := pool.accept(t)
+
+		h := xatum.C2S_Handshake{}
+		conn.read(t, xatum.PacketC2S_Handshake, &h)
+		if h.Addr != testWallet {
+			t.Fatalf("expected wallet %s, got %s", testWallet, h.Addr)
+		}
+
+		conn.send(t, xatum.PacketS2C_Job, testJob(uint64(i+1)))
+	}
+
+	got := map[uint64]bool{}
+	for range proxies {
+		got[recv(t, jobs).Diff] = true
+	}
+	if !got[1] || !got[2] {
+		t.Fatalf("expected jobs with difficulty 1 and 2, got %v", got)
+	}
+
+	// each proxy has its own job
+	for i, p := range proxies {
+		if p.CurrentJob().Diff != uint64(i+1) {
+			t.Fatalf("proxy %d has job with difficulty %d", i, p.CurrentJob().Diff)
+		}
+	}
+
+	for _, p := range proxies {
+		p.Stop()
+	}
+}
+
+func TestMinerHooks(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connects := make(chan ConnectionInfo, 1)
+	disconnects := make(chan ConnectionInfo, 1)
+	p.Hooks.OnConnect = func(c ConnectionInfo) {
+		connects <- c
+	}
+	p.Hooks.OnDisconnect = func(c ConnectionInfo) {
+		disconnects <- c
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	poolConn := pool.accept(t)
+	poolConn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(100))
+
+	// wait for the job, so the miner receives it after the handshake
+	deadline := time.Now().Add(5 * time.Second)
+	for p.CurrentJob().Diff == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the job")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	miner := dialMiner(t, cfg)
+
+	miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+		Addr:  testMiner,
+		Work:  "rig1",
+		Agent: testAgent,
+		Algos: []string{xelishash.ALGO_V1},
+	})
+
+	info := recv(t, connects)
+	if info.Protocol != "xatum" || info.Wallet != testMiner || info.Worker != "rig1" || info.Agent != testAgent {
+		t.Fatalf("unexpected connection info %+v", info)
+	}
+
+	job := xatum.S2C_Job{}
+	miner.read(t, xatum.PacketS2C_Job, &job)
+	if job.Diff != 100 {
+		t.Fatalf("expected difficulty 100, got %d", job.Diff)
+	}
+
+	miner.Close()
+
+	info = recv(t, disconnects)
+	if info.Wallet != testMiner {
+		t.Fatalf("unexpected connection info %+v", info)
+	}
+}
+
+func TestInvalidMinerAddress(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connects := make(chan ConnectionInfo, 1)
+	p.Hooks.OnConnect = func(c ConnectionInfo) {
+		connects <- c
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	miner := dialMiner(t, cfg)
+
+	// a typo in the last character
+	typo := []byte(testMiner)
+	typo[len(typo)-1] ^= 1
+
+	miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+		Addr:  string(typo),
+		Work:  "rig1",
+		Algos: []string{xelishash.ALGO_V1},
+	})
+
+	msg := xatum.S2C_Print{}
+	miner.read(t, xatum.PacketS2C_Print, &msg)
+	if !strings.Contains(msg.Msg, "wrong checksum") {
+		t.Fatalf("expected a checksum error, got %q", msg.Msg)
+	}
+
+	select {
+	case info := <-connects:
+		t.Fatalf("miner with an invalid address connected: %+v", info)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKick(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connects := make(chan ConnectionInfo, 1)
+	disconnects := make(chan ConnectionInfo, 1)
+	p.Hooks.OnConnect = func(c ConnectionInfo) {
+		connects <- c
+	}
+	p.Hooks.OnDisconnect = func(c ConnectionInfo) {
+		disconnects <- c
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	miner := dialMiner(t, cfg)
+	miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+		Addr:  testMiner,
+		Work:  "rig1",
+		Agent: testAgent,
+		Algos: []string{xelishash.ALGO_V1},
+	})
+
+	info := recv(t, connects)
+
+	conns := p.Connections()
+	if len(conns) != 1 || conns[0].Id != info.Id {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+
+	if !p.Kick(info.Id) {
+		t.Fatal("the miner wasn't kicked")
+	}
+	if recv(t, disconnects).Id != info.Id {
+		t.Fatal("unexpected disconnection")
+	}
+
+	if p.Kick(info.Id) {
+		t.Fatal("kicked a miner which is already disconnected")
+	}
+	if len(p.Connections()) != 0 {
+		t.Fatalf("unexpected connections %+v", p.Connections())
+	}
+}
+
+func TestVerifyJobKey(t *testing.T) {
+	pool := newFakePool(t)
+	backup := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+	cfg.BackupPools = []string{backup.listener.Addr().String()}
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 4)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// the first pool sends a job paying to the miner instead of the proxy's wallet
+	conn := pool.accept(t)
+	conn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	conn.send(t, xatum.PacketS2C_Job, testJobFor(1, testMiner))
+
+	// the proxy refuses it, and connects to the backup pool
+	conn = backup.accept(t)
+	conn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+
+	if !p.alerter.Active("job_key_mismatch") {
+		t.Fatal("expected the job_key_mismatch alert")
+	}
+	if p.CurrentJob().Diff != 0 {
+		t.Fatal("the job paying to another wallet was accepted")
+	}
+	if p.PoolAddress() != cfg.BackupPools[0] {
+		t.Fatalf("expected pool %s, got %s", cfg.BackupPools[0], p.PoolAddress())
+	}
+
+	conn.send(t, xatum.PacketS2C_Job, testJobFor(2, testWallet))
+
+	job := recv(t, jobs)
+	if job.Diff != 2 {
+		t.Fatalf("expected the job of the backup pool, got difficulty %d", job.Diff)
+	}
+	if p.alerter.Active("job_key_mismatch") {
+		t.Fatal("the job_key_mismatch alert should be resolved")
+	}
+}
+
+func TestFailoverBackoff(t *testing.T) {
+	pool := newFakePool(t)
+	backup := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+	cfg.BackupPools = []string{backup.listener.Addr().String()}
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// every pool sends jobs paying to another wallet, so the proxy keeps failing over
+	connects := 0
+	deadline := time.After(2500 * time.Millisecond)
+	for done := false; !done; {
+		var conn *fakeConn
+		select {
+		case conn = <-pool.conns:
+		case conn = <-backup.conns:
+		case <-deadline:
+			done = true
+			continue
+		}
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		connects++
+
+		conn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+		conn.send(t, xatum.PacketS2C_Job, testJobFor(1, testMiner))
+	}
+
+	// the reconnections wait a second each, instead of looping
+	if connects < 2 || connects > 4 {
+		t.Fatalf("expected 2 to 4 connections in 2.5 seconds, got %d", connects)
+	}
+}
+
+func TestJobKeyAlert(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+	cfg.VerifyJobKey = false
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 4)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// without VerifyJobKey, a job paying to another wallet is accepted, but alerted
+	conn := pool.accept(t)
+	conn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	conn.send(t, xatum.PacketS2C_Job, testJobFor(1, testMiner))
+
+	if job := recv(t, jobs); job.Diff != 1 {
+		t.Fatalf("expected the job, got difficulty %d", job.Diff)
+	}
+	if !p.alerter.Active("job_key_mismatch") {
+		t.Fatal("expected the job_key_mismatch alert")
+	}
+
+	conn.send(t, xatum.PacketS2C_Job, testJob(2))
+	recv(t, jobs)
+	if p.alerter.Active("job_key_mismatch") {
+		t.Fatal("the job_key_mismatch alert should be resolved")
+	}
+}
+
+func TestJobAlgorithm(t *testing.T) {
+	pool := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 4)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	conn := pool.accept(t)
+	conn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+
+	// a job with an unknown algorithm is ignored
+	job := testJob(1)
+	job.Algo = "xel/99"
+	conn.send(t, xatum.PacketS2C_Job, job)
+
+	// the algorithm of a hard fork is enabled when the pool switches to it
+	job = testJob(2)
+	job.Algo = xelishash.ALGO_V2
+	conn.send(t, xatum.PacketS2C_Job, job)
+
+	if job := recv(t, jobs); job.Diff != 2 || job.Algo != xelishash.ALGO_V2 {
+		t.Fatalf("expected the %s job, got %+v", xelishash.ALGO_V2, job)
+	}
+	if _, err := xelishash.Get(xelishash.ALGO_V2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cfg := testConfig(t, "127.0.0.1:1")
+	cfg.GetworkListen = []string{l.Addr().String()}
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Start(context.Background())
+	if err == nil {
+		p.Stop()
+		t.Fatal("expected an error, the Getwork address is in use")
+	}
+}
+
+func TestStopOnCancel(t *testing.T) {
+	pool := newFakePool(t)
+
+	p, err := New(testConfig(t, pool.listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err = p.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.accept(t)
+
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(done)
+	}()
+	recv(t, done)
+
+	err = p.Start(context.Background())
+	if err == nil {
+		t.Fatal("expected an error, the proxy can't be restarted")
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"xatum-proxy/log"
+	"xatum-proxy/proxyproto"
+)
+
+// Routing rules. Each rule of Config.Routes sends the work of the matching miners to its own pool
+// and wallet, so one proxy can serve several customers:
+//
+//	"worker=acme-* acme.pool:5209 xel:..."     workers named acme-..., to another pool and wallet
+//	"ip=10.1.0.0/16 - xel:..."                 miners of a network, to PoolAddress and another wallet
+//	"wallet=xel:... agent=xelis-miner* other.pool:5209"
+//
+// The conditions are wallet, worker, ip and agent, and a miner matches a rule if it matches all
+// its conditions. worker and agent are patterns, where * matches any text and ? any character;
+// agent is case-insensitive. ip is an IP address or a CIDR prefix. The pool "-" is PoolAddress,
+// and the wallet is WalletAddress if it's omitted. The first matching rule is used. Routed miners
+// are bound to their pool, they aren't part of the split.
+
+// RouteRule is a rule of Config.Routes
+type RouteRule struct {
+	Wallet string         // empty matches all the wallets
+	Worker string         // pattern, empty matches all the workers
+	Agent  string         // case-insensitive pattern, empty matches all the agents
+	IP     []netip.Prefix // empty matches all the IPs
+
+	Upstream Upstream
+}
+
+// ParseRoutes parses the rules of Config.Routes, "key=value... pool [wallet]"
+func ParseRoutes(rules []string) ([]RouteRule, error) {
+	res := make([]RouteRule, 0, len(rules))
+
+	for _, v := range rules {
+		fields := strings.Fields(v)
+		rule := RouteRule{}
+
+		n := 0
+		for ; n < len(fields); n++ {
+			key, value, ok := strings.Cut(fields[n], "=")
+			if !ok {
+				break
+			}
+			if value == "" {
+				return nil, fmt.Errorf("rule %q: empty %s", v, key)
+			}
+
+			switch key {
+			case "wallet":
+				rule.Wallet = value
+			case "worker":
+				rule.Worker = value
+			case "agent":
+				rule.Agent = strings.ToLower(value)
+			case "ip":
+				ip, err := proxyproto.ParseTrusted([]string{value})
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: invalid ip %q: %w", v, value, err)
+				}
+				rule.IP = ip
+			default:
+				return nil, fmt.Errorf("rule %q: unknown condition %q, expected wallet, worker, ip or agent", v, key)
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("rule %q: expected a condition", v)
+		}
+
+		up, err := parseUpstream(fields[n:])
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", v, err)
+		}
+		rule.Upstream = up
+
+		res = append(res, rule)
+	}
+
+	return res, nil
+}
+
+// Match returns true if the miner matches all the conditions of the rule
+func (r RouteRule) Match(conn ConnectionInfo) bool {
+	if r.Wallet != "" && r.Wallet != conn.Wallet {
+		return false
+	}
+	if r.Worker != "" && !matchPattern(r.Worker, conn.Worker) {
+		return false
+	}
+	if r.Agent != "" && !matchPattern(r.Agent, strings.ToLower(conn.Agent)) {
+		return false
+	}
+	if len(r.IP) > 0 && !proxyproto.IsTrusted(r.IP, conn.IP) {
+		return false
+	}
+	return true
+}
+
+// returns true if s matches the pattern, where * matches any text and ? any character
+func matchPattern(pattern, s string) bool {
+	p := []rune(pattern)
+	str := []rune(s)
+
+	// position of the last *, and of the text it matches up to, to backtrack
+	star, starStr := -1, 0
+	i, j := 0, 0
+
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, starStr = i, j
+			i++
+		case star >= 0:
+			starStr++
+			i, j = star+1, starStr
+		default:
+			return false
+		}
+	}
+
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// connects to the pools of the routes. Routes with the same pool and wallet share a lane.
+func (p *Proxy) startRoutes() {
+	p.mutPool.Lock()
+	defer p.mutPool.Unlock()
+
+	for _, v := range p.routes {
+		lane := -1
+		for i, up := range p.routed {
+			if up.Target == v.Upstream {
+				lane = p.routeLane(i)
+			}
+		}
+		if lane == -1 {
+			p.routed = append(p.routed, p.newUpstream(v.Upstream))
+			lane = p.routeLane(len(p.routed) - 1)
+		}
+		p.routeLanes = append(p.routeLanes, lane)
+	}
+}
+
+// returns the lane of routed[i]. The routes' lanes are after the lanes of the split.
+func (p *Proxy) routeLane(i int) int {
+	return len(p.split) + 1 + i
+}
+
+// returns the lane of the first route matching the miner, or -1 if there isn't one
+func (p *Proxy) matchRoute(conn ConnectionInfo) int {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+
+	for i, v := range p.routeLanes {
+		if p.routes[i].Match(conn) {
+			log.Debugf("miner %s.%s matches route %d", conn.Wallet, conn.Worker, i)
+			return v
+		}
+	}
+	return -1
+}
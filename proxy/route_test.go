@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"acme-*", "acme-rig1", true},
+		{"acme-*", "acme-", true},
+		{"acme-*", "other-rig1", false},
+		{"*-gpu", "rig1-gpu", true},
+		{"*-gpu", "rig1-cpu", false},
+		{"rig?", "rig1", true},
+		{"rig?", "rig12", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"xelis-miner/*", "xelis-miner/1.2.0", true},
+		{"x*/1.*", "xelis-miner/1.2.0", true},
+		{"x*/2.*", "xelis-miner/1.2.0", false},
+	}
+
+	for _, v := range tests {
+		if matchPattern(v.pattern, v.s) != v.match {
+			t.Fatalf("pattern %q, %q: expected %v", v.pattern, v.s, v.match)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	routes, err := ParseRoutes([]string{
+		"worker=acme-* agent=XELIS-MINER* acme.pool:5209 xet:acme",
+		"ip=10.1.0.0/16 -",
+		"wallet=" + testMiner + " ip=192.168.1.2 other.pool:5209",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if routes[0].Upstream != (Upstream{Pool: "acme.pool:5209", Wallet: "xet:acme"}) || routes[1].Upstream != (Upstream{}) {
+		t.Fatalf("unexpected upstreams %+v %+v", routes[0].Upstream, routes[1].Upstream)
+	}
+
+	tests := []struct {
+		conn  ConnectionInfo
+		match [3]bool
+	}{
+		{ConnectionInfo{Worker: "acme-1", Agent: "xelis-miner/1.0", IP: "1.2.3.4"}, [3]bool{true, false, false}},
+		{ConnectionInfo{Worker: "acme-1", Agent: "other", IP: "1.2.3.4"}, [3]bool{false, false, false}},
+		{ConnectionInfo{Worker: "rig1", IP: "10.1.200.3"}, [3]bool{false, true, false}},
+		{ConnectionInfo{Worker: "rig1", IP: "10.2.0.1"}, [3]bool{false, false, false}},
+		{ConnectionInfo{Wallet: testMiner, IP: "192.168.1.2"}, [3]bool{false, false, true}},
+		{ConnectionInfo{Wallet: testMiner, IP: "192.168.1.3"}, [3]bool{false, false, false}},
+		{ConnectionInfo{Wallet: testWallet, IP: "192.168.1.2"}, [3]bool{false, false, false}},
+	}
+
+	for _, v := range tests {
+		for i, r := range routes {
+			if r.Match(v.conn) != v.match[i] {
+				t.Fatalf("%+v, route %d: expected %v", v.conn, i, v.match[i])
+			}
+		}
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	for exp, rules := range map[string][]string{
+		"expected a condition":         {"acme.pool:5209"},
+		"unknown condition \"name\"":   {"name=acme acme.pool:5209"},
+		"empty worker":                 {"worker= acme.pool:5209"},
+		"invalid ip \"10.0.0.0/33\"":   {"ip=10.0.0.0/33 acme.pool:5209"},
+		"expected a pool":              {"worker=acme-*"},
+		"optionally a wallet":          {"worker=acme-* acme.pool:5209 xet:acme extra"},
+		`rule "ip=nope -": invalid ip`: {"ip=nope -"},
+	} {
+		_, err := ParseRoutes(rules)
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Fatalf("%q: expected an error containing %q, got %v", rules, exp, err)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	pool := newFakePool(t)
+	acme := newFakePool(t)
+
+	acmeWallet := xelisutil.Address{PublicKey: [32]byte{4}}.String()
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+	cfg.Routes = []string{
+		"worker=acme-* " + acme.listener.Addr().String() + " " + acmeWallet,
+		"agent=lolminer* " + acme.listener.Addr().String() + " " + acmeWallet,
+		"ip=10.0.0.9 " + acme.listener.Addr().String() + " " + acmeWallet,
+	}
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 4)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// the routes with the same pool and wallet share a connection, with the route's wallet
+	poolConn := pool.accept(t)
+	acmeConn := acme.accept(t)
+
+	h := xatum.C2S_Handshake{}
+	acmeConn.read(t, xatum.PacketC2S_Handshake, &h)
+	if h.Addr != acmeWallet {
+		t.Fatalf("expected wallet %s, got %s", acmeWallet, h.Addr)
+	}
+	poolConn.read(t, xatum.PacketC2S_Handshake, &h)
+	if h.Addr != testWallet {
+		t.Fatalf("expected wallet %s, got %s", testWallet, h.Addr)
+	}
+
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(100))
+	acmeConn.send(t, xatum.PacketS2C_Job, testJobFor(200, acmeWallet))
+	recv(t, jobs)
+	recv(t, jobs)
+
+	select {
+	case <-acme.conns:
+		t.Fatal("unexpected second connection to the route's pool")
+	default:
+	}
+
+	dial := func(worker, agent string) (*fakeConn, xatum.S2C_Job) {
+		miner := dialMiner(t, cfg)
+		miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+			Addr:  testMiner,
+			Work:  worker,
+			Agent: agent,
+			Algos: []string{xelishash.ALGO_V1},
+		})
+
+		job := xatum.S2C_Job{}
+		miner.read(t, xatum.PacketS2C_Job, &job)
+		return miner, job
+	}
+
+	rig, rigJob := dial("rig1", "xelis-miner/1.0")
+	acme1, acme1Job := dial("acme-1", "xelis-miner/1.0")
+	acme2, acme2Job := dial("rig2", "lolMiner 1.82")
+
+	if rigJob.Diff != 100 {
+		t.Fatalf("expected the job of the pool, got difficulty %d", rigJob.Diff)
+	}
+	if acme1Job.Diff != 200 || acme2Job.Diff != 200 {
+		t.Fatalf("expected the jobs of the route's pool, got difficulties %d and %d", acme1Job.Diff, acme2Job.Diff)
+	}
+
+	// the routed miners only get the jobs of their pool
+	acmeJob := testJobFor(201, acmeWallet)
+	acmeJob.Height = 7
+	acmeConn.send(t, xatum.PacketS2C_Job, acmeJob)
+	acme1.read(t, xatum.PacketS2C_Job, &acme1Job)
+	acme2.read(t, xatum.PacketS2C_Job, &acme2Job)
+	if acme1Job.Diff != 201 || acme2Job.Diff != 201 {
+		t.Fatalf("expected the new job of the route's pool, got difficulties %d and %d", acme1Job.Diff, acme2Job.Diff)
+	}
+
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(101))
+	rig.read(t, xatum.PacketS2C_Job, &rigJob)
+	if rigJob.Diff != 101 {
+		t.Fatalf("expected the new job of the pool, got difficulty %d", rigJob.Diff)
+	}
+
+	// and their shares go there
+	acme1.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: acme1Job.Blob})
+	if s := readSubmit(t, acmeConn); string(s.Data) != string(acme1Job.Blob) {
+		t.Fatal("unexpected share submitted to the route's pool")
+	}
+	rig.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: rigJob.Blob})
+	if s := readSubmit(t, poolConn); string(s.Data) != string(rigJob.Blob) {
+		t.Fatal("unexpected share submitted to the pool")
+	}
+
+	pools := map[string]int{}
+	for _, v := range p.Connections() {
+		pools[v.Pool]++
+	}
+	if pools[cfg.PoolAddress] != 1 || pools[acme.listener.Addr().String()] != 2 {
+		t.Fatalf("unexpected pools of the miners %v", pools)
+	}
+
+	// the HTTP clients of the Getwork RPC are routed too, and get the height of their job
+	c := p.httpClient("10.0.0.9")
+	if c.CurrentJob.Diff != 201 {
+		t.Fatalf("expected the job of the route's pool, got difficulty %d", c.CurrentJob.Diff)
+	}
+	if res := p.handleRpcRequest(RpcRequest{JsonRpc: "2.0", Method: "get_height"}, c); res.Result != uint64(7) {
+		t.Fatalf("expected the height of the route's job, got %v", res.Result)
+	}
+	if c := p.httpClient("10.0.0.8"); c.CurrentJob.Diff != 101 {
+		t.Fatalf("expected the job of the pool, got difficulty %d", c.CurrentJob.Diff)
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upstream scheduler. Each rule of Config.Schedule sends the miners' work to a pool and a wallet
+// for some time, which is either a percentage of each hour, or the minutes matched by a cron
+// expression:
+//
+//	"5% - xel:..."                     5% of each hour (3 minutes) to another wallet on PoolAddress
+//	"* 22-23,0-5 * * * night.pool:5209" from 22:00 to 6:00 on another pool, to WalletAddress
+//
+// The pool "-" is PoolAddress, and the wallet is WalletAddress if it's omitted. Cron rules are
+// checked first, in order, then the percentages are laid out from the start of the hour, in
+// order. The rest of the time goes to PoolAddress and WalletAddress.
+
+// the period of the percentage rules
+const SCHEDULE_PERIOD = time.Hour
+
+// Upstream is a pool and the wallet mined to. The zero value is PoolAddress and WalletAddress.
+type Upstream struct {
+	Pool   string // empty for PoolAddress, or one of BackupPools after a failover
+	Wallet string // empty for WalletAddress
+}
+
+type scheduleRule struct {
+	cron     *cronExpr // nil for percentage rules
+	percent  float64
+	upstream Upstream
+}
+
+// Schedule selects the upstream at a given time
+type Schedule struct {
+	rules []scheduleRule
+}
+
+// ParseSchedule parses the rules of Config.Schedule
+func ParseSchedule(rules []string) (Schedule, error) {
+	s := Schedule{}
+	total := 0.0
+
+	for _, v := range rules {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			return Schedule{}, errors.New("empty schedule rule")
+		}
+
+		rule := scheduleRule{}
+		var target []string
+
+		if strings.HasSuffix(fields[0], "%") {
+			n, err := parsePercent(fields[0])
+			if err != nil {
+				return Schedule{}, fmt.Errorf("rule %q: %w", v, err)
+			}
+			rule.percent = n
+			total += n
+			target = fields[1:]
+		} else {
+			if len(fields) < 5 {
+				return Schedule{}, fmt.Errorf("rule %q: expected a percentage or a cron expression", v)
+			}
+			cron, err := parseCron(fields[:5])
+			if err != nil {
+				return Schedule{}, fmt.Errorf("rule %q: %w", v, err)
+			}
+			rule.cron = cron
+			target = fields[5:]
+		}
+
+		up, err := parseUpstream(target)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("rule %q: %w", v, err)
+		}
+		rule.upstream = up
+
+		s.rules = append(s.rules, rule)
+	}
+
+	if total > 100 {
+		return Schedule{}, fmt.Errorf("the percentages add up to %g%%, more than 100%%", total)
+	}
+
+	return s, nil
+}
+
+// parses a percentage like "5%" or "2.5%"
+func parsePercent(f string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(f, "%"), 64)
+	if err != nil || n <= 0 || n > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", f)
+	}
+	return n, nil
+}
+
+// parses the pool, "-" for PoolAddress, and the optional wallet of a rule
+func parseUpstream(fields []string) (Upstream, error) {
+	if len(fields) == 0 || len(fields) > 2 {
+		return Upstream{}, errors.New("expected a pool and optionally a wallet")
+	}
+
+	up := Upstream{}
+	if fields[0] != "-" {
+		up.Pool = fields[0]
+	}
+	if len(fields) == 2 {
+		up.Wallet = fields[1]
+	}
+	return up, nil
+}
+
+// Upstreams returns the upstreams of the rules
+func (s Schedule) Upstreams() []Upstream {
+	res := make([]Upstream, 0, len(s.rules))
+	for _, v := range s.rules {
+		res = append(res, v.upstream)
+	}
+	return res
+}
+
+// At returns the upstream to use at the time t. Cron expressions are matched in the location of t.
+func (s Schedule) At(t time.Time) Upstream {
+	for _, v := range s.rules {
+		if v.cron != nil && v.cron.match(t) {
+			return v.upstream
+		}
+	}
+
+	elapsed := t.Sub(t.Truncate(SCHEDULE_PERIOD))
+	start := time.Duration(0)
+	for _, v := range s.rules {
+		if v.cron != nil {
+			continue
+		}
+		end := start + time.Duration(v.percent/100*float64(SCHEDULE_PERIOD))
+		if elapsed >= start && elapsed < end {
+			return v.upstream
+		}
+		start = end
+	}
+
+	return Upstream{}
+}
+
+// cronExpr is the minute, hour, day of month, month and day of week fields of a cron expression,
+// as bitsets
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+
+	// the day matches either dom or dow if both are restricted, like in cron
+	domStar, dowStar bool
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(fields []string) (*cronExpr, error) {
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronRanges[i][0], cronRanges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron field %q: %w", f, err)
+		}
+		sets[i] = set
+	}
+
+	// 7 is also sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronExpr{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parses a field like "*", "*/15", "1-5", "22-23,0-5" or "0-30/10". Ranges can't wrap around.
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+
+			var err error
+			lo, err = strconv.Atoi(loStr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				hi, err = strconv.Atoi(hiStr)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%s is out of range %d-%d", rng, min, max)
+			}
+		}
+
+		for i := lo; i <= hi; i += step {
+			set |= 1 << i
+		}
+	}
+
+	return set, nil
+}
+
+func (c *cronExpr) match(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+	"xatum-proxy/xelisutil"
+)
+
+type fakeClock struct {
+	t   time.Time
+	mut sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.t = t
+}
+
+func at(hour, min, sec int) time.Time {
+	// 2024-01-01 is a monday
+	return time.Date(2024, 1, 1, hour, min, sec, 0, time.UTC)
+}
+
+func TestScheduleAt(t *testing.T) {
+	s, err := ParseSchedule([]string{
+		"* 22-23,0-5 * * * night.pool:5209",
+		"0-9 12 * * 0,6 weekend.pool:5209",
+		"5% - xet:fee",
+		"2.5% other.pool:5209 xet:other",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	night := Upstream{Pool: "night.pool:5209"}
+	weekend := Upstream{Pool: "weekend.pool:5209"}
+	fee := Upstream{Wallet: "xet:fee"}
+	other := Upstream{Pool: "other.pool:5209", Wallet: "xet:other"}
+
+	tests := []struct {
+		t   time.Time
+		exp Upstream
+	}{
+		{at(22, 0, 0), night},
+		{at(3, 30, 0), night},
+		{at(5, 59, 59), night},
+		{at(6, 0, 0), fee},
+		{at(6, 2, 59), fee},
+		{at(6, 3, 0), other},
+		{at(6, 4, 29), other},
+		{at(6, 4, 30), Upstream{}},
+		{at(21, 59, 0), Upstream{}},
+		{at(12, 1, 0), fee},                      // monday
+		{at(12, 5, 0).AddDate(0, 0, 5), weekend}, // saturday
+		{at(12, 5, 0).AddDate(0, 0, 6), weekend}, // sunday
+		{at(12, 10, 0).AddDate(0, 0, 6), Upstream{}},
+	}
+
+	for _, v := range tests {
+		if u := s.At(v.t); u != v.exp {
+			t.Fatalf("%s: expected %+v, got %+v", v.t, v.exp, u)
+		}
+	}
+
+	if u := (Schedule{}).At(at(12, 0, 0)); u != (Upstream{}) {
+		t.Fatalf("empty schedule: got %+v", u)
+	}
+}
+
+func TestCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		t     time.Time
+		match bool
+	}{
+		{"*/15 * * * *", at(10, 45, 0), true},
+		{"*/15 * * * *", at(10, 46, 0), false},
+		{"10-30/10 * * * *", at(10, 20, 0), true},
+		{"10-30/10 * * * *", at(10, 25, 0), false},
+		{"5/20 * * * *", at(10, 45, 0), true},
+		{"* * 1 1 *", at(10, 0, 0), true},
+		{"* * * 2 *", at(10, 0, 0), false},
+		{"* * * * 7", at(10, 0, 0).AddDate(0, 0, 6), true}, // sunday
+		// both the day of month and the day of week are restricted: either matches
+		{"* * 15 * 1", at(10, 0, 0), true},
+		{"* * 1 * 5", at(10, 0, 0), true},
+		{"* * 2 * 5", at(10, 0, 0), false},
+	}
+
+	for _, v := range tests {
+		c, err := parseCron(strings.Fields(v.expr))
+		if err != nil {
+			t.Fatalf("%s: %v", v.expr, err)
+		}
+		if c.match(v.t) != v.match {
+			t.Fatalf("%s at %s: expected %v", v.expr, v.t, v.match)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := map[string][]string{
+		"invalid percentage":       {"0% pool:1"},
+		"more than 100%":           {"60% pool:1", "50% - xet:a"},
+		"expected a percentage":    {"* * pool:1"},
+		"out of range":             {"60 * * * * pool:1"},
+		"invalid step":             {"*/0 * * * * pool:1"},
+		"expected a pool":          {"10%"},
+		"optionally a wallet":      {"10% pool:1 xet:a extra"},
+		"empty schedule rule":      {" "},
+		`invalid value "a"`:        {"a * * * * pool:1"},
+		"23-1 is out of range":     {"* 23-1 * * * pool:1"},
+		"0-7":                      {"* * * * 8 pool:1"},
+		"rule \"5 4 3 2\": expect": {"5 4 3 2"},
+	}
+
+	for exp, rules := range tests {
+		_, err := ParseSchedule(rules)
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Fatalf("%q: expected an error containing %q, got %v", rules, exp, err)
+		}
+	}
+}
+
+// reads the next packet from the proxy's pool connection, skipping the pings
+func readSubmit(t *testing.T, c *fakeConn) xatum.C2S_Submit {
+	s := xatum.C2S_Submit{}
+	c.read(t, xatum.PacketC2S_Submit, &s)
+	return s
+}
+
+// waits for the proxy to close the pool connection
+func waitClosed(t *testing.T, c *fakeConn) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, err := c.rdr.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			t.Fatal("the connection wasn't closed:", err)
+		}
+	}
+}
+
+func TestScheduleSwitch(t *testing.T) {
+	pool := newFakePool(t)
+	night := newFakePool(t)
+
+	nightWallet := xelisutil.Address{PublicKey: [32]byte{3}}.String()
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+	cfg.Schedule = []string{"50% " + night.listener.Addr().String() + " " + nightWallet}
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{t: at(10, 0, 0)}
+	p.clock = clock
+
+	jobs := make(chan Job, 4)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// the first half of the hour goes to the night pool, with its wallet
+	nightConn := night.accept(t)
+	h := xatum.C2S_Handshake{}
+	nightConn.read(t, xatum.PacketC2S_Handshake, &h)
+	if h.Addr != nightWallet {
+		t.Fatalf("expected wallet %s, got %s", nightWallet, h.Addr)
+	}
+	nightConn.send(t, xatum.PacketS2C_Job, testJobFor(100, nightWallet))
+	recv(t, jobs)
+
+	miner := dialMiner(t, cfg)
+	miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+		Addr:  testMiner,
+		Work:  "rig1",
+		Agent: testAgent,
+		Algos: []string{xelishash.ALGO_V1},
+	})
+
+	jobA := xatum.S2C_Job{}
+	miner.read(t, xatum.PacketS2C_Job, &jobA)
+	if jobA.Diff != 100 {
+		t.Fatalf("expected the job of the night pool, got difficulty %d", jobA.Diff)
+	}
+
+	// the second half goes to PoolAddress. The miner gets its job without reconnecting.
+	clock.Set(at(10, 40, 0))
+	p.checkSchedule()
+
+	poolConn := pool.accept(t)
+	poolConn.read(t, xatum.PacketC2S_Handshake, &h)
+	if h.Addr != testWallet {
+		t.Fatalf("expected wallet %s, got %s", testWallet, h.Addr)
+	}
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(200))
+
+	jobB := xatum.S2C_Job{}
+	miner.read(t, xatum.PacketS2C_Job, &jobB)
+	if jobB.Diff != 200 {
+		t.Fatalf("expected the job of the pool, got difficulty %d", jobB.Diff)
+	}
+	if u := p.Upstream(); u.Pool != cfg.PoolAddress || u.Wallet != testWallet {
+		t.Fatalf("unexpected upstream %+v", u)
+	}
+
+	// the shares go to the pool which sent their job
+	miner.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: jobA.Blob})
+	if s := readSubmit(t, nightConn); string(s.Data) != string(jobA.Blob) {
+		t.Fatal("unexpected share submitted to the night pool")
+	}
+	miner.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: jobB.Blob})
+	if s := readSubmit(t, poolConn); string(s.Data) != string(jobB.Blob) {
+		t.Fatal("unexpected share submitted to the pool")
+	}
+
+	// switching back while the night pool is draining reuses its connection and its last job
+	clock.Set(at(10, 1, 0))
+	p.checkSchedule()
+
+	job := xatum.S2C_Job{}
+	miner.read(t, xatum.PacketS2C_Job, &job)
+	if job.Diff != 100 {
+		t.Fatalf("expected the last job of the night pool, got difficulty %d", job.Diff)
+	}
+
+	clock.Set(at(10, 40, 0))
+	p.checkSchedule()
+	miner.read(t, xatum.PacketS2C_Job, &job)
+	if job.Diff != 200 {
+		t.Fatalf("expected the last job of the pool, got difficulty %d", job.Diff)
+	}
+
+	select {
+	case <-night.conns:
+		t.Fatal("the proxy reconnected to the night pool")
+	default:
+	}
+
+	// the night pool is closed when its jobs expired
+	clock.Set(at(10, 40, 0).Add(UPSTREAM_DRAIN_TIME))
+	p.checkSchedule()
+	waitClosed(t, nightConn)
+
+	if p.findUpstream(1) != nil || p.findUpstream(2) == nil {
+		t.Fatal("expected only the upstream of the pool")
+	}
+
+	// the shares of its jobs are lost, the miner isn't disconnected
+	miner.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: jobA.Blob})
+	miner.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: jobB.Blob})
+	if s := readSubmit(t, poolConn); string(s.Data) != string(jobB.Blob) {
+		t.Fatal("unexpected share submitted to the pool")
+	}
+}
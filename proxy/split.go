@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"xatum-proxy/log"
+)
+
+// Hashrate splitting. Each rule of Config.Split connects to another pool at the same time as the
+// pool of the schedule, and gets a share of the miners' hashrate:
+//
+//	"30% other.pool:5209" 30% of the hashrate to another pool, mining to WalletAddress
+//	"10% - xel:..."       10% to PoolAddress, mining to another wallet
+//
+// Each miner is bound to a lane when it connects: lane 0 is the upstream of the schedule, which
+// gets the rest of the hashrate, and lane i is the upstream of the i-th rule. The miners only get
+// the jobs of their lane. Every SPLIT_REBALANCE_INTERVAL, miners are moved to another lane if the
+// hashrate of the lanes drifted from their weights: they get the job of their new lane, and their
+// shares of the previous jobs still go to the previous pool. Lanes whose pool is down get no miners.
+
+// how often the miners are rebalanced between the lanes
+const SPLIT_REBALANCE_INTERVAL = 30 * time.Second
+
+// the lanes are rebalanced when the hashrate of a lane is above its share by more than this
+// fraction of the total hashrate
+const SPLIT_TOLERANCE = 0.05
+
+// SplitRule is a rule of Config.Split
+type SplitRule struct {
+	Percent  float64
+	Upstream Upstream
+}
+
+// ParseSplit parses the rules of Config.Split, "N% pool [wallet]". The pool "-" is PoolAddress,
+// and the wallet is WalletAddress if it's omitted.
+func ParseSplit(rules []string) ([]SplitRule, error) {
+	res := make([]SplitRule, 0, len(rules))
+	total := 0.0
+
+	for _, v := range rules {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			return nil, errors.New("empty split rule")
+		}
+		if !strings.HasSuffix(fields[0], "%") {
+			return nil, fmt.Errorf("rule %q: expected a percentage", v)
+		}
+
+		n, err := parsePercent(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", v, err)
+		}
+		up, err := parseUpstream(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", v, err)
+		}
+
+		total += n
+		res = append(res, SplitRule{
+			Percent:  n,
+			Upstream: up,
+		})
+	}
+
+	if total > 100 {
+		return nil, fmt.Errorf("the percentages add up to %g%%, more than 100%%", total)
+	}
+
+	return res, nil
+}
+
+// a miner and its estimated hashrate
+type laneMiner struct {
+	id   uint64
+	lane int
+	load float64
+}
+
+// returns the hashrate of each lane
+func laneLoads(n int, miners []laneMiner) []float64 {
+	loads := make([]float64, n)
+	for _, v := range miners {
+		loads[v.lane] += v.load
+	}
+	return loads
+}
+
+// returns the lane where a miner with the given hashrate keeps the lanes closest to their weights,
+// or 0 if no lane has a weight
+func pickLane(weights, loads []float64, load float64) int {
+	best, bestRatio := 0, math.Inf(1)
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		if r := (loads[i] + load) / w; r < bestRatio {
+			best, bestRatio = i, r
+		}
+	}
+	return best
+}
+
+// returns the new lane of the miners to move, so the hashrate of the lanes is proportional to
+// their weights. The miners of lanes without weight are all moved, then miners are moved from the
+// lane with the most excess hashrate to the lane which lacks the most, while it brings the lanes
+// closer to their weights.
+func balanceLanes(weights []float64, miners []laneMiner) map[uint64]int {
+	moves := make(map[uint64]int)
+
+	wsum := 0.0
+	for _, v := range weights {
+		wsum += max(v, 0)
+	}
+	if wsum == 0 || len(miners) == 0 {
+		return moves
+	}
+
+	miners = slices.Clone(miners)
+	loads := laneLoads(len(weights), miners)
+	total := 0.0
+	for _, v := range loads {
+		total += v
+	}
+
+	move := func(i, lane int) {
+		loads[miners[i].lane] -= miners[i].load
+		loads[lane] += miners[i].load
+		miners[i].lane = lane
+	}
+
+	orig := make([]int, len(miners))
+	for i, m := range miners {
+		orig[i] = m.lane
+		if weights[m.lane] <= 0 {
+			move(i, pickLane(weights, loads, m.load))
+		}
+	}
+
+	excess := func(lane int) float64 {
+		return loads[lane] - weights[lane]/wsum*total
+	}
+
+	// each move reduces the total gap between the lanes and their shares, so this terminates
+	for range miners {
+		over, under := -1, -1
+		for i, w := range weights {
+			if w <= 0 {
+				continue
+			}
+			if over == -1 || excess(i) > excess(over) {
+				over = i
+			}
+			if under == -1 || excess(i) < excess(under) {
+				under = i
+			}
+		}
+
+		o, u := excess(over), -excess(under)
+		if o <= SPLIT_TOLERANCE*total {
+			break
+		}
+
+		// moving a miner reduces the gap if its hashrate is below o+u. The miner closest to the
+		// smallest gap reduces it the most.
+		gap := min(o, u)
+		pick := -1
+		for i, m := range miners {
+			if m.lane != over || m.load >= o+u {
+				continue
+			}
+			if pick == -1 || math.Abs(m.load-gap) < math.Abs(miners[pick].load-gap) {
+				pick = i
+			}
+		}
+		if pick == -1 {
+			break
+		}
+		move(pick, under)
+	}
+
+	for i, m := range miners {
+		if m.lane != orig[i] {
+			moves[m.id] = m.lane
+		}
+	}
+	return moves
+}
+
+// connects to the pools of the split
+func (p *Proxy) startSplit() {
+	p.mutPool.Lock()
+	defer p.mutPool.Unlock()
+
+	for _, v := range p.split {
+		p.splits = append(p.splits, p.newUpstream(v.Upstream))
+	}
+}
+
+// returns the lane of the upstream, or -1 if the miners don't get its jobs
+// p.mutPool MUST be locked before calling this
+func (p *Proxy) upstreamLane(up *upstream) int {
+	if up == p.active {
+		return 0
+	}
+	for i, v := range p.splits {
+		if v == up {
+			return i + 1
+		}
+	}
+	for i, v := range p.routed {
+		if v == up {
+			return p.routeLane(i)
+		}
+	}
+	return -1
+}
+
+// returns the upstream of the lane, nil if there isn't one
+// p.mutPool MUST be locked before calling this
+func (p *Proxy) laneUpstream(lane int) *upstream {
+	switch {
+	case lane == 0:
+		return p.active
+	case lane <= len(p.splits):
+		return p.splits[lane-1]
+	case lane > len(p.split) && lane-len(p.split)-1 < len(p.routed):
+		return p.routed[lane-len(p.split)-1]
+	}
+	return nil
+}
+
+// returns the job of the lane, with zero difficulty if there isn't one
+func (p *Proxy) laneJob(lane int) Job {
+	if lane == 0 {
+		return p.CurrentJob()
+	}
+
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+
+	up := p.laneUpstream(lane)
+	if up == nil {
+		return Job{}
+	}
+	return up.job
+}
+
+// returns the pool address of the lane
+func (p *Proxy) lanePool(lane int) string {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+
+	return p.poolAddress(p.laneUpstream(lane))
+}
+
+// returns the weights of the lanes. The lanes whose pool is down, or didn't send a job yet, have
+// no weight.
+func (p *Proxy) laneWeights() []float64 {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+
+	ready := func(up *upstream) bool {
+		return up != nil && up.cl != nil && up.job.Diff != 0
+	}
+
+	weights := make([]float64, len(p.splits)+1)
+	rest := 100.0
+	for i, v := range p.splits {
+		rest -= p.split[i].Percent
+		if ready(v) {
+			weights[i+1] = p.split[i].Percent
+		}
+	}
+	if ready(p.active) {
+		weights[0] = max(rest, 0)
+	}
+
+	return weights
+}
+
+// returns the miners of the split with their lane and their hashrate. Miners without shares yet
+// count as the average miner. Routed miners aren't part of the split.
+// p.mutLanes MUST be locked before calling this
+func (p *Proxy) laneMiners() []laneMiner {
+	miners := make([]laneMiner, 0, len(p.lanes))
+	known, sum := 0, 0.0
+
+	for id, lane := range p.lanes {
+		if lane > len(p.split) {
+			continue
+		}
+		h := p.hashrates.Connection(id).M5
+		if h > 0 {
+			known++
+			sum += h
+		}
+		miners = append(miners, laneMiner{
+			id:   id,
+			lane: lane,
+			load: h,
+		})
+	}
+
+	avg := 1.0
+	if known > 0 {
+		avg = sum / float64(known)
+	}
+	for i := range miners {
+		if miners[i].load == 0 {
+			miners[i].load = avg
+		}
+	}
+
+	// sorted, so the miners are moved in a deterministic order
+	slices.SortFunc(miners, func(a, b laneMiner) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return miners
+}
+
+// binds a new miner to the lane of its route, or to a lane of the split, and returns it
+func (p *Proxy) assignLane(conn ConnectionInfo) int {
+	connId := conn.Id
+
+	if lane := p.matchRoute(conn); lane >= 0 {
+		p.mutLanes.Lock()
+		p.lanes[connId] = lane
+		p.mutLanes.Unlock()
+
+		log.Infof("miner %s.%s is routed to pool %s", conn.Wallet, conn.Worker, p.lanePool(lane))
+		return lane
+	}
+
+	if len(p.split) == 0 {
+		return 0
+	}
+
+	weights := p.laneWeights()
+
+	p.mutLanes.Lock()
+	defer p.mutLanes.Unlock()
+
+	miners := p.laneMiners()
+	load := 1.0
+	if len(miners) > 0 {
+		load = 0
+		for _, v := range miners {
+			load += v.load
+		}
+		load /= float64(len(miners))
+	}
+
+	lane := pickLane(weights, laneLoads(len(weights), miners), load)
+	p.lanes[connId] = lane
+
+	log.Debugf("miner with ID %d is in lane %d", connId, lane)
+	return lane
+}
+
+// returns the lane of a miner, 0 if it isn't bound to a lane
+func (p *Proxy) minerLane(connId uint64) int {
+	p.mutLanes.Lock()
+	defer p.mutLanes.Unlock()
+	return p.lanes[connId]
+}
+
+// returns the job of the miner's lane
+func (p *Proxy) minerJob(connId uint64) Job {
+	return p.laneJob(p.minerLane(connId))
+}
+
+func (p *Proxy) removeLane(connId uint64) {
+	p.mutLanes.Lock()
+	defer p.mutLanes.Unlock()
+	delete(p.lanes, connId)
+}
+
+// moves miners between the lanes, so each lane gets its share of the hashrate
+func (p *Proxy) rebalance() {
+	weights := p.laneWeights()
+
+	p.mutLanes.Lock()
+	moves := balanceLanes(weights, p.laneMiners())
+	for id, lane := range moves {
+		p.lanes[id] = lane
+	}
+	p.mutLanes.Unlock()
+
+	if len(moves) == 0 {
+		return
+	}
+
+	log.Infof("moving %d miners to balance the hashrate between the pools", len(moves))
+	p.stats.AddEvent("info", "moved %d miners to balance the hashrate between the pools", len(moves))
+
+	for id, lane := range moves {
+		job := p.laneJob(lane)
+		if job.Diff != 0 {
+			p.sendMinerJob(id, job)
+		}
+	}
+}
+
+func (p *Proxy) splitHandler() {
+	for sleep(p.ctx, SPLIT_REBALANCE_INTERVAL) {
+		p.rebalance()
+	}
+}
+
+// sends a job to the Xatum or Getwork miner with the given ID
+func (p *Proxy) sendMinerJob(id uint64, job Job) {
+	p.srv.RLock()
+	for _, v := range p.srv.Connections {
+		if v.Id == id {
+			v.Lock()
+			SendJob(v, job)
+			v.Unlock()
+			p.srv.RUnlock()
+			return
+		}
+	}
+	p.srv.RUnlock()
+
+	p.socketsMut.RLock()
+	defer p.socketsMut.RUnlock()
+
+	for _, c := range p.sockets {
+		if c != nil && c.Id == id {
+			c.Lock()
+			err := c.WriteJSON(map[string]any{
+				"new_job": newBlockTemplate(c.newJob(job)),
+			})
+			c.Unlock()
+			if err != nil {
+				log.Warn("failed to send job:", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xelishash"
+)
+
+func TestParseSplit(t *testing.T) {
+	split, err := ParseSplit([]string{"30% other.pool:5209", "10% - xet:fee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(split) != 2 || split[0] != (SplitRule{30, Upstream{Pool: "other.pool:5209"}}) ||
+		split[1] != (SplitRule{10, Upstream{Wallet: "xet:fee"}}) {
+		t.Fatalf("unexpected split %+v", split)
+	}
+
+	for exp, rules := range map[string][]string{
+		"expected a percentage": {"other.pool:5209"},
+		"invalid percentage":    {"-5% other.pool:5209"},
+		"expected a pool":       {"30%"},
+		"more than 100%":        {"60% a:1", "60% b:1"},
+		"empty split rule":      {""},
+	} {
+		_, err := ParseSplit(rules)
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Fatalf("%q: expected an error containing %q, got %v", rules, exp, err)
+		}
+	}
+}
+
+func TestPickLane(t *testing.T) {
+	weights := []float64{70, 30}
+	loads := []float64{0, 0}
+
+	lanes := make([]int, 0)
+	for range 10 {
+		lane := pickLane(weights, loads, 1)
+		loads[lane]++
+		lanes = append(lanes, lane)
+	}
+	if loads[0] != 7 || loads[1] != 3 {
+		t.Fatalf("expected 7 miners in lane 0 and 3 in lane 1, got %v", lanes)
+	}
+
+	if lane := pickLane([]float64{0, 0}, loads, 1); lane != 0 {
+		t.Fatalf("expected lane 0 without weights, got %d", lane)
+	}
+	if lane := pickLane([]float64{0, 30}, loads, 1); lane != 1 {
+		t.Fatalf("expected the only lane with a weight, got %d", lane)
+	}
+}
+
+func TestBalanceLanes(t *testing.T) {
+	miners := func(loads ...float64) []laneMiner {
+		res := make([]laneMiner, len(loads))
+		for i, v := range loads {
+			res[i] = laneMiner{id: uint64(i), load: v}
+		}
+		return res
+	}
+
+	// all the miners joined before the second pool was up
+	moves := balanceLanes([]float64{70, 30}, miners(1, 1, 1, 1, 1, 1, 1, 1, 1, 1))
+	if len(moves) != 3 {
+		t.Fatalf("expected 3 miners moved, got %v", moves)
+	}
+	for _, lane := range moves {
+		if lane != 1 {
+			t.Fatalf("unexpected moves %v", moves)
+		}
+	}
+
+	// a big miner is moved instead of many small ones
+	moves = balanceLanes([]float64{50, 50}, miners(1, 1, 10, 1, 1, 1, 1, 1, 1, 1, 1, 1))
+	if len(moves) != 1 || moves[2] != 1 {
+		t.Fatalf("expected the big miner moved, got %v", moves)
+	}
+
+	// moving the only miner wouldn't bring the lanes closer to their weights
+	moves = balanceLanes([]float64{50, 50}, miners(1))
+	if len(moves) != 0 {
+		t.Fatalf("unexpected moves %v", moves)
+	}
+
+	// within the tolerance
+	m := miners(100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100)
+	for i := range 11 {
+		m[i].lane = 1
+	}
+	moves = balanceLanes([]float64{50, 50}, m)
+	if len(moves) != 0 {
+		t.Fatalf("unexpected moves %v", moves)
+	}
+
+	// the miners of a lane whose pool is down are all moved
+	m = miners(1, 1, 1, 1)
+	m[0].lane, m[1].lane = 1, 1
+	moves = balanceLanes([]float64{50, 0}, m)
+	if len(moves) != 2 || moves[0] != 0 || moves[1] != 0 {
+		t.Fatalf("unexpected moves %v", moves)
+	}
+
+	if moves := balanceLanes([]float64{0, 0}, m); len(moves) != 0 {
+		t.Fatalf("unexpected moves without weights %v", moves)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	pool := newFakePool(t)
+	other := newFakePool(t)
+
+	cfg := testConfig(t, pool.listener.Addr().String())
+	cfg.Split = []string{"50% " + other.listener.Addr().String()}
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := make(chan Job, 4)
+	p.Hooks.OnJob = func(job Job) {
+		jobs <- job
+	}
+
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// the proxy is connected to both pools at the same time
+	poolConn := pool.accept(t)
+	otherConn := other.accept(t)
+
+	poolConn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	otherConn.read(t, xatum.PacketC2S_Handshake, &xatum.C2S_Handshake{})
+	poolConn.send(t, xatum.PacketS2C_Job, testJob(100))
+	otherConn.send(t, xatum.PacketS2C_Job, testJob(200))
+	recv(t, jobs)
+	recv(t, jobs)
+
+	// the miners are split between the pools
+	dial := func(worker string) (*fakeConn, xatum.S2C_Job) {
+		miner := dialMiner(t, cfg)
+		miner.send(t, xatum.PacketC2S_Handshake, xatum.C2S_Handshake{
+			Addr:  testMiner,
+			Work:  worker,
+			Agent: testAgent,
+			Algos: []string{xelishash.ALGO_V1},
+		})
+
+		job := xatum.S2C_Job{}
+		miner.read(t, xatum.PacketS2C_Job, &job)
+		return miner, job
+	}
+
+	miner1, job1 := dial("rig1")
+	miner2, job2 := dial("rig2")
+	if job1.Diff != 100 || job2.Diff != 200 {
+		t.Fatalf("expected a job of each pool, got difficulties %d and %d", job1.Diff, job2.Diff)
+	}
+
+	pools := map[string]int{}
+	for _, v := range p.Connections() {
+		pools[v.Pool]++
+	}
+	if pools[cfg.PoolAddress] != 1 || pools[other.listener.Addr().String()] != 1 {
+		t.Fatalf("unexpected pools of the miners %v", pools)
+	}
+
+	// each miner only gets the jobs of its pool, and its shares go there
+	otherConn.send(t, xatum.PacketS2C_Job, testJob(201))
+	miner2.read(t, xatum.PacketS2C_Job, &job2)
+	if job2.Diff != 201 {
+		t.Fatalf("expected the new job of the other pool, got difficulty %d", job2.Diff)
+	}
+
+	miner1.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: job1.Blob})
+	if s := readSubmit(t, poolConn); string(s.Data) != string(job1.Blob) {
+		t.Fatal("unexpected share submitted to the pool")
+	}
+	miner2.send(t, xatum.PacketC2S_Submit, xatum.C2S_Submit{Data: job2.Blob})
+	if s := readSubmit(t, otherConn); string(s.Data) != string(job2.Blob) {
+		t.Fatal("unexpected share submitted to the other pool")
+	}
+
+	// when the other pool is down, its miner is moved to the pool
+	other.listener.Close()
+	otherConn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.laneWeights()[1] != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the other pool is still up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.rebalance()
+
+	miner2.read(t, xatum.PacketS2C_Job, &job2)
+	if job2.Diff != 100 {
+		t.Fatalf("expected the job of the pool, got difficulty %d", job2.Diff)
+	}
+	for _, v := range p.Connections() {
+		if v.Pool != cfg.PoolAddress {
+			t.Fatalf("miner %d is still on pool %s", v.Id, v.Pool)
+		}
+	}
+}
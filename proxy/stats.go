@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"xatum-proxy/hashrate"
+	"xatum-proxy/log"
+)
+
+// Proxy-wide statistics, shown in the dashboard
+
+const MAX_EVENTS = 100
+const HASHRATE_SAMPLE_INTERVAL = 10 * time.Second
+const MAX_HASHRATE_SAMPLES = 360 // one hour of samples
+const SUMMARY_INTERVAL = 6       // print a summary every 6 samples
+const MAX_BLOCKS = 100           // the latest block candidates which are kept
+
+type Event struct {
+	Time  int64  `json:"time"` // unix milliseconds
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+type HashrateSample struct {
+	Time     int64   `json:"time"` // unix milliseconds
+	Hashrate float64 `json:"hashrate"`
+}
+
+type Stats struct {
+	SharesSubmitted uint64
+	SharesAccepted  uint64
+	SharesRejected  uint64
+
+	UpstreamConnected bool
+	UpstreamAddress   string
+	UpstreamSince     time.Time
+
+	BlocksFound uint64
+
+	samples []HashrateSample
+	events  []Event
+	blocks  []BlockCandidate
+
+	sync.RWMutex
+}
+
+// adds an event to the recent events feed
+func (s *Stats) AddEvent(level string, format string, a ...any) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.events = append(s.events, Event{
+		Time:  time.Now().UnixMilli(),
+		Level: level,
+		Msg:   fmt.Sprintf(format, a...),
+	})
+	if len(s.events) > MAX_EVENTS {
+		s.events = s.events[len(s.events)-MAX_EVENTS:]
+	}
+}
+
+func (s *Stats) ShareSubmitted() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.SharesSubmitted++
+}
+
+func (s *Stats) ShareResult(accepted bool, msg string) {
+	s.Lock()
+	if accepted {
+		s.SharesAccepted++
+	} else {
+		s.SharesRejected++
+	}
+	s.Unlock()
+
+	if !accepted {
+		s.AddEvent("warn", "share rejected by the pool: %s", msg)
+	}
+}
+
+func (s *Stats) SetUpstream(connected bool, addr string) {
+	s.Lock()
+	s.UpstreamConnected = connected
+	s.UpstreamAddress = addr
+	s.UpstreamSince = time.Now()
+	s.Unlock()
+
+	if connected {
+		s.AddEvent("info", "connected to pool %s", addr)
+	} else {
+		s.AddEvent("warn", "disconnected from pool %s", addr)
+	}
+}
+
+// takes a hashrate sample
+func (s *Stats) tick(hashrate float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.samples = append(s.samples, HashrateSample{
+		Time:     time.Now().UnixMilli(),
+		Hashrate: hashrate,
+	})
+	if len(s.samples) > MAX_HASHRATE_SAMPLES {
+		s.samples = s.samples[len(s.samples)-MAX_HASHRATE_SAMPLES:]
+	}
+}
+
+func (s *Stats) Samples() []HashrateSample {
+	s.RLock()
+	defer s.RUnlock()
+
+	return append([]HashrateSample{}, s.samples...)
+}
+
+func (s *Stats) Events() []Event {
+	s.RLock()
+	defer s.RUnlock()
+
+	return append([]Event{}, s.events...)
+}
+
+func (s *Stats) AddBlock(b BlockCandidate) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.BlocksFound++
+	s.blocks = append(s.blocks, b)
+	if len(s.blocks) > MAX_BLOCKS {
+		s.blocks = s.blocks[len(s.blocks)-MAX_BLOCKS:]
+	}
+}
+
+func (s *Stats) Blocks() []BlockCandidate {
+	s.RLock()
+	defer s.RUnlock()
+
+	return append([]BlockCandidate{}, s.blocks...)
+}
+
+func (p *Proxy) statsUpdater() {
+	for i := 1; sleep(p.ctx, HASHRATE_SAMPLE_INTERVAL); i++ {
+		p.stats.tick(p.hashrates.Total().M1)
+
+		log.Dev("took hashrate sample")
+
+		if i%SUMMARY_INTERVAL == 0 {
+			p.hashrates.Prune()
+			p.logSummary()
+		}
+	}
+}
+
+// prints a periodic summary of the proxy's hashrate
+func (p *Proxy) logSummary() {
+	rates := p.hashrates.Total()
+
+	p.srv.RLock()
+	numXatum := len(p.srv.Connections)
+	p.srv.RUnlock()
+	p.socketsMut.RLock()
+	numGetwork := len(p.sockets)
+	p.socketsMut.RUnlock()
+
+	p.stats.RLock()
+	accepted, rejected := p.stats.SharesAccepted, p.stats.SharesRejected
+	p.stats.RUnlock()
+
+	log.Title(log.Cyan+" Hashrate 1m:", hashrate.Format(rates.M1), "| 15m:", hashrate.Format(rates.M15),
+		"| 1h:", hashrate.Format(rates.H1), "| 24h:", hashrate.Format(rates.H24))
+	log.Title(log.Cyan+" Miners:", numXatum, "Xatum,", numGetwork, "Getwork | Shares:", accepted, "accepted,",
+		rejected, "rejected")
+}
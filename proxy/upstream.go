@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"xatum-proxy/log"
+	"xatum-proxy/xatum/client"
+	"xatum-proxy/xelisutil"
+)
+
+// Upstreams. The miners get the jobs of the active upstream. When the schedule switches to another
+// upstream, the previous one stays connected for UPSTREAM_DRAIN_TIME, so the shares of its jobs are
+// still submitted to it, and the miners aren't disconnected.
+
+// how long an upstream is kept after the switch to another one
+const UPSTREAM_DRAIN_TIME = 2 * time.Minute
+
+// how often the schedule is checked
+const SCHEDULE_CHECK_INTERVAL = time.Second
+
+type upstream struct {
+	Id     uint64
+	Target Upstream
+
+	wallet    string // the wallet mined to, WalletAddress if Target.Wallet is empty
+	walletKey [32]byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// guarded by p.mutPool
+	cl         *client.Client
+	job        Job       // the last job, zero if there isn't one
+	drainUntil time.Time // when the upstream is closed, zero if it isn't draining
+	failedOver bool      // the connection was closed by failover, so the reconnection waits
+
+	// shares of the upstream's jobs, waiting to be submitted to the pool
+	shares chan Share
+
+	// shares submitted to the pool which didn't receive a reply yet, in submission order
+	pendingShares    []Share
+	mutPendingShares sync.Mutex
+}
+
+// creates an upstream, and starts connecting to its pool
+// p.mutPool MUST be locked before calling this
+func (p *Proxy) newUpstream(target Upstream) *upstream {
+	up := &upstream{
+		Id:     atomic.AddUint64(&p.lastUpstreamId, 1),
+		Target: target,
+		wallet: target.Wallet,
+		shares: make(chan Share, SHARES_BUFFER),
+	}
+
+	walletAddr := p.wallet
+	if up.wallet == "" {
+		up.wallet = p.cfg.WalletAddress
+	} else {
+		// the wallets of the schedule are checked by Validate
+		walletAddr, _ = xelisutil.ParseAddress(up.wallet)
+	}
+	up.walletKey = walletAddr.PublicKey
+
+	up.ctx, up.cancel = context.WithCancel(p.ctx)
+
+	p.run(func() {
+		p.runUpstream(up)
+	})
+
+	return up
+}
+
+// returns the pool address of the upstream
+// p.mutPool MUST be locked before calling this
+func (p *Proxy) poolAddress(up *upstream) string {
+	if up != nil && up.Target.Pool != "" {
+		return up.Target.Pool
+	}
+	if p.poolIndex > 0 {
+		return p.cfg.BackupPools[p.poolIndex-1]
+	}
+	return p.cfg.PoolAddress
+}
+
+// returns the pool address of the upstream
+func (p *Proxy) upstreamPool(up *upstream) string {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+	return p.poolAddress(up)
+}
+
+func (p *Proxy) isActive(up *upstream) bool {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+	return p.active == up
+}
+
+// returns the upstream with the given ID, or nil if it's closed
+func (p *Proxy) findUpstream(id uint64) *upstream {
+	p.mutPool.RLock()
+	defer p.mutPool.RUnlock()
+
+	for _, v := range p.upstreams {
+		if v.Id == id {
+			return v
+		}
+	}
+	for _, v := range slices.Concat(p.splits, p.routed) {
+		if v.Id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// makes the upstream with the given target active. The previous upstream is drained, and an
+// upstream which is still draining is reused. Its last job is sent to the miners right away, the
+// new upstreams' jobs are sent when they are received.
+func (p *Proxy) switchUpstream(target Upstream) {
+	p.mutPool.Lock()
+
+	prev := p.active
+	if prev != nil && prev.Target == target {
+		p.mutPool.Unlock()
+		return
+	}
+
+	now := p.clock.Now()
+	if prev != nil {
+		prev.drainUntil = now.Add(UPSTREAM_DRAIN_TIME)
+	}
+
+	var up *upstream
+	for _, v := range p.upstreams {
+		if v.Target == target {
+			up = v
+		}
+	}
+	if up == nil {
+		up = p.newUpstream(target)
+		p.upstreams = append(p.upstreams, up)
+	}
+	up.drainUntil = time.Time{}
+	p.active = up
+
+	job := up.job
+	if job.Diff != 0 {
+		p.setCurJob(job)
+	}
+	connected := up.cl != nil
+	poolAddr := p.poolAddress(up)
+	p.mutPool.Unlock()
+
+	if prev != nil {
+		log.Infof("switching to pool %s, wallet %s", poolAddr, up.wallet)
+		p.stats.AddEvent("info", "switched to pool %s, wallet %s", poolAddr, up.wallet)
+	}
+
+	if connected {
+		p.stats.SetUpstream(true, poolAddr)
+	}
+	if job.Diff != 0 {
+		p.broadcastJob(job, 0)
+	}
+}
+
+// closes the upstreams which finished draining
+func (p *Proxy) closeDrained(now time.Time) {
+	p.mutPool.Lock()
+	defer p.mutPool.Unlock()
+
+	kept := p.upstreams[:0]
+	for _, v := range p.upstreams {
+		if v != p.active && !v.drainUntil.IsZero() && !now.Before(v.drainUntil) {
+			log.Infof("closing the connection to pool %s, the shares of its jobs expired", p.poolAddress(v))
+			v.cancel()
+			continue
+		}
+		kept = append(kept, v)
+	}
+	clear(p.upstreams[len(kept):])
+	p.upstreams = kept
+}
+
+// switches to the upstream of the schedule, and closes the drained upstreams
+func (p *Proxy) checkSchedule() {
+	now := p.clock.Now()
+
+	p.switchUpstream(p.schedule.At(now))
+	p.closeDrained(now)
+}
+
+func (p *Proxy) scheduleHandler() {
+	for sleep(p.ctx, SCHEDULE_CHECK_INTERVAL) {
+		p.checkSchedule()
+	}
+}
@@ -0,0 +1,282 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAProxy PROXY protocol v1 and v2 support.
+// The header is only parsed on connections coming from a trusted source, so clients can't spoof
+// their address. Connections from trusted sources without a header are passed through unchanged.
+
+const HEADER_TIMEOUT = 10 * time.Second
+
+const v1MaxLength = 107
+
+var v1Prefix = []byte("PROXY ")
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// ParseTrusted parses a list of IP addresses and CIDR prefixes
+func ParseTrusted(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+
+	for _, v := range list {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return prefixes, nil
+}
+
+// IsTrusted returns true if the IP is contained in one of the trusted prefixes
+func IsTrusted(trusted []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener wraps a net.Listener, and parses the PROXY protocol header of the connections accepted
+// from trusted sources.
+type Listener struct {
+	net.Listener
+
+	Trusted []netip.Prefix
+}
+
+func NewListener(l net.Listener, trusted []netip.Prefix) *Listener {
+	return &Listener{
+		Listener: l,
+		Trusted:  trusted,
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil || !IsTrusted(l.Trusted, host) {
+		return c, nil
+	}
+
+	return &Conn{
+		Conn: c,
+		rdr:  bufio.NewReader(c),
+	}, nil
+}
+
+// Conn is a connection from a trusted source. The header is read lazily on the first call to Read
+// or RemoteAddr, so a slow client doesn't block the accept loop.
+type Conn struct {
+	net.Conn
+
+	rdr    *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(HEADER_TIMEOUT))
+		c.remote, c.err = ReadHeader(c.rdr)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.rdr.Read(b)
+}
+
+// RemoteAddr returns the source address sent in the header, or the address of the peer if there is
+// no header
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ReadHeader reads a PROXY protocol header from rdr. It returns a nil address if there is no
+// header, or if the header doesn't carry a source address (LOCAL / UNKNOWN).
+func ReadHeader(rdr *bufio.Reader) (net.Addr, error) {
+	b, err := rdr.Peek(len(v1Prefix))
+	if err != nil {
+		// connections closed before sending anything have no header
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if bytes.Equal(b, v1Prefix) {
+		return readV1(rdr)
+	}
+
+	b, err = rdr.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(b, v2Signature) {
+		return readV2(rdr)
+	}
+
+	return nil, nil
+}
+
+func readV1(rdr *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		c, err := rdr.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+		}
+	}
+
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: v1 header doesn't end with CRLF", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, s)
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHeader, err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHeader, err)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+func readV2(rdr *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	_, err := io.ReadFull(rdr, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	version := hdr[12] >> 4
+	command := hdr[12] & 0xf
+	family := hdr[13]
+	length := binary.BigEndian.Uint16(hdr[14:16])
+
+	if version != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, version)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(rdr, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// LOCAL command, sent by the balancer for health checks
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("%w: address block too short", ErrInvalidHeader)
+		}
+		addr := netip.AddrFrom4([4]byte(data[0:4]))
+		port := binary.BigEndian.Uint16(data[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("%w: address block too short", ErrInvalidHeader)
+		}
+		addr := netip.AddrFrom16([16]byte(data[0:16]))
+		port := binary.BigEndian.Uint16(data[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	default:
+		// unsupported families (UDP, unix) don't carry a usable address
+		return nil, nil
+	}
+}
+
+// ForwardedFor returns the client IP from an X-Forwarded-For header value. The addresses are
+// walked from the right, skipping the trusted proxies; remote is the address of the peer which
+// sent the header. If remote isn't trusted, the header is ignored.
+func ForwardedFor(trusted []netip.Prefix, remote string, header string) string {
+	if header == "" || !IsTrusted(trusted, remote) {
+		return remote
+	}
+
+	ips := strings.Split(header, ",")
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(ips[i])
+
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			// malformed header, don't trust what's left of it
+			return remote
+		}
+		ip = addr.Unmap().String()
+
+		if !IsTrusted(trusted, ip) {
+			return ip
+		}
+		remote = ip
+	}
+
+	return remote
+}
@@ -0,0 +1,175 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func v2Header(command byte, family byte, addr []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|command, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addr)))
+	return append(b, addr...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x14, 0x5b}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6[32:34], 12345)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		remote string
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 5211\r\n"), "192.0.2.1:12345", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 ::1 12345 5211\r\n"), "[2001:db8::1]:12345", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 5211\n"), "", true},
+		{"v1 bad ip", []byte("PROXY TCP4 192.0.2 10.0.0.1 12345 5211\r\n"), "", true},
+		{"v2 tcp4", v2Header(1, 0x11, v4), "192.0.2.1:12345", false},
+		{"v2 tcp6", v2Header(1, 0x21, v6), "[2001:db8::1]:12345", false},
+		{"v2 local", v2Header(0, 0x00, nil), "", false},
+		{"v2 short", v2Header(1, 0x11, v4[:4]), "", true},
+		{"no header", []byte("shares~{}\n"), "", false},
+	}
+
+	for _, tt := range tests {
+		data := append(append([]byte{}, tt.data...), []byte("payload")...)
+		rdr := bufio.NewReader(bytes.NewReader(data))
+
+		addr, err := ReadHeader(rdr)
+		if tt.err {
+			if !errors.Is(err, ErrInvalidHeader) {
+				t.Errorf("%s: expected invalid header error, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+
+		remote := ""
+		if addr != nil {
+			remote = addr.String()
+		}
+		if remote != tt.remote {
+			t.Errorf("%s: expected address %q, got %q", tt.name, tt.remote, remote)
+		}
+
+		// the rest of the stream must be untouched
+		rest, _ := io.ReadAll(rdr)
+		if tt.remote != "" && string(rest) != "payload" {
+			t.Errorf("%s: unexpected payload %q", tt.name, rest)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	trusted, err := ParseTrusted([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l, trusted)
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4000 5211\r\nhello"))
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != "203.0.113.7:4000" {
+		t.Fatalf("unexpected remote address %s", c.RemoteAddr())
+	}
+
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected data %q", b)
+	}
+}
+
+func TestUntrustedListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	trusted, _ := ParseTrusted([]string{"10.0.0.1"})
+	pl := NewListener(l, trusted)
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4000 5211\r\n"))
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// spoofed headers from untrusted sources are left in the stream
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	if host != "127.0.0.1" {
+		t.Fatalf("untrusted header was parsed, remote address %s", c.RemoteAddr())
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote, header, expected string
+	}{
+		{"10.0.0.1", "203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.1", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1", "garbage, 203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1", "203.0.113.7, garbage", "10.0.0.1"},
+		{"2001:db8::1", "2001:db8::2", "2001:db8::2"},
+		// untrusted peers can't spoof their address
+		{"198.51.100.9", "203.0.113.7", "198.51.100.9"},
+	}
+
+	for _, tt := range tests {
+		ip := ForwardedFor(trusted, tt.remote, tt.header)
+		if ip != tt.expected {
+			t.Errorf("ForwardedFor(%q, %q) = %q, expected %q", tt.remote, tt.header, ip, tt.expected)
+		}
+	}
+}
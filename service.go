@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+	"xatum-proxy/config"
+	"xatum-proxy/hashrate"
+	"xatum-proxy/log"
+	"xatum-proxy/proxy"
+	"xatum-proxy/systemd"
+)
+
+// System service: xatum-proxy [flags] install|uninstall|start|stop|status
+// install copies the executable and the configuration to a directory owned by a dedicated user, and
+// generates a systemd unit which runs the proxy there.
+
+const SERVICE_NAME = "xatum-proxy"
+const SERVICE_DIR = "/opt/xatum-proxy"
+const SERVICE_WATCHDOG = 30 * time.Second
+
+// files copied to the service's directory, if they exist next to the executable
+var serviceFiles = []string{"cert.pem", "key.pem"}
+
+// runs a service subcommand, and exits if it fails
+func serviceCommand(args []string) {
+	var err error
+
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "start", "stop", "status":
+		err = systemctl(args[0], SERVICE_NAME)
+	default:
+		err = fmt.Errorf("unknown command %q, expected install, uninstall, start, stop or status", args[0])
+	}
+
+	// systemctl status exits with 3 if the service isn't running
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && args[0] == "status" {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		log.Err(err)
+		os.Exit(1)
+	}
+}
+
+// checks that the service can be installed or uninstalled
+func checkSystemd() error {
+	if runtime.GOOS != "linux" {
+		return errors.New("the service is only supported on Linux with systemd")
+	}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return errors.New("the service needs systemd: systemctl not found")
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("installing the service needs root, run it with sudo")
+	}
+	return nil
+}
+
+func installService(args []string) error {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	userName := fs.String("user", SERVICE_NAME, "user which runs the service, created if it doesn't exist")
+	dir := fs.String("dir", SERVICE_DIR, "directory of the executable, the configuration and the TLS certificate")
+	fs.Parse(args)
+
+	err := checkSystemd()
+	if err != nil {
+		return err
+	}
+
+	err = Cfg.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	usr, err := serviceUser(*userName, *dir)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(usr.Uid)
+	gid, _ := strconv.Atoi(usr.Gid)
+
+	err = os.MkdirAll(*dir, 0o750)
+	if err != nil {
+		return err
+	}
+	err = os.Chown(*dir, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(*dir, SERVICE_NAME)
+	if exe != dst {
+		err = copyFile(exe, dst, 0o755)
+		if err != nil {
+			return fmt.Errorf("failed to copy the executable: %w", err)
+		}
+	}
+
+	// the configuration is saved with the environment and the flags, since the service doesn't
+	// have them. An existing configuration is kept, so reinstalling only updates the executable.
+	dstCfg := filepath.Join(*dir, filepath.Base(cfgFile))
+	if _, err := os.Stat(dstCfg); err == nil {
+		log.Info("keeping the existing configuration", dstCfg)
+	} else {
+		err = config.SaveFile(dstCfg, &Cfg)
+		if err != nil {
+			return err
+		}
+		err = os.Chown(dstCfg, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, v := range serviceFiles {
+		from := filepath.Join(path(), v)
+		to := filepath.Join(*dir, v)
+
+		if _, err := os.Stat(from); err != nil || from == to {
+			continue
+		}
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+
+		err = copyFile(from, to, 0o600)
+		if err != nil {
+			return err
+		}
+		err = os.Chown(to, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	unit := systemd.Unit{
+		Name:        SERVICE_NAME,
+		Description: "XATUM-PROXY mining proxy",
+		Exec:        dst,
+		User:        usr.Username,
+		Dir:         *dir,
+		Watchdog:    SERVICE_WATCHDOG,
+	}
+	err = os.WriteFile(unit.File(), []byte(unit.String()), 0o644)
+	if err != nil {
+		return err
+	}
+	log.Info("created", unit.File())
+
+	err = systemctl("daemon-reload")
+	if err != nil {
+		return err
+	}
+	err = systemctl("enable", SERVICE_NAME)
+	if err != nil {
+		return err
+	}
+
+	log.Info("installed the service in", *dir+", start it with:", dst, "start")
+	return nil
+}
+
+func uninstallService() error {
+	err := checkSystemd()
+	if err != nil {
+		return err
+	}
+
+	unit := systemd.Unit{Name: SERVICE_NAME}
+
+	err = systemctl("disable", "--now", SERVICE_NAME)
+	if err != nil {
+		log.Warn("failed to stop the service:", err)
+	}
+
+	err = os.Remove(unit.File())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = systemctl("daemon-reload")
+	if err != nil {
+		return err
+	}
+
+	log.Info("uninstalled the service. Its directory and its user are kept, with the configuration and the TLS certificate.")
+	return nil
+}
+
+// returns the user of the service, and creates it if it doesn't exist
+func serviceUser(name, home string) (*user.User, error) {
+	usr, err := user.Lookup(name)
+	if err == nil {
+		return usr, nil
+	}
+	if !errors.As(err, new(user.UnknownUserError)) {
+		return nil, err
+	}
+
+	log.Info("creating the user", name)
+
+	out, err := exec.Command("useradd", "--system", "--user-group", "--no-create-home", "--home-dir", home,
+		"--shell", "/usr/sbin/nologin", name).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the user %s: %w: %s", name, err, out)
+	}
+
+	return user.Lookup(name)
+}
+
+// runs systemctl, with its output in the terminal
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// copies a file through a temporary file, so a running executable can be replaced
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// tells systemd that the proxy is ready, then pings the watchdog while the proxy responds
+func notifySystemd(ctx context.Context, p *proxy.Proxy) {
+	ok, err := systemd.Notify(systemd.READY)
+	if err != nil {
+		log.Warn("failed to notify systemd:", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	interval := systemd.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Debug("systemd watchdog interval:", interval)
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// State takes the proxy's locks, so the pings stop if it is stuck
+		st := p.State()
+		status := fmt.Sprintf("%d miners, %s", len(st.Workers), hashrate.Format(p.Hashrate().M1))
+
+		_, err := systemd.Notify(systemd.WATCHDOG + "\n" + systemd.Status(status))
+		if err != nil {
+			log.Warn("failed to ping the systemd watchdog:", err)
+		}
+	}
+}
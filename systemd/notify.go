@@ -0,0 +1,64 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sd_notify protocol: the service sends its state as datagrams to the socket in $NOTIFY_SOCKET.
+// See https://www.freedesktop.org/software/systemd/man/sd_notify.html
+
+const (
+	READY    = "READY=1"
+	STOPPING = "STOPPING=1"
+	WATCHDOG = "WATCHDOG=1"
+)
+
+// Notify sends the state to systemd. It returns false if the service isn't started by systemd
+// with Type=notify, which is not an error.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+
+	// abstract sockets start with a null byte
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Status returns the STATUS= state, a free-form message shown by systemctl status
+func Status(msg string) string {
+	return "STATUS=" + msg
+}
+
+// WatchdogInterval returns the interval in which systemd expects WATCHDOG=1, from $WATCHDOG_USEC,
+// or 0 if the watchdog is disabled
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 63)
+	if err != nil || usec == 0 {
+		return 0
+	}
+
+	// the watchdog is for another process
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,109 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	ok, err := Notify(READY)
+	if ok || err != nil {
+		t.Fatalf("expected no notification without NOTIFY_SOCKET, got %v %v", ok, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	ok, err = Notify(WATCHDOG + "\n" + Status("2 miners"))
+	if !ok || err != nil {
+		t.Fatalf("expected a notification, got %v %v", ok, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "WATCHDOG=1\nSTATUS=2 miners" {
+		t.Fatalf("unexpected notification %q", buf[:n])
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	_, err = Notify(READY)
+	if err == nil {
+		t.Fatal("expected an error for a missing socket")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec string
+		pid  string
+		exp  time.Duration
+	}{
+		{"", "", 0},
+		{"abc", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		{"30000000", "1", 0},
+	}
+
+	for _, v := range tests {
+		t.Setenv("WATCHDOG_USEC", v.usec)
+		t.Setenv("WATCHDOG_PID", v.pid)
+
+		if d := WatchdogInterval(); d != v.exp {
+			t.Fatalf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: expected %s, got %s", v.usec, v.pid, v.exp, d)
+		}
+	}
+}
+
+func TestUnit(t *testing.T) {
+	u := Unit{
+		Name:        "xatum-proxy",
+		Description: "XATUM-PROXY mining proxy",
+		Exec:        "/opt/xatum proxy/xatum-proxy",
+		Args:        []string{"--tui=false"},
+		User:        "xatum",
+		Dir:         "/opt/xatum proxy",
+		Watchdog:    30 * time.Second,
+	}
+
+	if u.File() != "/etc/systemd/system/xatum-proxy.service" {
+		t.Fatalf("unexpected unit file %s", u.File())
+	}
+
+	s := u.String()
+	for _, v := range []string{
+		"Type=notify\n",
+		"ExecStart=\"/opt/xatum proxy/xatum-proxy\" --tui=false\n",
+		"User=xatum\n",
+		"Group=xatum\n",
+		"WorkingDirectory=\"/opt/xatum proxy\"\n",
+		"WatchdogSec=30\n",
+		"WantedBy=multi-user.target\n",
+	} {
+		if !strings.Contains(s, v) {
+			t.Fatalf("expected %q in the unit:\n%s", v, s)
+		}
+	}
+
+	u.Watchdog = 0
+	if strings.Contains(u.String(), "WatchdogSec") {
+		t.Fatal("unexpected watchdog")
+	}
+}
@@ -0,0 +1,69 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Unit is a systemd service, run as a dedicated user in its own directory
+type Unit struct {
+	Name        string // like "xatum-proxy", the unit file is Name.service
+	Description string
+	Exec        string // path of the executable
+	Args        []string
+	User        string
+	Dir         string // working directory, which the service can write to
+	Watchdog    time.Duration
+}
+
+// UNITS_DIR is the directory of the units installed by the system administrator
+const UNITS_DIR = "/etc/systemd/system"
+
+// File returns the path of the unit file
+func (u Unit) File() string {
+	return UNITS_DIR + "/" + u.Name + ".service"
+}
+
+// String returns the content of the unit file
+func (u Unit) String() string {
+	exec := quote(u.Exec)
+	for _, v := range u.Args {
+		exec += " " + quote(v)
+	}
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "[Unit]\n")
+	fmt.Fprintf(&sb, "Description=%s\n", u.Description)
+	fmt.Fprintf(&sb, "Wants=network-online.target\n")
+	fmt.Fprintf(&sb, "After=network-online.target\n")
+	fmt.Fprintf(&sb, "\n[Service]\n")
+	fmt.Fprintf(&sb, "Type=notify\n")
+	fmt.Fprintf(&sb, "ExecStart=%s\n", exec)
+	fmt.Fprintf(&sb, "User=%s\n", u.User)
+	fmt.Fprintf(&sb, "Group=%s\n", u.User)
+	fmt.Fprintf(&sb, "WorkingDirectory=%s\n", quote(u.Dir))
+	fmt.Fprintf(&sb, "Restart=on-failure\n")
+	fmt.Fprintf(&sb, "RestartSec=5\n")
+	if u.Watchdog > 0 {
+		fmt.Fprintf(&sb, "WatchdogSec=%d\n", int64(u.Watchdog.Seconds()))
+	}
+	// the ports below 1024 need this capability
+	fmt.Fprintf(&sb, "AmbientCapabilities=CAP_NET_BIND_SERVICE\n")
+	fmt.Fprintf(&sb, "NoNewPrivileges=true\n")
+	fmt.Fprintf(&sb, "ProtectSystem=full\n")
+	fmt.Fprintf(&sb, "PrivateTmp=true\n")
+	fmt.Fprintf(&sb, "LimitNOFILE=65536\n")
+	fmt.Fprintf(&sb, "\n[Install]\n")
+	fmt.Fprintf(&sb, "WantedBy=multi-user.target\n")
+
+	return sb.String()
+}
+
+// quotes a word of the unit file if it contains spaces or quotes
+func quote(s string) string {
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
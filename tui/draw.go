@@ -0,0 +1,228 @@
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"xatum-proxy/hashrate"
+	"xatum-proxy/log"
+	"xatum-proxy/proxy"
+
+	"golang.org/x/term"
+)
+
+const (
+	altScreenOn  = "\033[?1049h"
+	altScreenOff = "\033[?1049l"
+	cursorOn     = "\033[?25h"
+	cursorOff    = "\033[?25l"
+	cursorHome   = "\033[H"
+	clearLine    = "\033[K"
+	clearBelow   = "\033[J"
+	reverse      = "\033[7m"
+)
+
+type column struct {
+	name  string
+	width int
+	sort  sortColumn // the column which sorts the table by this one, or numSortColumns
+	value func(c proxy.AdminConnection) string
+}
+
+var columns = []column{
+	{"PROTO", 8, sortProtocol, func(c proxy.AdminConnection) string { return c.Protocol }},
+	{"WORKER", 16, sortWorker, workerName},
+	{"WALLET", 16, numSortColumns, func(c proxy.AdminConnection) string { return shortWallet(c.Wallet) }},
+	{"IP", 16, sortIP, func(c proxy.AdminConnection) string { return c.IP }},
+	{"HR 1M", 12, sortHashrate, func(c proxy.AdminConnection) string { return hashrate.Format(c.Hashrate.M1) }},
+	{"HR 15M", 12, numSortColumns, func(c proxy.AdminConnection) string { return hashrate.Format(c.Hashrate.M15) }},
+	{"SHARES", 8, sortShares, func(c proxy.AdminConnection) string { return strconv.FormatUint(c.Shares, 10) }},
+	{"DIFF", 12, numSortColumns, func(c proxy.AdminConnection) string { return strconv.FormatUint(c.Diff, 10) }},
+	{"LAST SHARE", 12, sortLastShare, func(c proxy.AdminConnection) string { return since(c.LastShare) }},
+	{"AGENT", 0, numSortColumns, func(c proxy.AdminConnection) string { return c.Agent }},
+}
+
+// truncates or pads s to w runes
+func fit(s string, w int) string {
+	n := utf8.RuneCountInString(s)
+	if n > w {
+		r := []rune(s)
+		if w > 1 {
+			return string(r[:w-1]) + "…"
+		}
+		return string(r[:w])
+	}
+	return s + strings.Repeat(" ", w-n)
+}
+
+// formats the time since a unix milliseconds timestamp
+func since(ms int64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return formatDuration(time.Since(time.UnixMilli(ms))) + " ago"
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Truncate(time.Second).String()
+	}
+	return d.Truncate(time.Minute).String()
+}
+
+func (t *TUI) size() (int, int) {
+	w, h, err := term.GetSize(int(t.out.Fd()))
+	if err != nil || w <= 0 || h <= 0 {
+		return 80, 24
+	}
+	return w, h
+}
+
+// draws the whole screen
+func (t *TUI) draw() {
+	width, height := t.size()
+
+	st := t.p.State()
+	rates := t.p.Hashrate()
+	workers := st.Workers
+	sortWorkers(workers, t.sortBy, t.sortDesc)
+
+	lines := make([]string, 0, height)
+	line := func(color, s string) {
+		lines = append(lines, color+fit(s, width)+log.Reset)
+	}
+
+	line(reverse+log.Bold, " XATUM-PROXY v"+st.Version+"  "+st.Upstream.Wallet)
+
+	if st.Upstream.Connected {
+		line(log.Green, fmt.Sprintf(" Upstream: connected to %s for %s", st.Upstream.Address,
+			formatDuration(time.Since(time.UnixMilli(st.Upstream.Since)))))
+	} else if st.Upstream.Since > 0 {
+		line(log.Red, fmt.Sprintf(" Upstream: disconnected from %s for %s", st.Upstream.Address,
+			formatDuration(time.Since(time.UnixMilli(st.Upstream.Since)))))
+	} else {
+		line(log.Yellow, " Upstream: connecting to "+t.p.PoolAddress())
+	}
+
+	if st.Job.Diff == 0 {
+		line("", " Job: waiting for the first job")
+	} else {
+		line("", fmt.Sprintf(" Job: difficulty %d | algorithm %s | workhash %s", st.Job.Diff, st.Job.Algo,
+			st.Job.Workhash))
+	}
+
+	line("", fmt.Sprintf(" Hashrate 1m: %s | 15m: %s | 1h: %s | 24h: %s", hashrate.Format(rates.M1),
+		hashrate.Format(rates.M15), hashrate.Format(rates.H1), hashrate.Format(rates.H24)))
+	line("", fmt.Sprintf(" Shares: %d submitted, %d accepted, %d rejected | Workers: %d",
+		st.Shares.Submitted, st.Shares.Accepted, st.Shares.Rejected, len(workers)))
+
+	// the rest of the screen is split between the workers and the logs, minus the footer
+	rest := height - len(lines) - 1
+	tableRows := max(1, rest/2-1)
+	logRows := max(0, rest-tableRows-2)
+
+	header := " "
+	for _, c := range columns {
+		name := c.name
+		if c.sort == t.sortBy {
+			if t.sortDesc {
+				name += " ↓"
+			} else {
+				name += " ↑"
+			}
+		}
+		header += fitColumn(name, c.width)
+	}
+	line(reverse, header)
+
+	sel := indexOf(workers, t.selected)
+	if len(workers) > 0 {
+		t.selected = workers[sel].Id
+	}
+	offset := max(0, sel-tableRows+1)
+
+	for i := 0; i < tableRows; i++ {
+		if offset+i >= len(workers) {
+			line("", "")
+			continue
+		}
+
+		c := workers[offset+i]
+		row := " "
+		for _, col := range columns {
+			row += fitColumn(col.value(c), col.width)
+		}
+
+		if offset+i == sel {
+			line(reverse, row)
+		} else {
+			line("", row)
+		}
+	}
+
+	line(reverse, " LOGS (level "+t.minLevel.String()+" and above)")
+	logs := t.logs.Last(logRows, t.minLevel)
+	for i := 0; i < logRows; i++ {
+		if i >= len(logs) {
+			line("", "")
+			continue
+		}
+		line(levelColor(logs[i].Level), " "+logs[i].Text)
+	}
+
+	switch t.prompt {
+	case promptPool:
+		line(log.Bold, " Pool address: "+t.input+"█  (enter to switch, esc to cancel)")
+	case promptKick:
+		if len(workers) > 0 {
+			c := workers[sel]
+			line(log.Bold, fmt.Sprintf(" Kick %s %s (%s)? [y/N]", c.Protocol, workerName(c), c.IP))
+		} else {
+			line(log.Bold, " Kick? [y/N]")
+		}
+	default:
+		if t.status != "" {
+			line(log.Bold, " "+t.status)
+		} else {
+			line(log.Gray, " ↑↓ select  s sort  r reverse  l log level  k kick  p switch pool  q quit")
+		}
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString(cursorHome)
+	for i, v := range lines {
+		if i >= height {
+			break
+		}
+		buf.WriteString(v + clearLine)
+		if i < height-1 && i < len(lines)-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString(clearBelow)
+
+	t.out.Write(buf.Bytes())
+}
+
+// columns of zero width take the rest of the line
+func fitColumn(s string, w int) string {
+	if w == 0 {
+		return s
+	}
+	return fit(s, w-1) + " "
+}
+
+func levelColor(l level) string {
+	switch l {
+	case levelErr:
+		return log.Red
+	case levelWarn:
+		return log.Yellow
+	case levelDebug:
+		return log.Cyan
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package tui
+
+import (
+	"os"
+	"unicode/utf8"
+)
+
+// Keyboard input. In raw mode, the keys are read from stdin as bytes, with escape sequences for the
+// arrows.
+
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyPageUp    = "pgup"
+	keyPageDown  = "pgdown"
+	keyEnter     = "enter"
+	keyEscape    = "esc"
+	keyBackspace = "backspace"
+	keyCtrlC     = "ctrl-c"
+)
+
+var escapeKeys = map[string]string{
+	"\033[A":  keyUp,
+	"\033OA":  keyUp,
+	"\033[B":  keyDown,
+	"\033OB":  keyDown,
+	"\033[5~": keyPageUp,
+	"\033[6~": keyPageDown,
+}
+
+// splits the bytes read from stdin into keys. Printable keys are returned as themselves, unknown
+// escape sequences are dropped.
+func parseKeys(data []byte) []string {
+	keys := make([]string, 0, 1)
+
+	for len(data) > 0 {
+		switch data[0] {
+		case '\033':
+			if len(data) == 1 {
+				keys = append(keys, keyEscape)
+				return keys
+			}
+
+			// an escape sequence ends with a letter or a tilde
+			n := 2
+			for n < len(data) && (data[n] < 'A' || data[n] > 'z') && data[n] != '~' {
+				n++
+			}
+			if n < len(data) {
+				n++
+			}
+
+			if k, ok := escapeKeys[string(data[:n])]; ok {
+				keys = append(keys, k)
+			}
+			data = data[n:]
+			continue
+		case '\r', '\n':
+			keys = append(keys, keyEnter)
+		case 0x7f, 0x08:
+			keys = append(keys, keyBackspace)
+		case 0x03:
+			keys = append(keys, keyCtrlC)
+		default:
+			r, size := utf8.DecodeRune(data)
+			if r >= ' ' && r != utf8.RuneError {
+				keys = append(keys, string(r))
+			}
+			data = data[size:]
+			continue
+		}
+		data = data[1:]
+	}
+
+	return keys
+}
+
+// sends the keys read from stdin, until it is closed
+func readKeys(in *os.File, keys chan<- string) {
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+	}
+}
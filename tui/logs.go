@@ -0,0 +1,102 @@
+package tui
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Log pane. The log package writes to log.Stdout and log.Stderr, which are replaced by a logBuffer
+// while the TUI is shown.
+
+const MAX_LOG_LINES = 1000
+
+type level uint8
+
+const (
+	levelDebug level = iota // DEBUG, DEV, NET and MUTEX
+	levelInfo
+	levelWarn
+	levelErr
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "err"}
+
+func (l level) String() string {
+	return levelNames[l]
+}
+
+type logLine struct {
+	Level level
+	Text  string // without colors
+}
+
+var ansiRegexp = regexp.MustCompile("\033\\[[0-9;?]*[a-zA-Z]")
+
+// returns the level of a line of the log package, from its tag like [WARN]
+func parseLevel(line string) level {
+	switch {
+	case strings.Contains(line, "[ERR]"), strings.Contains(line, "[FATAL]"):
+		return levelErr
+	case strings.Contains(line, "[WARN]"):
+		return levelWarn
+	case strings.Contains(line, "[DEBUG]"), strings.Contains(line, "[DEV]"),
+		strings.Contains(line, "[NET]"), strings.Contains(line, "NETDEV"), strings.Contains(line, "[MUTEX]"):
+		return levelDebug
+	}
+	// [INFO] and the lines of log.Title
+	return levelInfo
+}
+
+type logBuffer struct {
+	lines   []logLine
+	partial string // the end of the last write, if it didn't end with a newline
+
+	// called after each write, without the lock
+	onWrite func()
+
+	sync.Mutex
+}
+
+func (b *logBuffer) Write(data []byte) (int, error) {
+	b.Lock()
+	s := b.partial + string(data)
+	lines := strings.Split(s, "\n")
+	b.partial = lines[len(lines)-1]
+
+	for _, v := range lines[:len(lines)-1] {
+		v = ansiRegexp.ReplaceAllString(v, "")
+		b.lines = append(b.lines, logLine{
+			Level: parseLevel(v),
+			Text:  strings.ReplaceAll(strings.TrimRight(v, " \r"), "\t", "    "),
+		})
+	}
+	if len(b.lines) > MAX_LOG_LINES {
+		b.lines = b.lines[len(b.lines)-MAX_LOG_LINES:]
+	}
+	b.Unlock()
+
+	if b.onWrite != nil {
+		b.onWrite()
+	}
+	return len(data), nil
+}
+
+// returns the last n lines with at least the given level
+func (b *logBuffer) Last(n int, min level) []logLine {
+	b.Lock()
+	defer b.Unlock()
+
+	res := make([]logLine, 0, n)
+	for i := len(b.lines) - 1; i >= 0 && len(res) < n; i-- {
+		if b.lines[i].Level >= min {
+			res = append(res, b.lines[i])
+		}
+	}
+
+	// oldest first
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
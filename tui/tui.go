@@ -0,0 +1,227 @@
+package tui
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"time"
+	"xatum-proxy/log"
+	"xatum-proxy/proxy"
+
+	"golang.org/x/term"
+)
+
+// Full-screen terminal UI: upstream status, current job, workers table and logs. The logs are
+// captured while it is shown, and printed normally again after Close.
+
+const REFRESH_INTERVAL = time.Second
+
+type promptKind uint8
+
+const (
+	promptNone promptKind = iota
+	promptPool            // editing the pool address
+	promptKick            // confirming the kick of the selected worker
+)
+
+type TUI struct {
+	p *proxy.Proxy
+
+	in  *os.File
+	out *os.File
+
+	oldState  *term.State
+	oldStdout io.Writer
+	oldStderr io.Writer
+
+	logs   *logBuffer
+	redraw chan struct{}
+
+	// the state of the view, only used by the goroutine of Run
+	selected uint64 // id of the selected worker
+	sortBy   sortColumn
+	sortDesc bool
+	minLevel level
+	prompt   promptKind
+	input    string
+	status   string // message shown in the footer, until the next key
+}
+
+// IsTerminal returns true if stdin and stdout are terminals, so the TUI can be shown
+func IsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// New switches the terminal to the TUI, and captures the logs. Close MUST be called to restore the
+// terminal.
+func New(p *proxy.Proxy) (*TUI, error) {
+	t := &TUI{
+		p:        p,
+		in:       os.Stdin,
+		out:      os.Stdout,
+		logs:     &logBuffer{},
+		redraw:   make(chan struct{}, 1),
+		sortDesc: true,
+		minLevel: levelInfo,
+	}
+
+	state, err := term.MakeRaw(int(t.in.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	t.oldState = state
+
+	t.logs.onWrite = t.requestRedraw
+	t.oldStdout, t.oldStderr = log.Stdout, log.Stderr
+	log.Stdout, log.Stderr = t.logs, t.logs
+
+	t.out.WriteString(altScreenOn + cursorOff)
+
+	return t, nil
+}
+
+// Close restores the terminal and the logs. The logs aren't synchronized, so nothing may log while
+// Close runs: the proxy must be stopped first.
+func (t *TUI) Close() {
+	log.Stdout, log.Stderr = t.oldStdout, t.oldStderr
+
+	t.out.WriteString(cursorOn + altScreenOff)
+
+	err := term.Restore(int(t.in.Fd()), t.oldState)
+	if err != nil {
+		log.Warn("failed to restore the terminal:", err)
+	}
+}
+
+// Run shows the TUI until ctx is canceled or the user quits
+func (t *TUI) Run(ctx context.Context) {
+	keys := make(chan string, 16)
+	go readKeys(t.in, keys)
+
+	ticker := time.NewTicker(REFRESH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		t.draw()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.redraw:
+		case k := <-keys:
+			if !t.handleKey(k) {
+				return
+			}
+		}
+	}
+}
+
+func (t *TUI) requestRedraw() {
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// handles a key, and returns false if the user quits
+func (t *TUI) handleKey(k string) bool {
+	if k == keyCtrlC {
+		return false
+	}
+
+	t.status = ""
+
+	switch t.prompt {
+	case promptPool:
+		switch k {
+		case keyEscape:
+			t.prompt = promptNone
+		case keyEnter:
+			t.prompt = promptNone
+			t.switchPool(t.input)
+		case keyBackspace:
+			if r := []rune(t.input); len(r) > 0 {
+				t.input = string(r[:len(r)-1])
+			}
+		default:
+			if len([]rune(k)) == 1 {
+				t.input += k
+			}
+		}
+		return true
+	case promptKick:
+		t.prompt = promptNone
+		if k == "y" || k == "Y" {
+			t.kick(t.selected)
+		}
+		return true
+	}
+
+	workers := t.workers()
+	sel := indexOf(workers, t.selected)
+
+	switch k {
+	case "q", "Q":
+		return false
+	case keyUp:
+		sel--
+	case keyDown:
+		sel++
+	case keyPageUp:
+		sel -= 10
+	case keyPageDown:
+		sel += 10
+	case "s":
+		t.sortBy = (t.sortBy + 1) % numSortColumns
+	case "r":
+		t.sortDesc = !t.sortDesc
+	case "l":
+		t.minLevel = (t.minLevel + 1) % level(len(levelNames))
+	case "p":
+		t.prompt = promptPool
+		t.input = t.p.PoolAddress()
+	case "k":
+		if len(workers) == 0 {
+			t.status = "no worker to kick"
+		} else {
+			t.prompt = promptKick
+		}
+	}
+
+	if len(workers) > 0 && k != "s" && k != "r" {
+		sel = max(0, min(sel, len(workers)-1))
+		t.selected = workers[sel].Id
+	}
+
+	return true
+}
+
+// returns the workers, in the order of the table
+func (t *TUI) workers() []proxy.AdminConnection {
+	ws := t.p.Connections()
+	sortWorkers(ws, t.sortBy, t.sortDesc)
+	return ws
+}
+
+func (t *TUI) kick(id uint64) {
+	if t.p.Kick(id) {
+		t.status = "kicked the worker"
+		log.Info("kicked miner", id, "from the terminal UI")
+	} else {
+		t.status = "the worker is already disconnected"
+	}
+}
+
+func (t *TUI) switchPool(addr string) {
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.status = "invalid pool address: " + err.Error()
+		return
+	}
+
+	log.Info("switching to pool", addr, "from the terminal UI")
+	t.p.SetPoolAddress(addr)
+	t.status = "switching to pool " + addr
+}
@@ -0,0 +1,113 @@
+package tui
+
+import (
+	"reflect"
+	"testing"
+	"xatum-proxy/hashrate"
+	"xatum-proxy/log"
+	"xatum-proxy/proxy"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := map[string][]string{
+		"q":                {"q"},
+		"\033[A\033[B":     {keyUp, keyDown},
+		"\033OA":           {keyUp},
+		"\033[5~x\033[6~":  {keyPageUp, "x", keyPageDown},
+		"\033":             {keyEscape},
+		"ab\r\x7f\x03":     {"a", "b", keyEnter, keyBackspace, keyCtrlC},
+		"\033[1;5Cé":       {"é"},
+		"\x01":             {},
+		"xet:1.2.3.4:5209": {"x", "e", "t", ":", "1", ".", "2", ".", "3", ".", "4", ":", "5", "2", "0", "9"},
+	}
+
+	for in, exp := range tests {
+		keys := parseKeys([]byte(in))
+		if !reflect.DeepEqual(keys, exp) {
+			t.Fatalf("%q: expected %q, got %q", in, exp, keys)
+		}
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := &logBuffer{}
+	writes := 0
+	b.onWrite = func() {
+		writes++
+	}
+
+	b.Write([]byte("pool:52         [INFO]  connected\n"))
+	b.Write([]byte("pool:60         " + log.Yellow + "[WARN]  share rejected\n" + log.Reset))
+	b.Write([]byte("listen:10       " + log.Cyan + "[DEBUG] new "))
+	b.Write([]byte("connection\n" + log.Reset + log.Red + "[ERR]   failed\n"))
+	b.Write([]byte(log.Cyan + " Hashrate 1m: 0 H/s\n"))
+
+	if writes != 5 {
+		t.Fatalf("expected 5 writes, got %d", writes)
+	}
+
+	exp := []logLine{
+		{levelInfo, "pool:52         [INFO]  connected"},
+		{levelWarn, "pool:60         [WARN]  share rejected"},
+		{levelDebug, "listen:10       [DEBUG] new connection"},
+		{levelErr, "[ERR]   failed"},
+		{levelInfo, " Hashrate 1m: 0 H/s"},
+	}
+	if lines := b.Last(10, levelDebug); !reflect.DeepEqual(lines, exp) {
+		t.Fatalf("expected %q, got %q", exp, lines)
+	}
+
+	// the last lines with at least the warn level
+	if lines := b.Last(1, levelWarn); !reflect.DeepEqual(lines, exp[3:4]) {
+		t.Fatalf("expected %q, got %q", exp[3:4], lines)
+	}
+	if lines := b.Last(10, levelWarn); !reflect.DeepEqual(lines, []logLine{exp[1], exp[3]}) {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+
+	for i := 0; i < MAX_LOG_LINES; i++ {
+		b.Write([]byte("[INFO]  line\n"))
+	}
+	if n := len(b.Last(MAX_LOG_LINES*2, levelDebug)); n != MAX_LOG_LINES {
+		t.Fatalf("expected %d lines, got %d", MAX_LOG_LINES, n)
+	}
+}
+
+func TestSortWorkers(t *testing.T) {
+	ws := []proxy.AdminConnection{
+		{Id: 1, Protocol: "xatum", Worker: "b", Shares: 5, Hashrate: hashrate.Rates{M1: 100}},
+		{Id: 2, Protocol: "getwork", Worker: "a", Shares: 5, Hashrate: hashrate.Rates{M1: 300}},
+		{Id: 3, Protocol: "xatum", Worker: "c", Shares: 1, Hashrate: hashrate.Rates{M1: 200}},
+	}
+
+	ids := func() []uint64 {
+		res := make([]uint64, 0, len(ws))
+		for _, v := range ws {
+			res = append(res, v.Id)
+		}
+		return res
+	}
+
+	tests := []struct {
+		by   sortColumn
+		desc bool
+		exp  []uint64
+	}{
+		{sortHashrate, true, []uint64{2, 3, 1}},
+		{sortHashrate, false, []uint64{1, 3, 2}},
+		{sortShares, true, []uint64{1, 2, 3}}, // ties are sorted by id
+		{sortWorker, false, []uint64{2, 1, 3}},
+		{sortProtocol, false, []uint64{2, 1, 3}},
+	}
+
+	for _, v := range tests {
+		sortWorkers(ws, v.by, v.desc)
+		if !reflect.DeepEqual(ids(), v.exp) {
+			t.Fatalf("sort by %s (desc %v): expected %v, got %v", v.by, v.desc, v.exp, ids())
+		}
+	}
+
+	if indexOf(ws, 3) != 2 || indexOf(ws, 42) != 0 {
+		t.Fatal("unexpected index")
+	}
+}
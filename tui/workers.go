@@ -0,0 +1,83 @@
+package tui
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"xatum-proxy/proxy"
+)
+
+// Workers table
+
+type sortColumn uint8
+
+const (
+	sortHashrate sortColumn = iota
+	sortShares
+	sortWorker
+	sortIP
+	sortLastShare
+	sortProtocol
+
+	numSortColumns
+)
+
+var sortNames = [...]string{"hashrate", "shares", "worker", "ip", "last share", "protocol"}
+
+func (s sortColumn) String() string {
+	return sortNames[s]
+}
+
+func workerName(c proxy.AdminConnection) string {
+	if c.Worker == "" {
+		return "-"
+	}
+	return c.Worker
+}
+
+// sorts the workers by the given column, in ascending or descending order. Ties are sorted by id,
+// so the rows don't move between refreshes.
+func sortWorkers(ws []proxy.AdminConnection, by sortColumn, desc bool) {
+	slices.SortStableFunc(ws, func(a, b proxy.AdminConnection) int {
+		var c int
+		switch by {
+		case sortHashrate:
+			c = cmp.Compare(a.Hashrate.M1, b.Hashrate.M1)
+		case sortShares:
+			c = cmp.Compare(a.Shares, b.Shares)
+		case sortWorker:
+			c = strings.Compare(workerName(a)+a.Wallet, workerName(b)+b.Wallet)
+		case sortIP:
+			c = strings.Compare(a.IP, b.IP)
+		case sortLastShare:
+			c = cmp.Compare(a.LastShare, b.LastShare)
+		case sortProtocol:
+			c = strings.Compare(a.Protocol, b.Protocol)
+		}
+		if desc {
+			c = -c
+		}
+		if c == 0 {
+			c = cmp.Compare(a.Id, b.Id)
+		}
+		return c
+	})
+}
+
+// returns the index of the worker with the given id, or 0 if it isn't in the list anymore
+func indexOf(ws []proxy.AdminConnection, id uint64) int {
+	for i, v := range ws {
+		if v.Id == id {
+			return i
+		}
+	}
+	return 0
+}
+
+// shortens a wallet address to its prefix and its last characters
+func shortWallet(w string) string {
+	if len(w) <= 16 {
+		return w
+	}
+	return w[:8] + "…" + w[len(w)-6:]
+}
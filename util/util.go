@@ -3,12 +3,49 @@ package util
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"net"
+	"net/netip"
 	"strings"
 	"time"
 )
 
+// RemovePort returns the host of a host:port address. IPv6 addresses are returned without brackets.
+// Addresses without a port are returned as they are.
 func RemovePort(s string) string {
-	return strings.Split(s, ":")[0]
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	}
+	return host
+}
+
+// IPKey returns the key used for per-IP accounting: the address itself for IPv4, and the /64
+// prefix for IPv6, since a single host usually owns a whole /64.
+func IPKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	if addr.Is4() {
+		return addr.String()
+	}
+
+	prefix, err := addr.Prefix(64)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// ListenAddr splits a listen address into network and address. Addresses starting with "unix:" are
+// unix sockets, the others are TCP.
+func ListenAddr(s string) (network string, address string) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", s
 }
 
 func RandomUint64() uint64 {
@@ -0,0 +1,53 @@
+package util
+
+import "testing"
+
+func TestRemovePort(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4:5211":         "1.2.3.4",
+		"[2001:db8::1]:5211":   "2001:db8::1",
+		"[::1]:80":             "::1",
+		"1.2.3.4":              "1.2.3.4",
+		"2001:db8::1":          "2001:db8::1",
+		"[2001:db8::1]":        "2001:db8::1",
+		"example.com:443":      "example.com",
+		"@":                    "@",
+		"":                     "",
+		"[fe80::1%eth0]:12345": "fe80::1%eth0",
+	}
+
+	for in, expected := range tests {
+		if out := RemovePort(in); out != expected {
+			t.Errorf("RemovePort(%q) = %q, expected %q", in, out, expected)
+		}
+	}
+}
+
+func TestIPKey(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":              "1.2.3.4",
+		"::ffff:1.2.3.4":       "1.2.3.4",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"2001:db8:1:2:ffff::1": "2001:db8:1:2::/64",
+		"not an ip":            "not an ip",
+		"2001:db8:1:3:3:4:5:6": "2001:db8:1:3::/64",
+	}
+
+	for in, expected := range tests {
+		if out := IPKey(in); out != expected {
+			t.Errorf("IPKey(%q) = %q, expected %q", in, out, expected)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	network, addr := ListenAddr("unix:/run/xatum.sock")
+	if network != "unix" || addr != "/run/xatum.sock" {
+		t.Errorf("unexpected unix listen address %s %s", network, addr)
+	}
+
+	network, addr = ListenAddr("[::]:5211")
+	if network != "tcp" || addr != "[::]:5211" {
+		t.Errorf("unexpected tcp listen address %s %s", network, addr)
+	}
+}
@@ -0,0 +1,35 @@
+package xatum
+
+import "slices"
+
+// Protocol versions and extensions.
+// Legacy clients send a handshake without version, and never receive extension packets. Clients
+// with version 1 or newer send the extensions they support, and the server replies with a hello
+// packet with the extensions supported by both. Extensions are only used after the hello packet,
+// so clients connected to legacy servers, which don't send it, keep using the legacy protocol.
+
+const PROTOCOL_VERSION = 1
+
+const (
+	CapJobId       = "job_id"       // jobs have an ID, which is sent back with the shares
+	CapShareResult = "share_result" // shares have an ID, which is sent back with their result
+	CapDiff        = "diff"         // difficulty changes without a new job
+	CapReconnect   = "reconnect"    // the server can move the client to another address
+)
+
+// Negotiate returns the protocol version and extensions supported by both peers
+func Negotiate(version uint32, caps []string, localCaps []string) (uint32, []string) {
+	version = min(version, PROTOCOL_VERSION)
+
+	negotiated := make([]string, 0, len(caps))
+	if version == 0 {
+		return 0, negotiated
+	}
+
+	for _, v := range caps {
+		if slices.Contains(localCaps, v) && !slices.Contains(negotiated, v) {
+			negotiated = append(negotiated, v)
+		}
+	}
+	return version, negotiated
+}
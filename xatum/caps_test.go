@@ -0,0 +1,68 @@
+package xatum
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := []string{CapJobId, CapShareResult, CapDiff}
+
+	tests := []struct {
+		name     string
+		version  uint32
+		caps     []string
+		expected uint32
+		expCaps  []string
+	}{
+		{"legacy peer", 0, nil, 0, []string{}},
+		{"legacy peer with caps", 0, []string{CapDiff}, 0, []string{}},
+		{"v1 peer", 1, []string{CapDiff, CapJobId}, 1, []string{CapDiff, CapJobId}},
+		{"newer peer", 7, []string{CapJobId, "future_ext"}, PROTOCOL_VERSION, []string{CapJobId}},
+		{"duplicate caps", 1, []string{CapDiff, CapDiff}, 1, []string{CapDiff}},
+	}
+
+	for _, tt := range tests {
+		v, caps := Negotiate(tt.version, tt.caps, local)
+		if v != tt.expected || !slices.Equal(caps, tt.expCaps) {
+			t.Errorf("%s: got version %d caps %v, expected %d %v", tt.name, v, caps, tt.expected, tt.expCaps)
+		}
+	}
+}
+
+// packets without extensions must be identical to the legacy ones
+func TestLegacyPackets(t *testing.T) {
+	tests := []struct {
+		packet   any
+		expected string
+	}{
+		{C2S_Handshake{Addr: "xel:abc", Work: "x", Agent: "miner", Algos: []string{"xel/0"}},
+			`{"addr":"xel:abc","work":"x","agent":"miner","algos":["xel/0"]}`},
+		{C2S_Submit{Data: B64{1, 2}, Hash: "00"}, `{"data":"AQI=","hash":"00"}`},
+		{S2C_Success{Msg: "ok"}, `{"msg":"ok"}`},
+	}
+
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.expected {
+			t.Errorf("got %s, expected %s", data, tt.expected)
+		}
+	}
+}
+
+func TestLegacyHandshake(t *testing.T) {
+	h := C2S_Handshake{}
+	err := json.Unmarshal([]byte(`{"addr":"xel:abc","work":"x","agent":"miner","algos":["xel/0"]}`), &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, caps := Negotiate(h.Version, h.Caps, []string{CapJobId})
+	if v != 0 || len(caps) != 0 {
+		t.Fatalf("legacy handshake negotiated version %d caps %v", v, caps)
+	}
+}
@@ -2,9 +2,13 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -12,161 +16,419 @@ import (
 	"xatum-proxy/xatum"
 )
 
+// Xatum client library.
+// A Client is created with Dial, sends the handshake, and then Run reads the packets until the
+// context is canceled, the connection fails or the pool stops sending jobs. The handlers are called
+// from Run, so they must not block for long. Submit and Send can be called concurrently.
+// A Client can't be reused after Run returns: dial a new one to reconnect.
+
+const (
+	DEFAULT_DIAL_TIMEOUT  = 20 * time.Second
+	DEFAULT_READ_TIMEOUT  = time.Minute
+	DEFAULT_WRITE_TIMEOUT = 20 * time.Second
+	DEFAULT_JOB_TIMEOUT   = 10 * time.Minute
+)
+
+var (
+	// ErrClosed is returned after the client was closed with Close
+	ErrClosed = errors.New("client closed")
+	// ErrJobStall is returned by Run if no jobs are received for JobTimeout
+	ErrJobStall = errors.New("no jobs received from the pool")
+)
+
+// ProtocolError is returned by Run if the pool sends an invalid packet
+type ProtocolError struct {
+	Packet string
+	Err    error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("invalid %s packet: %s", e.Packet, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// RedirectError is returned by Run if the pool asked the client to reconnect
+type RedirectError struct {
+	Reconnect xatum.S2C_Reconnect
+	Address   string // address to reconnect to
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("pool asked to reconnect to %s in %d seconds", e.Address, e.Reconnect.Wait)
+}
+
+// extensions supported by the client
+var Capabilities = []string{
+	xatum.CapJobId,
+	xatum.CapShareResult,
+	xatum.CapDiff,
+	xatum.CapReconnect,
+}
+
+// Handlers are called by Run when the pool sends a packet. Nil handlers are ignored.
+type Handlers struct {
+	Job     func(xatum.S2C_Job)
+	Success func(xatum.S2C_Success)
+	Print   func(xatum.S2C_Print)
+}
+
 type Client struct {
 	PoolAddress string
-	conn        net.Conn
 
-	Alive bool
+	Handlers Handlers
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	JobTimeout   time.Duration // Run returns ErrJobStall if no jobs are received for this long
+
+	conn net.Conn
 
-	LastJob time.Time
+	closeOnce sync.Once
+	closed    chan struct{}
+	writeMut  sync.Mutex
 
-	Jobs    chan xatum.S2C_Job
-	Prints  chan xatum.S2C_Print
-	Success chan xatum.S2C_Success
+	lastJobTime time.Time
+
+	// negotiated with the hello packet, 0 and empty for legacy servers
+	version uint32
+	caps    []string
+
+	lastJob xatum.S2C_Job
 
 	sync.RWMutex
 }
 
-func NewClient(poolAddr string) (*Client, error) {
-	cl := &Client{
+// Dial connects to the pool
+func Dial(ctx context.Context, poolAddr string) (*Client, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{
+			Timeout: DEFAULT_DIAL_TIMEOUT,
+		},
+		Config: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", poolAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
 		PoolAddress: poolAddr,
 
-		Alive:   true,
-		LastJob: time.Now(),
+		ReadTimeout:  DEFAULT_READ_TIMEOUT,
+		WriteTimeout: DEFAULT_WRITE_TIMEOUT,
+		JobTimeout:   DEFAULT_JOB_TIMEOUT,
+
+		conn:   conn,
+		closed: make(chan struct{}),
+	}, nil
+}
 
-		Jobs:    make(chan xatum.S2C_Job, 1),
-		Prints:  make(chan xatum.S2C_Print, 1),
-		Success: make(chan xatum.S2C_Success, 1),
+// NewClient connects to the pool, see Dial
+func NewClient(poolAddr string) (*Client, error) {
+	return Dial(context.Background(), poolAddr)
+}
+
+// Run reads the packets from the pool and calls the handlers. It returns when ctx is canceled
+// (ctx.Err()), the client is closed (ErrClosed), the pool stops sending jobs (ErrJobStall), the
+// pool sends an invalid packet (*ProtocolError) or asks to reconnect (*RedirectError), or the
+// connection fails. The connection is always closed when Run returns.
+func (cl *Client) Run(ctx context.Context) error {
+	defer cl.Close()
+
+	cl.Lock()
+	cl.lastJobTime = time.Now()
+	cl.Unlock()
+
+	// the reason why the watchdog closed the connection
+	var cause error
+	var causeMut sync.Mutex
+
+	stop := func(err error) {
+		causeMut.Lock()
+		cause = err
+		causeMut.Unlock()
+		cl.Close()
 	}
 
-	conn, err := tls.Dial("tcp", cl.PoolAddress, &tls.Config{
-		InsecureSkipVerify: true,
-	})
-	cl.conn = conn
-	if err != nil {
-		log.Warnf("connection failed: %s", err)
-		return nil, err
+	done := make(chan struct{})
+	defer close(done)
+
+	go cl.watchdog(ctx, done, stop)
+
+	err := cl.readLoop()
+
+	causeMut.Lock()
+	defer causeMut.Unlock()
+
+	if cause != nil {
+		return cause
+	}
+
+	var redirect *RedirectError
+	var protoErr *ProtocolError
+	if cl.Closed() && !errors.As(err, &redirect) && !errors.As(err, &protoErr) {
+		return ErrClosed
 	}
+	return err
+}
+
+// closes the connection if ctx is canceled or the pool stops sending jobs
+func (cl *Client) watchdog(ctx context.Context, done chan struct{}, stop func(error)) {
+	timer := time.NewTimer(cl.JobTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			stop(ctx.Err())
+			return
+		case <-timer.C:
+			remaining := cl.JobTimeout - time.Since(cl.LastJob())
 
-	return cl, nil
+			if remaining <= 0 {
+				log.Errf("no jobs received in the last %s, reconnecting", cl.JobTimeout)
+				stop(ErrJobStall)
+				return
+			}
+			timer.Reset(remaining)
+		}
+	}
 }
 
-// Client must NOT be locked before calling this
-func (cl *Client) Connect() {
+func (cl *Client) readLoop() error {
 	rdr := bufio.NewReader(cl.conn)
 	for {
-		cl.conn.SetReadDeadline(time.Now().Add(time.Minute))
+		cl.conn.SetReadDeadline(time.Now().Add(cl.ReadTimeout))
 
 		str, err := rdr.ReadString('\n')
-
 		if err != nil {
 			log.Warnf("connection closed: %s", err)
-			cl.Close()
-			return
+			return err
 		}
 		log.Net("<<<", str)
 
-		spl := strings.SplitN(str, "~", 2)
-		if spl == nil || len(spl) < 2 {
+		spl := strings.SplitN(strings.TrimSuffix(str, "\n"), "~", 2)
+		if len(spl) < 2 {
 			log.Warn("packet data is malformed")
 			continue
 		}
 
-		pack := spl[0]
+		err = cl.handlePacket(spl[0], []byte(spl[1]))
+		if err != nil {
+			cl.Close()
+			return err
+		}
+	}
+}
 
-		cl.Lock()
-		if pack != xatum.PacketS2C_Job && time.Since(cl.LastJob) > 10*time.Minute {
-			log.Err("no jobs received in the last minute, reconnecting")
+func (cl *Client) handlePacket(pack string, data []byte) error {
+	switch {
+	case pack == xatum.PacketS2C_Job:
+		pData := xatum.S2C_Job{}
+		err := json.Unmarshal(data, &pData)
+		if err != nil {
+			return &ProtocolError{pack, err}
+		}
 
-			cl.Close()
-			cl.Unlock()
-			return
+		cl.onJob(pData)
+	case pack == xatum.PacketS2C_Hello:
+		pData := xatum.S2C_Hello{}
+		err := json.Unmarshal(data, &pData)
+		if err != nil {
+			return &ProtocolError{pack, err}
 		}
+
+		// the server can't enable extensions which the client didn't ask for
+		version, caps := xatum.Negotiate(pData.Version, pData.Caps, Capabilities)
+
+		log.Debugf("negotiated protocol version %d, extensions %v", version, caps)
+
+		cl.Lock()
+		cl.version = version
+		cl.caps = caps
 		cl.Unlock()
+	case pack == xatum.PacketS2C_Diff && cl.Has(xatum.CapDiff):
+		pData := xatum.S2C_Diff{}
+		err := json.Unmarshal(data, &pData)
+		if err != nil {
+			return &ProtocolError{pack, err}
+		}
 
-		if pack == xatum.PacketS2C_Job {
-			pData := xatum.S2C_Job{}
+		// a difficulty change is handled as a copy of the last job with the new difficulty
+		cl.RLock()
+		job := cl.lastJob
+		cl.RUnlock()
 
-			err := json.Unmarshal([]byte(spl[1]), &pData)
-			if err != nil {
-				log.Warn("failed to parse data")
-				cl.Close()
-				return
-			}
+		if job.Blob == nil || (pData.Job != "" && pData.Job != job.Id) {
+			log.Debug("received a difficulty change for an unknown job")
+			return nil
+		}
 
-			log.Debug("ok, job received, sending to channel")
+		job.Diff = pData.Diff
+		cl.onJob(job)
+	case pack == xatum.PacketS2C_Reconnect && cl.Has(xatum.CapReconnect):
+		pData := xatum.S2C_Reconnect{}
+		err := json.Unmarshal(data, &pData)
+		if err != nil {
+			return &ProtocolError{pack, err}
+		}
 
-			cl.Jobs <- pData
-			cl.Lock()
-			cl.LastJob = time.Now()
-			cl.Unlock()
+		return &RedirectError{
+			Reconnect: pData,
+			Address:   pData.Address(cl.PoolAddress),
+		}
+	case pack == xatum.PacketS2C_Print:
+		pData := xatum.S2C_Print{}
+		err := json.Unmarshal(data, &pData)
+		if err != nil {
+			return &ProtocolError{pack, err}
+		}
 
-			log.Debug("ok, done sending to channel")
-		} else if pack == xatum.PacketS2C_Print {
-			pData := xatum.S2C_Print{}
-			err := json.Unmarshal([]byte(spl[1]), &pData)
-			if err != nil {
-				log.Warn("failed to parse data")
-				cl.Close()
-				return
-			}
+		const PREFIX = "message from pool:"
 
-			const PREFIX = "message from pool:"
+		switch pData.Lvl {
+		case 1:
+			log.Infof(PREFIX+" %s", pData.Msg)
+		case 2:
+			log.Warnf(PREFIX+" %s", pData.Msg)
+		case 3:
+			log.Errf(PREFIX+" %s", pData.Msg)
+		}
 
-			switch pData.Lvl {
-			case 1:
-				log.Infof(PREFIX+" %s", pData.Msg)
-			case 2:
-				log.Warnf(PREFIX+" %s", pData.Msg)
-			case 3:
-				log.Errf(PREFIX+" %s", pData.Msg)
-			}
+		if cl.Handlers.Print != nil {
+			cl.Handlers.Print(pData)
+		}
+	case pack == xatum.PacketS2C_Success:
+		pData := xatum.S2C_Success{}
+		err := json.Unmarshal(data, &pData)
+		if err != nil {
+			return &ProtocolError{pack, err}
+		}
 
-		} else if pack == xatum.PacketS2C_Ping {
-			cl.Send("pong", map[string]any{})
-		} else {
-			log.Warnf("Unknown packet %s", pack)
+		if cl.Handlers.Success != nil {
+			cl.Handlers.Success(pData)
 		}
+	case pack == xatum.PacketS2C_Ping:
+		err := cl.Send(xatum.PacketC2S_Pong, map[string]any{})
+		if err != nil {
+			log.Warn("failed to send pong:", err)
+		}
+	default:
+		log.Warnf("Unknown packet %s", pack)
+	}
 
+	return nil
+}
+
+func (cl *Client) onJob(job xatum.S2C_Job) {
+	cl.Lock()
+	cl.lastJobTime = time.Now()
+	cl.lastJob = job
+	cl.Unlock()
+
+	if cl.Handlers.Job != nil {
+		cl.Handlers.Job(job)
 	}
+}
+
+// Handshake sends the handshake packet, asking for the client's extensions
+func (cl *Client) Handshake(h xatum.C2S_Handshake) error {
+	h.Version = xatum.PROTOCOL_VERSION
+	h.Caps = Capabilities
 
+	return cl.Send(xatum.PacketC2S_Handshake, h)
 }
 
-// Client MUST be locked before calling this
-func (cl *Client) Close() {
-	err := cl.conn.Close()
-	if err != nil {
-		log.Debug("cl.conn.Close failed:", err)
+// Has returns true if the extension was negotiated with the server
+func (cl *Client) Has(capability string) bool {
+	cl.RLock()
+	defer cl.RUnlock()
+	return slices.Contains(cl.caps, capability)
+}
+
+// Version returns the negotiated protocol version, 0 for legacy servers
+func (cl *Client) Version() uint32 {
+	cl.RLock()
+	defer cl.RUnlock()
+	return cl.version
+}
+
+// Caps returns the negotiated extensions
+func (cl *Client) Caps() []string {
+	cl.RLock()
+	defer cl.RUnlock()
+	return slices.Clone(cl.caps)
+}
+
+// LastJob returns the time of the last job received
+func (cl *Client) LastJob() time.Time {
+	cl.RLock()
+	defer cl.RUnlock()
+	return cl.lastJobTime
+}
+
+// Close closes the connection, making Run return. It can be called more than once.
+func (cl *Client) Close() error {
+	err := ErrClosed
+	cl.closeOnce.Do(func() {
+		close(cl.closed)
+		err = cl.conn.Close()
+	})
+	return err
+}
+
+// Closed returns true if the client was closed
+func (cl *Client) Closed() bool {
+	select {
+	case <-cl.closed:
+		return true
+	default:
+		return false
 	}
-	close(cl.Jobs)
-	close(cl.Prints)
-	close(cl.Success)
-	cl.Alive = false
 }
 
-// Client MUST be locked before calling this
-func (c *Client) Send(name string, a any) error {
+// Send sends a packet. It's safe for concurrent use.
+func (cl *Client) Send(name string, a any) error {
 	data, err := json.Marshal(a)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	c.SendBytes(append([]byte(name+"~"), data...))
-	return nil
+	return cl.SendBytes(append([]byte(name+"~"), data...))
 }
 
-// Client MUST be locked before calling this
+// SendBytes sends a raw packet. It's safe for concurrent use.
 func (cl *Client) SendBytes(data []byte) error {
+	if cl.Closed() {
+		return ErrClosed
+	}
+
 	log.Net(">>>", string(data))
 
-	_, err := cl.conn.Write(append(data, '\n'))
-	if err != nil {
-		return err
-	}
+	cl.writeMut.Lock()
+	defer cl.writeMut.Unlock()
 
-	return nil
+	cl.conn.SetWriteDeadline(time.Now().Add(cl.WriteTimeout))
+	_, err := cl.conn.Write(append(data, '\n'))
+	return err
 }
 
+// Submit sends a share, removing the fields of the extensions which the server doesn't support.
+// It's safe for concurrent use.
 func (cl *Client) Submit(pack xatum.C2S_Submit) error {
+	if !cl.Has(xatum.CapJobId) {
+		pack.Job = ""
+	}
+	if !cl.Has(xatum.CapShareResult) {
+		pack.Id = 0
+	}
 
 	return cl.Send(xatum.PacketC2S_Submit, pack)
 }
@@ -0,0 +1,444 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"xatum-proxy/xatum"
+	"xatum-proxy/xatum/server"
+)
+
+// fakeServer is a scripted Xatum server, speaking either the legacy protocol or version 1
+type fakeServer struct {
+	listener net.Listener
+	conns    chan *fakeConn
+}
+
+type fakeConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	// the certificate is written to a temporary directory, like the proxy's CertDir
+	cert, err := server.LoadCertificate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{
+		listener: l,
+		conns:    make(chan *fakeConn, 1),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// the client's dial returns after the TLS handshake
+			go func() {
+				err := c.(*tls.Conn).Handshake()
+				if err != nil {
+					c.Close()
+					return
+				}
+				s.conns <- &fakeConn{Conn: c, rdr: bufio.NewReader(c)}
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	return s
+}
+
+func (s *fakeServer) accept(t *testing.T) *fakeConn {
+	select {
+	case c := <-s.conns:
+		t.Cleanup(func() {
+			c.Close()
+		})
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the client")
+		return nil
+	}
+}
+
+func (c *fakeConn) read(t *testing.T, name string, v any) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	str, err := c.rdr.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spl := strings.SplitN(strings.TrimSpace(str), "~", 2)
+	if len(spl) != 2 || spl[0] != name {
+		t.Fatalf("expected packet %s, got %q", name, str)
+	}
+
+	err = json.Unmarshal([]byte(spl[1]), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *fakeConn) send(t *testing.T, name string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write(append([]byte(name+"~"), append(data, '\n')...))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testClient struct {
+	*Client
+
+	jobs    chan xatum.S2C_Job
+	results chan xatum.S2C_Success
+	errs    chan error
+	cancel  context.CancelFunc
+}
+
+// connects a client to the fake server, and runs it in the background
+func connect(t *testing.T, s *fakeServer, setup ...func(*Client)) (*testClient, *fakeConn) {
+	cl, err := Dial(context.Background(), s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testClient{
+		Client:  cl,
+		jobs:    make(chan xatum.S2C_Job, 10),
+		results: make(chan xatum.S2C_Success, 10),
+		errs:    make(chan error, 1),
+	}
+	cl.Handlers = Handlers{
+		Job: func(job xatum.S2C_Job) {
+			tc.jobs <- job
+		},
+		Success: func(res xatum.S2C_Success) {
+			tc.results <- res
+		},
+	}
+	for _, f := range setup {
+		f(cl)
+	}
+
+	err = cl.Handshake(xatum.C2S_Handshake{
+		Addr:  "xel:test",
+		Work:  "x",
+		Agent: "test",
+		Algos: []string{"xel/0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tc.cancel = cancel
+	go func() {
+		tc.errs <- cl.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		cl.Close()
+	})
+
+	c := s.accept(t)
+
+	shake := xatum.C2S_Handshake{}
+	c.read(t, xatum.PacketC2S_Handshake, &shake)
+	if shake.Version != xatum.PROTOCOL_VERSION || len(shake.Caps) == 0 {
+		t.Fatalf("client didn't announce its version: %+v", shake)
+	}
+
+	return tc, c
+}
+
+func (tc *testClient) recvJob(t *testing.T) xatum.S2C_Job {
+	select {
+	case job := <-tc.jobs:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for a job")
+		return xatum.S2C_Job{}
+	}
+}
+
+func (tc *testClient) wait(t *testing.T) error {
+	select {
+	case err := <-tc.errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Run to return")
+		return nil
+	}
+}
+
+func TestLegacyServer(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	// legacy servers reply with a job, without hello
+	c.send(t, xatum.PacketS2C_Job, xatum.S2C_Job{Diff: 100, Blob: make([]byte, 112)})
+	job := cl.recvJob(t)
+	if job.Diff != 100 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if cl.Version() != 0 || cl.Has(xatum.CapJobId) {
+		t.Fatalf("extensions enabled with a legacy server: version %d caps %v", cl.Version(), cl.Caps())
+	}
+
+	// extension fields are not sent to legacy servers
+	err := cl.Submit(xatum.C2S_Submit{Data: []byte{1}, Hash: "00", Job: "1", Id: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := map[string]any{}
+	c.read(t, xatum.PacketC2S_Submit, &sub)
+	if _, ok := sub["job"]; ok {
+		t.Fatalf("job ID sent to a legacy server: %v", sub)
+	}
+	if _, ok := sub["id"]; ok {
+		t.Fatalf("share ID sent to a legacy server: %v", sub)
+	}
+
+	// pings are answered
+	c.send(t, xatum.PacketS2C_Ping, map[string]any{})
+	c.read(t, xatum.PacketC2S_Pong, &map[string]any{})
+}
+
+func TestV1Server(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	// the server can't enable extensions which the client doesn't support
+	c.send(t, xatum.PacketS2C_Hello, xatum.S2C_Hello{
+		Version: 1,
+		Caps:    []string{xatum.CapJobId, xatum.CapShareResult, xatum.CapDiff, "unknown"},
+	})
+	c.send(t, xatum.PacketS2C_Job, xatum.S2C_Job{Diff: 100, Blob: make([]byte, 112), Id: "a"})
+
+	job := cl.recvJob(t)
+	if job.Id != "a" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if cl.Version() != 1 || len(cl.Caps()) != 3 {
+		t.Fatalf("unexpected negotiation: version %d caps %v", cl.Version(), cl.Caps())
+	}
+
+	// difficulty changes are received as a copy of the last job
+	c.send(t, xatum.PacketS2C_Diff, xatum.S2C_Diff{Diff: 200, Job: "a"})
+	job = cl.recvJob(t)
+	if job.Id != "a" || job.Diff != 200 || len(job.Blob) != 112 {
+		t.Fatalf("unexpected job after difficulty change %+v", job)
+	}
+
+	err := cl.Submit(xatum.C2S_Submit{Data: []byte{1}, Hash: "00", Job: "a", Id: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := xatum.C2S_Submit{}
+	c.read(t, xatum.PacketC2S_Submit, &sub)
+	if sub.Job != "a" || sub.Id != 5 {
+		t.Fatalf("unexpected submit %+v", sub)
+	}
+
+	c.send(t, xatum.PacketS2C_Success, xatum.S2C_Success{Msg: "ok", Id: 5})
+	select {
+	case res := <-cl.results:
+		if res.Id != 5 {
+			t.Fatalf("unexpected share result %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the share result")
+	}
+}
+
+func TestDiffWithoutNegotiation(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	c.send(t, xatum.PacketS2C_Job, xatum.S2C_Job{Diff: 100, Blob: make([]byte, 112)})
+	cl.recvJob(t)
+
+	// a difficulty change without hello is ignored
+	c.send(t, xatum.PacketS2C_Diff, xatum.S2C_Diff{Diff: 200})
+	c.send(t, xatum.PacketS2C_Job, xatum.S2C_Job{Diff: 300, Blob: make([]byte, 112)})
+
+	job := cl.recvJob(t)
+	if job.Diff != 300 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	c.send(t, xatum.PacketS2C_Hello, xatum.S2C_Hello{
+		Version: 1,
+		Caps:    []string{xatum.CapReconnect},
+	})
+	c.send(t, xatum.PacketS2C_Reconnect, xatum.S2C_Reconnect{Host: "eu.example.com", Wait: 5})
+
+	var redirect *RedirectError
+	err := cl.wait(t)
+	if !errors.As(err, &redirect) {
+		t.Fatalf("expected a redirect, got %v", err)
+	}
+	if redirect.Reconnect.Wait != 5 || !strings.HasPrefix(redirect.Address, "eu.example.com:") {
+		t.Fatalf("unexpected redirect %+v", redirect)
+	}
+	if !cl.Closed() {
+		t.Fatal("client is not closed after Run returned")
+	}
+}
+
+func TestReconnectWithoutNegotiation(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	c.send(t, xatum.PacketS2C_Reconnect, xatum.S2C_Reconnect{Host: "eu.example.com"})
+	c.send(t, xatum.PacketS2C_Job, xatum.S2C_Job{Diff: 100, Blob: make([]byte, 112)})
+
+	cl.recvJob(t)
+	if cl.Closed() {
+		t.Fatal("reconnect accepted without negotiation")
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	s := newFakeServer(t)
+	cl, _ := connect(t, s)
+
+	cl.cancel()
+
+	err := cl.wait(t)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestJobStall(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s, func(cl *Client) {
+		cl.JobTimeout = 300 * time.Millisecond
+	})
+
+	// jobs keep the connection alive
+	for i := 0; i < 3; i++ {
+		c.send(t, xatum.PacketS2C_Job, xatum.S2C_Job{Diff: 100, Blob: make([]byte, 112)})
+		cl.recvJob(t)
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	// other packets don't
+	go func() {
+		for i := 0; i < 10; i++ {
+			data, _ := json.Marshal(xatum.S2C_Print{Msg: "hi", Lvl: 0})
+			c.Write(append([]byte(xatum.PacketS2C_Print+"~"), append(data, '\n')...))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	err := cl.wait(t)
+	if !errors.Is(err, ErrJobStall) {
+		t.Fatalf("expected ErrJobStall, got %v", err)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	c.Write([]byte(xatum.PacketS2C_Job + "~{\"diff\":\"a lot\"}\n"))
+
+	var protoErr *ProtocolError
+	err := cl.wait(t)
+	if !errors.As(err, &protoErr) || protoErr.Packet != xatum.PacketS2C_Job {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	c.Close()
+
+	err := cl.wait(t)
+	if err == nil || errors.Is(err, ErrClosed) {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newFakeServer(t)
+	cl, _ := connect(t, s)
+
+	if err := cl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// closing twice is harmless
+	if err := cl.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	if err := cl.wait(t); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed from Run, got %v", err)
+	}
+	if err := cl.Submit(xatum.C2S_Submit{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed from Submit, got %v", err)
+	}
+}
+
+func TestConcurrentSubmit(t *testing.T) {
+	s := newFakeServer(t)
+	cl, c := connect(t, s)
+
+	const SHARES = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < SHARES; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cl.Submit(xatum.C2S_Submit{Data: make([]byte, 112), Hash: strings.Repeat("0", 64)})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// every packet must be received whole
+	for i := 0; i < SHARES; i++ {
+		sub := xatum.C2S_Submit{}
+		c.read(t, xatum.PacketC2S_Submit, &sub)
+		if len(sub.Data) != 112 {
+			t.Fatalf("corrupted share %+v", sub)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,24 @@
+package xatum
+
+import (
+	"net"
+	"strconv"
+)
+
+// Address returns the address to reconnect to. The host and port which are not set are taken from
+// the current address.
+func (r S2C_Reconnect) Address(current string) string {
+	host, port, err := net.SplitHostPort(current)
+	if err != nil {
+		host = current
+	}
+
+	if r.Host != "" {
+		host = r.Host
+	}
+	if r.Port != 0 {
+		port = strconv.FormatUint(uint64(r.Port), 10)
+	}
+
+	return net.JoinHostPort(host, port)
+}
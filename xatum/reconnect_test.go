@@ -0,0 +1,24 @@
+package xatum
+
+import "testing"
+
+func TestReconnectAddress(t *testing.T) {
+	tests := []struct {
+		r        S2C_Reconnect
+		current  string
+		expected string
+	}{
+		{S2C_Reconnect{}, "pool.example.com:6969", "pool.example.com:6969"},
+		{S2C_Reconnect{Host: "eu.example.com"}, "pool.example.com:6969", "eu.example.com:6969"},
+		{S2C_Reconnect{Port: 7000}, "pool.example.com:6969", "pool.example.com:7000"},
+		{S2C_Reconnect{Host: "2001:db8::1", Port: 7000}, "pool.example.com:6969", "[2001:db8::1]:7000"},
+		{S2C_Reconnect{Host: "eu.example.com"}, "[2001:db8::1]:6969", "eu.example.com:6969"},
+	}
+
+	for _, tt := range tests {
+		addr := tt.r.Address(tt.current)
+		if addr != tt.expected {
+			t.Errorf("%+v.Address(%q) = %q, expected %q", tt.r, tt.current, addr, tt.expected)
+		}
+	}
+}
@@ -3,14 +3,55 @@ package server
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"math/big"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
+	"xatum-proxy/log"
 )
 
+var certMut sync.Mutex
+
+// LoadCertificate loads cert.pem and key.pem from dir, generating them if they don't exist.
+// An empty dir is the working directory.
+func LoadCertificate(dir string) (tls.Certificate, error) {
+	certMut.Lock()
+	defer certMut.Unlock()
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		return cert, nil
+	}
+
+	log.Info("generating a new TLS certificate: no cert file found:", err)
+
+	certPem, keyPem, err := GenCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	err = os.WriteFile(keyFile, keyPem, 0o600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = os.WriteFile(certFile, certPem, 0o600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
+// GenCertificate generates a self-signed certificate, and returns the certificate and the key in
+// PEM format
 func GenCertificate() ([]byte, []byte, error) {
 	pubkey, key, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -53,9 +94,5 @@ func GenCertificate() ([]byte, []byte, error) {
 			Bytes: derBytes,
 		},
 	)
-	err = os.WriteFile("key.pem", keyPem, 0o600)
-	if err != nil {
-		return []byte{}, []byte{}, err
-	}
-	return certPem, keyPem, os.WriteFile("cert.pem", certPem, 0o600)
+	return certPem, keyPem, nil
 }
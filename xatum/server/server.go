@@ -3,11 +3,15 @@ package server
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"net"
-	"strconv"
+	"net/netip"
+	"slices"
 	"sync"
 	"time"
+	"xatum-proxy/agent"
 	"xatum-proxy/log"
+	"xatum-proxy/proxyproto"
 	"xatum-proxy/util"
 	"xatum-proxy/xatum"
 	"xatum-proxy/xelisutil"
@@ -21,6 +25,20 @@ type Server struct {
 
 	NewConnections chan *Connection
 
+	bans    map[string]time.Time // banned IP -> ban expiration, zero if the ban is permanent
+	bansMut sync.RWMutex
+
+	// if ProxyProtocol is true, the PROXY protocol header is parsed on connections from
+	// TrustedProxies
+	ProxyProtocol  bool
+	TrustedProxies []netip.Prefix
+
+	// directory of cert.pem and key.pem, the working directory if empty
+	CertDir string
+
+	listeners []net.Listener
+	closed    chan struct{}
+
 	sync.RWMutex
 }
 
@@ -32,21 +50,42 @@ type Connection struct {
 	LastJob    ConnJob
 
 	LastShare time.Time // in unix milliseconds
+	Shares    uint64
 	Score     int32
 	Wallet    string
+	Worker    string
+	Agent     string
+	Diff      uint64   // difficulty set by the proxy operator, 0 to use the pool's difficulty
+	Algos     []string // algorithms supported by both the miner and the proxy
+	XnSlice   []byte   // extra nonce slice delegated to a downstream proxy, nil for miners
+	Version   uint32   // negotiated protocol version
+	Caps      []string // negotiated extensions
+	Quirks    agent.Quirks
 
 	sync.RWMutex
 }
 
 type ConnJob struct {
-	Diff uint64
+	Id       string
+	Diff     uint64
+	Algo     string
+	XnPrefix uint8 // extra nonce bytes the miner can't change
+	Height   uint64
+	NetDiff  uint64 // difficulty of the network, 0 if unknown
 
 	BlockMiner xelisutil.BlockMiner
 
 	SubmittedNonces []uint64
+
+	Upstream uint64 // the proxy's upstream which sent the job
 }
 
 func (c *Connection) Send(name string, a any) error {
+	if name == xatum.PacketS2C_Print && c.Quirks.NoPrint {
+		log.Debugf("not sending print packet to miner with ID %d, which mishandles them", c.Id)
+		return nil
+	}
+
 	data, err := json.Marshal(a)
 	if err != nil {
 		panic(err)
@@ -66,54 +105,207 @@ func (c *Connection) SendJob(job xatum.S2C_Job) {
 	c.Send(xatum.PacketS2C_Job, job)
 }
 
-func (s *Server) Start(port uint16) {
-	s.NewConnections = make(chan *Connection, 1)
-	s.connsPerIp = make(map[string]uint32, 100)
+// Has returns true if the extension was negotiated with the miner
+// Connection MUST be locked before calling this
+func (c *Connection) Has(capability string) bool {
+	return slices.Contains(c.Caps, capability)
+}
+
+func NewServer() *Server {
+	return &Server{
+		NewConnections: make(chan *Connection, 1),
+		connsPerIp:     make(map[string]uint32, 100),
+		bans:           make(map[string]time.Time),
+		closed:         make(chan struct{}),
+	}
+}
 
-	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
+// Listen listens on all the given addresses. Addresses are either host:port (IPv4 or IPv6) or
+// unix:/path/to/socket.
+func (s *Server) Listen(addrs []string) error {
+	cert, err := LoadCertificate(s.CertDir)
 	if err != nil {
-		log.Info("generating a new TLS certificate: no cert file found:", err)
+		return err
+	}
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{
+			cert,
+		},
+	}
 
-		certPem, keyPem, err := GenCertificate()
+	for _, addr := range addrs {
+		network, address := util.ListenAddr(addr)
+
+		listener, err := net.Listen(network, address)
 		if err != nil {
-			log.Fatal(err)
+			s.Close()
+			return err
 		}
 
-		cert, err = tls.X509KeyPair(certPem, keyPem)
-		if err != nil {
-			log.Fatal(err)
+		if s.ProxyProtocol {
+			listener = proxyproto.NewListener(listener, s.TrustedProxies)
 		}
 
+		log.Info("Xatum server listening on", addr)
+
+		s.Lock()
+		s.listeners = append(s.listeners, tls.NewListener(listener, tlsConf))
+		s.Unlock()
 	}
 
-	listener, err := tls.Listen("tcp", "0.0.0.0:"+strconv.FormatUint(uint64(port), 10), &tls.Config{
-		Certificates: []tls.Certificate{
-			cert,
-		},
-	})
-	if err != nil {
-		log.Fatal(err)
+	return nil
+}
+
+// Serve accepts the connections on the listeners, and blocks until the server is closed
+func (s *Server) Serve() {
+	var wg sync.WaitGroup
+
+	s.RLock()
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acceptLoop(l)
+		}()
+	}
+	s.RUnlock()
+
+	wg.Wait()
+}
+
+// Close closes the listeners and all the connections
+// this function locks Server
+func (s *Server) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+
+	var err error
+	for _, l := range s.listeners {
+		err = errors.Join(err, l.Close())
+	}
+	s.listeners = nil
+
+	for _, v := range s.Connections {
+		v.Conn.Close()
 	}
+	s.Connections = nil
+	clear(s.connsPerIp)
 
-	log.Info("Xatum server listening on port", port)
+	return err
+}
+
+// Closed returns a channel which is closed when the server is closed
+func (s *Server) Closed() <-chan struct{} {
+	return s.closed
+}
 
+func (s *Server) acceptLoop(listener net.Listener) {
 	for {
 		c, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Err(err)
 			continue
 		}
-		minerIp := util.RemovePort(c.RemoteAddr().String())
 
-		log.Debug("new incoming connection with IP", minerIp)
+		// the remote address may have to be read from the PROXY protocol header, so it is
+		// checked outside of the accept loop
+		go func() {
+			minerIp := util.RemovePort(c.RemoteAddr().String())
+
+			if s.IsBanned(minerIp) {
+				log.Debug("refusing connection from banned IP", minerIp)
+				c.Close()
+				return
+			}
+
+			log.Debug("new incoming connection with IP", minerIp)
+
+			conn := &Connection{
+				Conn:      c,
+				Id:        util.RandomUint64(),
+				LastShare: time.Now(),
+			}
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// Ban refuses new connections from ip for the given duration (forever if 0), and kicks the
+// existing ones. ip can also be an IPv6 /64 prefix, like "2001:db8::/64".
+// this function locks Server
+func (s *Server) Ban(ip string, d time.Duration) {
+	s.bansMut.Lock()
+	if s.bans == nil {
+		s.bans = make(map[string]time.Time)
+	}
+	if d == 0 {
+		s.bans[ip] = time.Time{}
+	} else {
+		s.bans[ip] = time.Now().Add(d)
+	}
+	s.bansMut.Unlock()
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, v := range s.Connections {
+		connIp := util.RemovePort(v.Conn.RemoteAddr().String())
+		if connIp == ip || util.IPKey(connIp) == ip {
+			s.Kick(v.Id)
+		}
+	}
+}
+
+// Unban removes the ban on ip, and returns false if it wasn't banned
+func (s *Server) Unban(ip string) bool {
+	s.bansMut.Lock()
+	defer s.bansMut.Unlock()
+
+	_, ok := s.bans[ip]
+	delete(s.bans, ip)
+	return ok
+}
+
+// IsBanned returns true if ip, or its IPv6 /64 prefix, is currently banned. Expired bans are
+// removed.
+func (s *Server) IsBanned(ip string) bool {
+	s.bansMut.Lock()
+	defer s.bansMut.Unlock()
 
-		conn := &Connection{
-			Conn:      c,
-			Id:        util.RandomUint64(),
-			LastShare: time.Now(),
+	for _, k := range []string{ip, util.IPKey(ip)} {
+		exp, ok := s.bans[k]
+		if !ok {
+			continue
+		}
+		if !exp.IsZero() && time.Now().After(exp) {
+			delete(s.bans, k)
+			continue
 		}
-		go s.handleConnection(conn)
+		return true
 	}
+	return false
+}
+
+// Bans returns a copy of the ban list
+func (s *Server) Bans() map[string]time.Time {
+	s.bansMut.RLock()
+	defer s.bansMut.RUnlock()
+
+	bans := make(map[string]time.Time, len(s.bans))
+	for k, v := range s.bans {
+		bans[k] = v
+	}
+	return bans
 }
 
 // Server MUST be locked before calling this
@@ -124,7 +316,7 @@ func (s *Server) Kick(id uint64) {
 		if v.Id == id {
 			v.Conn.Close()
 
-			ipAddr := util.RemovePort(v.Conn.RemoteAddr().String())
+			ipAddr := util.IPKey(util.RemovePort(v.Conn.RemoteAddr().String()))
 
 			if s.connsPerIp[ipAddr] > 0 {
 				s.connsPerIp[ipAddr]--
@@ -144,7 +336,7 @@ func (srv *Server) handleConnection(conn *Connection) {
 	srv.Lock()
 	defer srv.Unlock()
 
-	ipAddr := util.RemovePort(conn.Conn.RemoteAddr().String())
+	ipAddr := util.IPKey(util.RemovePort(conn.Conn.RemoteAddr().String()))
 
 	if srv.connsPerIp[ipAddr] > MAX_CONNECTIONS_PER_IP {
 		log.Debug("address", ipAddr, "reached connections per IP limit")
@@ -157,5 +349,9 @@ func (srv *Server) handleConnection(conn *Connection) {
 	srv.Connections = append(srv.Connections, conn)
 	log.Debug("handling connection")
 
-	srv.NewConnections <- conn
+	select {
+	case srv.NewConnections <- conn:
+	case <-srv.closed:
+		conn.Conn.Close()
+	}
 }
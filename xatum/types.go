@@ -8,27 +8,74 @@ const (
 	PacketS2C_Print     = "print"
 	PacketS2C_Ping      = "ping"
 	PacketC2S_Pong      = "pong"
+
+	// extensions, only sent to peers which negotiated them (see caps.go)
+	PacketS2C_Hello     = "hello"
+	PacketS2C_Diff      = "diff"
+	PacketS2C_Reconnect = "reconnect"
 )
 
+// Extra nonce delegation, for proxies connected to other proxies:
+// a client which wants its own slice of the extra nonce sends xn_bytes in the handshake. The
+// server then fixes the first xn_prefix bytes of the extra nonce in the jobs, and the client can
+// only change the bytes after them. The slice delegated to the client is the last xn_bytes of the
+// prefix, so each hop is identified by its slice.
+// Servers which don't send xn_prefix fix the first DEFAULT_XN_PREFIX bytes.
+const DEFAULT_XN_PREFIX = 28
+
+// MIN_XN_FREE is the number of extra nonce bytes a slice must leave free, so the client can give
+// distinct extra nonces to its own miners
+const MIN_XN_FREE = 2
+
 type C2S_Handshake struct {
-	Addr  string   `json:"addr"`  // wallet address
-	Work  string   `json:"work"`  // worker name, by default "x"
-	Agent string   `json:"agent"` // the mining software
-	Algos []string `json:"algos"` // list of supported algorithms
+	Addr    string   `json:"addr"`               // wallet address
+	Work    string   `json:"work"`               // worker name, by default "x"
+	Agent   string   `json:"agent"`              // the mining software
+	Algos   []string `json:"algos"`              // list of supported algorithms
+	XnBytes uint8    `json:"xn_bytes,omitempty"` // extra nonce bytes requested by downstream proxies
+	Version uint32   `json:"v,omitempty"`        // protocol version, 0 for legacy clients
+	Caps    []string `json:"caps,omitempty"`     // extensions supported by the client
+}
+
+// S2C_Hello is the reply to the handshake of clients with version 1 or newer
+type S2C_Hello struct {
+	Version uint32   `json:"v"`    // negotiated protocol version
+	Caps    []string `json:"caps"` // negotiated extensions
 }
 
 type S2C_Job struct {
-	Diff uint64 `json:"diff"` // difficulty of the job
-	Blob B64    `json:"blob"` // xelis blob, which embeds work hash, extra nonce and public key (96 bytes) encoded as base64 string
+	Diff     uint64 `json:"diff"`                // difficulty of the job
+	Blob     B64    `json:"blob"`                // xelis blob, which embeds work hash, extra nonce and public key (96 bytes) encoded as base64 string
+	Algo     string `json:"algo,omitempty"`      // PoW algorithm of the job, "xel/0" if empty
+	Height   uint64 `json:"height,omitempty"`    // height of the block, if the pool provides it
+	XnPrefix uint8  `json:"xn_prefix,omitempty"` // extra nonce bytes the client must not change, DEFAULT_XN_PREFIX if 0
+	Id       string `json:"id,omitempty"`        // job ID, with CapJobId
+	NetDiff  uint64 `json:"net_diff,omitempty"`  // difficulty of the network, if the pool provides it
 }
 
 type C2S_Submit struct {
-	Data B64    `json:"data"` // the 112-bytes BlockMiner encoded as hex string
-	Hash string `json:"hash"` // the 32-bytes PoW hash of BlockMiner encoded as hex string
+	Data B64    `json:"data"`          // the 112-bytes BlockMiner encoded as hex string
+	Hash string `json:"hash"`          // the 32-bytes PoW hash of BlockMiner encoded as hex string
+	Job  string `json:"job,omitempty"` // ID of the job, with CapJobId
+	Id   uint64 `json:"id,omitempty"`  // ID of the share, echoed in the result with CapShareResult
 }
 
 type S2C_Success struct {
-	Msg string `json:"msg"` // "ok" if share is good, otherwise msg contains the error message
+	Msg string `json:"msg"`          // "ok" if share is good, otherwise msg contains the error message
+	Id  uint64 `json:"id,omitempty"` // ID of the share, with CapShareResult
+}
+
+// S2C_Reconnect asks the client to reconnect, with CapReconnect
+type S2C_Reconnect struct {
+	Host string `json:"host,omitempty"` // the current host if empty
+	Port uint16 `json:"port,omitempty"` // the current port if 0
+	Wait uint32 `json:"wait,omitempty"` // seconds to wait before reconnecting
+}
+
+// S2C_Diff changes the difficulty of the current job, with CapDiff
+type S2C_Diff struct {
+	Diff uint64 `json:"diff"`
+	Job  string `json:"job,omitempty"`
 }
 
 type S2C_Print struct {
@@ -0,0 +1,137 @@
+package xelishash
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Algorithm names, as used in the Xatum handshake
+const (
+	ALGO_V1 = "xel/0"
+	ALGO_V2 = "xel/1"
+)
+
+// Algorithm is a PoW hash function that can be selected by name.
+// Implementations must be safe for concurrent use.
+type Algorithm interface {
+	Name() string
+	Hash(input []byte) ([32]byte, error)
+}
+
+var algosMut sync.RWMutex
+var algos = map[string]Algorithm{}
+
+// Register makes an algorithm available by its name. Registering the same name twice replaces the
+// previous implementation.
+func Register(a Algorithm) {
+	algosMut.Lock()
+	defer algosMut.Unlock()
+
+	algos[a.Name()] = a
+}
+
+// Get returns the algorithm with the given name
+func Get(name string) (Algorithm, error) {
+	algosMut.RLock()
+	defer algosMut.RUnlock()
+
+	a, ok := algos[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %s", name)
+	}
+	return a, nil
+}
+
+// Algorithms returns the names of all the registered algorithms, sorted
+func Algorithms() []string {
+	algosMut.RLock()
+	defer algosMut.RUnlock()
+
+	names := make([]string, 0, len(algos))
+	for k := range algos {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// the scratchpads are big, so they are reused between hashes
+type algoV1 struct {
+	pads sync.Pool
+}
+
+func (a *algoV1) Name() string {
+	return ALGO_V1
+}
+func (a *algoV1) Hash(input []byte) ([32]byte, error) {
+	if len(input) > BYTES_ARRAY_INPUT {
+		return [32]byte{}, fmt.Errorf("%s input is too long", ALGO_V1)
+	}
+
+	buf := make([]byte, BYTES_ARRAY_INPUT)
+	copy(buf, input)
+
+	sp := a.pads.Get().(*ScratchPad)
+	defer a.pads.Put(sp)
+
+	return XelisHash(buf, sp)
+}
+
+type algoV2 struct {
+	pads sync.Pool
+}
+
+func (a *algoV2) Name() string {
+	return ALGO_V2
+}
+func (a *algoV2) Hash(input []byte) ([32]byte, error) {
+	sp := a.pads.Get().(*ScratchPadV2)
+	defer a.pads.Put(sp)
+
+	return XelisHashV2(input, sp)
+}
+
+// optional algorithms, which are only registered by Enable. The xel/1 implementation isn't
+// verified against the reference xelis-hash v2 yet, so the proxy neither advertises it to the pool
+// nor accepts its jobs until it's enabled.
+var optional = map[string]func() Algorithm{
+	ALGO_V2: func() Algorithm {
+		return &algoV2{
+			pads: sync.Pool{New: func() any { return new(ScratchPadV2) }},
+		}
+	},
+}
+
+// Supported reports whether the algorithm is registered, or can be registered by Enable
+func Supported(name string) bool {
+	if _, ok := optional[name]; ok {
+		return true
+	}
+	_, err := Get(name)
+	return err == nil
+}
+
+// Enable registers an optional algorithm, like xel/1. Enabling a registered algorithm does
+// nothing.
+func Enable(name string) error {
+	algosMut.Lock()
+	defer algosMut.Unlock()
+
+	if _, ok := algos[name]; ok {
+		return nil
+	}
+	newAlgo, ok := optional[name]
+	if !ok {
+		return fmt.Errorf("unknown algorithm %s", name)
+	}
+	algos[name] = newAlgo()
+	return nil
+}
+
+func init() {
+	Register(&algoV1{
+		pads: sync.Pool{New: func() any { return new(ScratchPad) }},
+	})
+}
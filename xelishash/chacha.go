@@ -0,0 +1,94 @@
+package xelishash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Minimal ChaCha keystream generator, used by the v2 scratchpad filling stage.
+// Only what xel/1 needs is implemented: a 256-bit key, a 96-bit nonce and a
+// block counter starting at 0.
+
+const CHACHA_NONCE_SIZE = 12
+
+type chacha struct {
+	state  [16]uint32
+	rounds int
+}
+
+func newChacha8(key [32]byte, nonce [CHACHA_NONCE_SIZE]byte) *chacha {
+	return newChacha(key, nonce, 8)
+}
+
+func newChacha(key [32]byte, nonce [CHACHA_NONCE_SIZE]byte, rounds int) *chacha {
+	c := &chacha{rounds: rounds}
+
+	c.state[0] = 0x61707865
+	c.state[1] = 0x3320646e
+	c.state[2] = 0x79622d32
+	c.state[3] = 0x6b206574
+
+	for i := 0; i < 8; i++ {
+		c.state[4+i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+
+	c.state[12] = 0
+	c.state[13] = binary.LittleEndian.Uint32(nonce[0:])
+	c.state[14] = binary.LittleEndian.Uint32(nonce[4:])
+	c.state[15] = binary.LittleEndian.Uint32(nonce[8:])
+
+	return c
+}
+
+func quarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d = bits.RotateLeft32(d^a, 16)
+	c += d
+	b = bits.RotateLeft32(b^c, 12)
+	a += b
+	d = bits.RotateLeft32(d^a, 8)
+	c += d
+	b = bits.RotateLeft32(b^c, 7)
+	return a, b, c, d
+}
+
+func (c *chacha) block(out *[64]byte) {
+	x := c.state
+
+	for i := 0; i < c.rounds; i += 2 {
+		x[0], x[4], x[8], x[12] = quarterRound(x[0], x[4], x[8], x[12])
+		x[1], x[5], x[9], x[13] = quarterRound(x[1], x[5], x[9], x[13])
+		x[2], x[6], x[10], x[14] = quarterRound(x[2], x[6], x[10], x[14])
+		x[3], x[7], x[11], x[15] = quarterRound(x[3], x[7], x[11], x[15])
+
+		x[0], x[5], x[10], x[15] = quarterRound(x[0], x[5], x[10], x[15])
+		x[1], x[6], x[11], x[12] = quarterRound(x[1], x[6], x[11], x[12])
+		x[2], x[7], x[8], x[13] = quarterRound(x[2], x[7], x[8], x[13])
+		x[3], x[4], x[9], x[14] = quarterRound(x[3], x[4], x[9], x[14])
+	}
+
+	for i := 0; i < 16; i++ {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i]+c.state[i])
+	}
+
+	c.state[12]++
+}
+
+// xors the keystream into dst
+func (c *chacha) xorKeyStream(dst []byte) {
+	var buf [64]byte
+
+	for len(dst) > 0 {
+		c.block(&buf)
+
+		n := len(dst)
+		if n > 64 {
+			n = 64
+		}
+
+		for i := 0; i < n; i++ {
+			dst[i] ^= buf[i]
+		}
+		dst = dst[n:]
+	}
+}
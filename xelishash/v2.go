@@ -0,0 +1,213 @@
+package xelishash
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"unsafe"
+
+	"github.com/zeebo/blake3"
+)
+
+// XELIS hash v2 (xel/1)
+
+const MEMORY_SIZE_V2 = 429 * 128
+const MEMORY_SIZE_V2_BYTES = MEMORY_SIZE_V2 * 8
+const SCRATCHPAD_ITERS_V2 = 3
+const BUFFER_SIZE_V2 = MEMORY_SIZE_V2 / 2
+const CHUNK_SIZE_V2 = 32
+
+var KEY_V2 = [16]byte([]byte("xelishash-pow-v2"))
+
+type ScratchPadV2 [MEMORY_SIZE_V2]uint64
+
+// WARNING: this only works on Little Endian architectures
+func scratchpadV2ToBytes(s *ScratchPadV2) *[MEMORY_SIZE_V2_BYTES]byte {
+	return (*[MEMORY_SIZE_V2_BYTES]byte)(unsafe.Pointer(s))
+}
+
+// fills the scratchpad with a ChaCha8 keystream derived from the input, chunk by chunk
+func stage_1_v2(input []byte, scratch_pad *[MEMORY_SIZE_V2_BYTES]byte) {
+	clear(scratch_pad[:])
+
+	input_hash := blake3.Sum256(input)
+
+	var nonce [CHACHA_NONCE_SIZE]byte
+	copy(nonce[:], input_hash[:CHACHA_NONCE_SIZE])
+
+	num_chunks := (len(input) + CHUNK_SIZE_V2 - 1) / CHUNK_SIZE_V2
+	output_offset := 0
+
+	for chunk_index := 0; chunk_index < num_chunks; chunk_index++ {
+		chunk := input[chunk_index*CHUNK_SIZE_V2 : min((chunk_index+1)*CHUNK_SIZE_V2, len(input))]
+
+		var tmp [HASH_SIZE * 2]byte
+		copy(tmp[:HASH_SIZE], input_hash[:])
+		copy(tmp[HASH_SIZE:], chunk)
+
+		input_hash = blake3.Sum256(tmp[:])
+
+		cipher := newChacha8(input_hash, nonce)
+
+		remaining_output_size := MEMORY_SIZE_V2_BYTES - output_offset
+		chunks_left := num_chunks - chunk_index
+		current_output_size := remaining_output_size / chunks_left
+
+		part := scratch_pad[output_offset : output_offset+current_output_size]
+		cipher.xorKeyStream(part)
+
+		output_offset += current_output_size
+
+		copy(nonce[:], part[max(current_output_size-CHACHA_NONCE_SIZE, 0):])
+	}
+}
+
+func murmurhash3(seed uint64) uint64 {
+	seed ^= seed >> 55
+	seed *= 0xff51afd7ed558ccd
+	seed ^= seed >> 32
+	seed *= 0xc4ceb9fe1a85ec53
+	seed ^= seed >> 15
+	return seed
+}
+
+// maps a 64-bit value to an index in one of the two halves of the scratchpad
+func mapIndex(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	hi, _ := bits.Mul64(x, BUFFER_SIZE_V2)
+	return hi
+}
+
+func pickHalf(seed uint64) bool {
+	return murmurhash3(seed)&(1<<58) != 0
+}
+
+func isqrt(n uint64) uint64 {
+	if n < 2 {
+		return n
+	}
+
+	x := n
+	y := (x + 1) >> 1
+	for y < x {
+		x = y
+		y = (x + n/x) >> 1
+	}
+
+	return x
+}
+
+func stage_3_v2(scratch_pad *ScratchPadV2) {
+	mem_buffer_a := scratch_pad[:BUFFER_SIZE_V2]
+	mem_buffer_b := scratch_pad[BUFFER_SIZE_V2:]
+
+	addr_a := mem_buffer_b[BUFFER_SIZE_V2-1]
+	addr_b := mem_buffer_a[BUFFER_SIZE_V2-1] >> 32
+	r := 0
+
+	var block [16]byte
+
+	for i := 0; i < SCRATCHPAD_ITERS_V2; i++ {
+		mem_a := mem_buffer_a[mapIndex(addr_a)]
+		mem_b := mem_buffer_b[mapIndex(mem_a^addr_b)]
+
+		binary.LittleEndian.PutUint64(block[:8], mem_b)
+		binary.LittleEndian.PutUint64(block[8:], mem_a)
+
+		block = aesRound2(block, KEY_V2)
+
+		hash1 := binary.LittleEndian.Uint64(block[:8])
+		hash2 := binary.LittleEndian.Uint64(block[8:])
+
+		result := ^(hash1 ^ hash2)
+
+		for j := 0; j < BUFFER_SIZE_V2; j++ {
+			index_a := mapIndex(result)
+			a := mem_buffer_a[index_a]
+
+			index_b := mapIndex(a ^ ^bits.RotateLeft64(result, -r))
+			b := mem_buffer_b[index_b]
+
+			var c uint64
+			if r < BUFFER_SIZE_V2 {
+				c = mem_buffer_a[r]
+			} else {
+				c = mem_buffer_b[r-BUFFER_SIZE_V2]
+			}
+
+			if r+1 < MEMORY_SIZE_V2 {
+				r++
+			} else {
+				r = 0
+			}
+
+			var v uint64
+			switch bits.RotateLeft64(result, int(c)) & 0xf {
+			case 0:
+				v = bits.RotateLeft64(result, j) ^ b
+			case 1:
+				v = ^(bits.RotateLeft64(result, j) ^ a)
+			case 2:
+				v = ^(result ^ a)
+			case 3:
+				v = result ^ b
+			case 4:
+				v = result ^ (a + b)
+			case 5:
+				v = result ^ (a - b)
+			case 6:
+				v = result ^ (b - a)
+			case 7:
+				v = result ^ (a * b)
+			case 8:
+				v = result ^ (a & b)
+			case 9:
+				v = result ^ (a | b)
+			case 10:
+				v = result ^ (a ^ b)
+			case 11:
+				v = result ^ (a - result)
+			case 12:
+				v = result ^ (b - result)
+			case 13:
+				v = result ^ (a + result)
+			case 14:
+				v = result ^ (result - a)
+			case 15:
+				v = result ^ (result - b)
+			}
+
+			seed := v ^ result
+			result = bits.RotateLeft64(seed, r)
+
+			use_buffer_b := pickHalf(v)
+			index_t := mapIndex(seed)
+
+			var t uint64
+			if use_buffer_b {
+				t = mem_buffer_b[index_t] ^ result
+				mem_buffer_b[index_t] = t
+			} else {
+				t = mem_buffer_a[index_t] ^ result
+				mem_buffer_a[index_t] = t
+			}
+
+			mem_buffer_a[index_a] ^= bits.RotateLeft64(t, -(i + j))
+			mem_buffer_b[index_b] ^= ^bits.RotateLeft64(t, -r)
+		}
+
+		addr_a = result
+		addr_b = isqrt(result)
+	}
+}
+
+// XelisHashV2 computes the xel/1 hash of input, which can have any length
+func XelisHashV2(input []byte, scratch_pad *ScratchPadV2) ([32]byte, error) {
+	spBytes := scratchpadV2ToBytes(scratch_pad)
+
+	stage_1_v2(input, spBytes)
+
+	stage_3_v2(scratch_pad)
+
+	return blake3.Sum256(spBytes[:]), nil
+}
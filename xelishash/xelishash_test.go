@@ -1,6 +1,8 @@
 package xelishash
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"testing"
 )
@@ -61,3 +63,105 @@ func BenchmarkHash(b *testing.B) {
 
 	}
 }
+
+func TestHashV2(t *testing.T) {
+	// NOTE: these vectors were generated by this implementation, so they only catch regressions.
+	// They have to be checked against the reference xelis-hash v2 before xel/1 is registered by
+	// default.
+	var scratch_pad ScratchPadV2
+
+	hash, err := XelisHashV2(make([]byte, 112), &scratch_pad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [32]byte{118, 164, 84, 125, 251, 180, 24, 69, 17, 102, 71, 62, 136, 241, 143, 159,
+		69, 156, 231, 107, 203, 236, 34, 17, 222, 144, 22, 65, 206, 66, 128, 221}
+	if hash != expected {
+		t.Fatalf("hash %x does not match expected hash %x", hash, expected)
+	}
+
+	data := make([]byte, 112)
+
+	copy(data, []byte("xelis-hashing-algorithm"))
+
+	hash, err = XelisHashV2(data, &scratch_pad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = [32]byte{6, 198, 119, 121, 126, 167, 53, 3, 78, 184, 169, 139, 248, 243, 127, 57,
+		33, 17, 181, 111, 255, 205, 188, 226, 4, 183, 45, 198, 190, 139, 103, 44}
+	if hash != expected {
+		t.Fatalf("hash %x does not match expected hash %x", hash, expected)
+	}
+}
+
+func TestChacha(t *testing.T) {
+	// RFC 7539 ChaCha20 keystream with all-zero key and nonce
+	expected, _ := hex.DecodeString("76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7")
+
+	out := make([]byte, 32)
+	newChacha([32]byte{}, [CHACHA_NONCE_SIZE]byte{}, 20).xorKeyStream(out)
+
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("keystream %x does not match expected %x", out, expected)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	// xel/1 isn't verified, so it's only available once enabled
+	if names := Algorithms(); len(names) != 1 || names[0] != ALGO_V1 {
+		t.Fatalf("expected only %s, got %v", ALGO_V1, names)
+	}
+	if !Supported(ALGO_V2) || Supported("xel/99") {
+		t.Fatal("unexpected supported algorithms")
+	}
+	if err := Enable(ALGO_V2); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		algosMut.Lock()
+		delete(algos, ALGO_V2)
+		algosMut.Unlock()
+	})
+	if err := Enable("xel/99"); err == nil {
+		t.Fatal("expected error enabling an unknown algorithm")
+	}
+	if names := Algorithms(); len(names) != 2 || names[1] != ALGO_V2 {
+		t.Fatalf("expected %s to be enabled, got %v", ALGO_V2, names)
+	}
+
+	for _, name := range []string{ALGO_V1, ALGO_V2} {
+		algo, err := Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h1, err := algo.Hash(make([]byte, 112))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h2, err := algo.Hash(make([]byte, 112))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h1 != h2 {
+			t.Fatalf("%s: hashing is not deterministic", name)
+		}
+	}
+
+	_, err := Get("xel/99")
+	if err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
+
+func BenchmarkHashV2(b *testing.B) {
+	var scratch_pad ScratchPadV2
+
+	var input = make([]byte, 112)
+
+	for i := 0; i < b.N; i++ {
+		XelisHashV2(input, &scratch_pad)
+	}
+}
@@ -0,0 +1,213 @@
+package xelisutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// XELIS addresses are bech32 strings, with ':' as the separator between the prefix and the data:
+// "xel:..." on mainnet and "xet:..." on testnet. The data is the 32-byte public key, followed by the
+// address type: 0 for normal addresses, or 1 and the serialized data of integrated addresses.
+
+const (
+	PREFIX_ADDRESS         = "xel"
+	TESTNET_PREFIX_ADDRESS = "xet"
+
+	ADDRESS_SEPARATOR = ':'
+
+	ADDRESS_TYPE_NORMAL = 0
+	ADDRESS_TYPE_DATA   = 1
+)
+
+// the longest address accepted, including the integrated data
+const MAX_ADDRESS_LENGTH = 1024
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+var ErrInvalidAddress = errors.New("invalid address")
+
+// Address is a decoded XELIS address
+type Address struct {
+	Mainnet   bool
+	PublicKey [32]byte
+	Data      []byte // serialized data of integrated addresses, nil for normal addresses
+}
+
+// IsIntegrated returns true if the address has integrated data
+func (a Address) IsIntegrated() bool {
+	return a.Data != nil
+}
+
+// Network returns "mainnet" or "testnet"
+func (a Address) Network() string {
+	if a.Mainnet {
+		return "mainnet"
+	}
+	return "testnet"
+}
+
+// String encodes the address
+func (a Address) String() string {
+	hrp := PREFIX_ADDRESS
+	if !a.Mainnet {
+		hrp = TESTNET_PREFIX_ADDRESS
+	}
+
+	raw := append(a.PublicKey[:], ADDRESS_TYPE_NORMAL)
+	if a.Data != nil {
+		raw = append(a.PublicKey[:], ADDRESS_TYPE_DATA)
+		raw = append(raw, a.Data...)
+	}
+
+	data, _ := convertBits(raw, 8, 5, true)
+
+	sb := strings.Builder{}
+	sb.WriteString(hrp)
+	sb.WriteByte(ADDRESS_SEPARATOR)
+	for _, v := range append(data, bech32Checksum(hrp, data)...) {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String()
+}
+
+// ParseAddress decodes a XELIS address. The errors wrap ErrInvalidAddress, and say why the
+// address is invalid.
+func ParseAddress(s string) (Address, error) {
+	invalid := func(format string, a ...any) (Address, error) {
+		return Address{}, fmt.Errorf("%w: "+format, append([]any{ErrInvalidAddress}, a...)...)
+	}
+
+	if len(s) > MAX_ADDRESS_LENGTH {
+		return invalid("too long")
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return invalid("mixed case")
+	}
+	s = strings.ToLower(s)
+
+	hrp, dataStr, ok := strings.Cut(s, string(ADDRESS_SEPARATOR))
+	if !ok {
+		return invalid("missing prefix, it should start with %s%c", PREFIX_ADDRESS, ADDRESS_SEPARATOR)
+	}
+
+	addr := Address{}
+	switch hrp {
+	case PREFIX_ADDRESS:
+		addr.Mainnet = true
+	case TESTNET_PREFIX_ADDRESS:
+		addr.Mainnet = false
+	default:
+		return invalid("unknown prefix %q, expected %s or %s", hrp, PREFIX_ADDRESS, TESTNET_PREFIX_ADDRESS)
+	}
+
+	if len(dataStr) < 6 {
+		return invalid("too short")
+	}
+
+	data := make([]byte, len(dataStr))
+	for i := range dataStr {
+		n := strings.IndexByte(bech32Charset, dataStr[i])
+		if n < 0 {
+			return invalid("invalid character %q", dataStr[i])
+		}
+		data[i] = byte(n)
+	}
+
+	if bech32Polymod(append(hrpExpand(hrp), data...)) != 1 {
+		return invalid("wrong checksum, the address may have a typo")
+	}
+	data = data[:len(data)-6]
+
+	raw, err := convertBits(data, 5, 8, false)
+	if err != nil {
+		return invalid("%s", err)
+	}
+
+	if len(raw) < 33 {
+		return invalid("too short")
+	}
+
+	copy(addr.PublicKey[:], raw[:32])
+
+	switch raw[32] {
+	case ADDRESS_TYPE_NORMAL:
+		if len(raw) != 33 {
+			return invalid("unexpected data after the public key")
+		}
+	case ADDRESS_TYPE_DATA:
+		addr.Data = raw[33:]
+	default:
+		return invalid("unknown address type %d", raw[32])
+	}
+
+	return addr, nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range bech32Generator {
+			if (top>>i)&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	res := make([]byte, 0, len(hrp)*2+1)
+	for i := range hrp {
+		res = append(res, hrp[i]>>5)
+	}
+	res = append(res, 0)
+	for i := range hrp {
+		res = append(res, hrp[i]&31)
+	}
+	return res
+}
+
+func bech32Checksum(hrp string, data []byte) []byte {
+	values := append(hrpExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+
+	mod := bech32Polymod(values) ^ 1
+
+	res := make([]byte, 6)
+	for i := range res {
+		res[i] = byte(mod>>(5*(5-i))) & 31
+	}
+	return res
+}
+
+// converts a byte slice from groups of fromBits bits to groups of toBits bits
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	acc := uint32(0)
+	bits := uint(0)
+	maxv := uint32(1)<<toBits - 1
+
+	res := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, v := range data {
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			res = append(res, byte(acc>>bits&maxv))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			res = append(res, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+
+	return res, nil
+}
@@ -0,0 +1,120 @@
+package xelisutil
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// mainnet addresses from the XELIS ecosystem
+var testAddresses = []string{
+	"xel:vs3mfyywt0fjys0rgslue7mm4wr23xdgejsjk0ld7f2kxng4d4nqqnkdufz",
+	"xel:ys4peuzztwl67rzhsdu0yxfzwcfmgt85uu53hycpeeary7n8qvysqmxznt0",
+}
+
+func TestParseAddress(t *testing.T) {
+	for _, v := range testAddresses {
+		addr, err := ParseAddress(v)
+		if err != nil {
+			t.Fatalf("%s: %v", v, err)
+		}
+		if !addr.Mainnet || addr.IsIntegrated() {
+			t.Fatalf("%s: expected a normal mainnet address, got %+v", v, addr)
+		}
+		if addr.String() != v {
+			t.Fatalf("expected %s, got %s", v, addr.String())
+		}
+
+		upper, err := ParseAddress(strings.ToUpper(v))
+		if err != nil || upper.PublicKey != addr.PublicKey {
+			t.Fatalf("%s: uppercase address should be valid, got %v", v, err)
+		}
+	}
+}
+
+func TestAddressRoundTrip(t *testing.T) {
+	key := [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26,
+		27, 28, 29, 30, 31, 32}
+
+	for _, addr := range []Address{
+		{Mainnet: false, PublicKey: key},
+		{Mainnet: true, PublicKey: key, Data: []byte{0x01, 0x02, 0x03}},
+		{Mainnet: false, PublicKey: key, Data: []byte{}},
+	} {
+		s := addr.String()
+
+		prefix := PREFIX_ADDRESS + ":"
+		if !addr.Mainnet {
+			prefix = TESTNET_PREFIX_ADDRESS + ":"
+		}
+		if !strings.HasPrefix(s, prefix) {
+			t.Fatalf("expected prefix %s, got %s", prefix, s)
+		}
+
+		decoded, err := ParseAddress(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if decoded.Mainnet != addr.Mainnet || decoded.PublicKey != addr.PublicKey ||
+			decoded.IsIntegrated() != addr.IsIntegrated() || !bytes.Equal(decoded.Data, addr.Data) {
+			t.Fatalf("expected %+v, got %+v", addr, decoded)
+		}
+	}
+}
+
+func TestParseAddressErrors(t *testing.T) {
+	valid := testAddresses[0]
+
+	// the checksum of the testnet prefix doesn't match the mainnet data
+	wrongNetwork := TESTNET_PREFIX_ADDRESS + strings.TrimPrefix(valid, PREFIX_ADDRESS)
+
+	// a change in the last data character, before the checksum
+	typo := []byte(valid)
+	typo[len(typo)-7] = 'q'
+	if typo[len(typo)-7] == valid[len(valid)-7] {
+		typo[len(typo)-7] = 'p'
+	}
+
+	tests := map[string]string{
+		"":                                      "missing prefix",
+		"YOUR WALLET ADDRESS HERE":              "missing prefix",
+		"xel1" + valid[4:]:                      "missing prefix",
+		"btc:" + valid[4:]:                      `unknown prefix "btc"`,
+		"xel:qqq":                               "too short",
+		"xel:" + valid[4:10] + "b" + valid[11:]: `invalid character 'b'`,
+		"Xel:" + valid[4:]:                      "mixed case",
+		wrongNetwork:                            "wrong checksum",
+		string(typo):                            "wrong checksum",
+		Address{Mainnet: true}.String()[:20] + strings.Repeat("q", MAX_ADDRESS_LENGTH): "too long",
+	}
+
+	for s, expected := range tests {
+		_, err := ParseAddress(s)
+		if err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+		if !errors.Is(err, ErrInvalidAddress) || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected error %q, got %q", s, expected, err)
+		}
+	}
+}
+
+func TestParseAddressType(t *testing.T) {
+	// a valid bech32 string with an unknown address type
+	raw := append(make([]byte, 32), 7)
+	data, err := convertBits(raw, 8, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := PREFIX_ADDRESS + ":"
+	for _, v := range append(data, bech32Checksum(PREFIX_ADDRESS, data)...) {
+		s += string(bech32Charset[v])
+	}
+
+	_, err = ParseAddress(s)
+	if err == nil || !strings.Contains(err.Error(), "unknown address type 7") {
+		t.Fatalf("expected an unknown address type error, got %v", err)
+	}
+}
@@ -91,6 +91,9 @@ func (b BlockMiner) Hash() [32]byte {
 func (b BlockMiner) PowHash(sp *xelishash.ScratchPad) [32]byte {
 	return PowHash(b[:], sp)
 }
+func (b BlockMiner) PowHashAlgo(algo string) ([32]byte, error) {
+	return PowHashAlgo(algo, b[:])
+}
 
 func (b BlockMiner) GetWorkhash() [32]byte {
 	return [32]byte(b[:32])
@@ -27,3 +27,13 @@ func PowHash(d []byte, scratchpad *xelishash.ScratchPad) [32]byte {
 
 	return data
 }
+
+// PowHashAlgo hashes d with the algorithm called algo
+func PowHashAlgo(algo string, d []byte) ([32]byte, error) {
+	a, err := xelishash.Get(algo)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return a.Hash(d)
+}